@@ -0,0 +1,166 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+// handleChallenge answers the challenge sent from the server plugin.
+func (p *IIDAttestorPlugin) handleChallenge(ctx context.Context, b []byte) ([]byte, error) {
+	challenge := &common.Challenge{}
+	if err := json.Unmarshal(b, challenge); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal challenge: %v", err)
+	}
+
+	p.logger.Debug("Received challenge", "type", challenge.Type)
+
+	resp := &common.ChallengeResponse{
+		Type: challenge.Type,
+	}
+
+	switch challenge.Type {
+	case common.ChallengeTypeMetadataNonce:
+		nonce, err := p.waitMetadataValue(ctx, challenge.MetadataKey)
+		if err != nil {
+			return nil, err
+		}
+		resp.Nonce = nonce
+	case common.ChallengeTypeBootstrapToken:
+		token, err := p.metadataValue(challenge.MetadataKey)
+		if err != nil {
+			return nil, err
+		}
+		resp.Nonce = token
+	case common.ChallengeTypeIdentityDocument:
+		if p.getVendorDataHandler == nil {
+			return nil, errors.New("handler not found, plugin not initialized")
+		}
+		vd, err := p.getVendorDataHandler()
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve openstack vendordata: %v", err)
+		}
+		doc, err := openstack.IdentityDocumentFromVendorData(vd, challenge.VendorDataName)
+		if err != nil {
+			return nil, err
+		}
+		resp.IdentityDocument = doc
+	case common.ChallengeTypeKeyPair:
+		sig, err := p.signKeyPairChallenge(challenge.Nonce)
+		if err != nil {
+			return nil, err
+		}
+		resp.Signature = sig
+	default:
+		return nil, fmt.Errorf("unsupported challenge type: %q", challenge.Type)
+	}
+
+	return json.Marshal(resp)
+}
+
+// metadataValue returns the value of given key in the instance metadata.
+func (p *IIDAttestorPlugin) metadataValue(key string) (string, error) {
+	if key == "" {
+		return "", errors.New("challenge has no metadata key")
+	}
+
+	meta, err := p.getMetadataHandler()
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve openstack metadata: %v", err)
+	}
+	v, ok := meta.Meta[key]
+	if !ok || v == "" {
+		return "", fmt.Errorf("instance metadata has no %q", key)
+	}
+	return v, nil
+}
+
+// waitMetadataValue polls the metadata service until the instance metadata has given key.
+func (p *IIDAttestorPlugin) waitMetadataValue(ctx context.Context, key string) (string, error) {
+	if key == "" {
+		return "", errors.New("challenge has no metadata key")
+	}
+	if p.getServiceMetadataHandler == nil {
+		return "", errors.New("handler not found, plugin not initialized")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.metadataPollTimeout)
+	defer cancel()
+
+	for {
+		meta, err := p.getServiceMetadataHandler()
+		if err != nil {
+			return "", fmt.Errorf("failed to retrieve openstack metadata: %v", err)
+		}
+		if v, ok := meta.Meta[key]; ok && v != "" {
+			return v, nil
+		}
+
+		p.logger.Debug("Metadata key not found yet, retrying", "key", key)
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("metadata key %q did not appear in the instance metadata: %v", key, ctx.Err())
+		case <-time.After(p.metadataPollInterval):
+		}
+	}
+}
+
+// signKeyPairChallenge signs the nonce with the private key of the instance's keypair.
+func (p *IIDAttestorPlugin) signKeyPairChallenge(nonce string) ([]byte, error) {
+	config, err := p.getConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.PrivateKeyPath == "" {
+		return nil, errors.New("private_key_path is required to answer the keypair challenge")
+	}
+
+	b, err := ioutil.ReadFile(config.PrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+
+	meta, err := p.getMetadataHandler()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve openstack metadata: %v", err)
+	}
+	data := common.KeyPairChallengeData(meta.UUID, nonce)
+
+	var sig *ssh.Signature
+	if signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		// The server rejects SHA-1 based "ssh-rsa" signatures.
+		as, ok := signer.(ssh.AlgorithmSigner)
+		if !ok {
+			return nil, errors.New("failed to sign keypair challenge: RSA key can't sign with rsa-sha2-256")
+		}
+		sig, err = as.SignWithAlgorithm(rand.Reader, data, ssh.SigAlgoRSASHA2256)
+	} else {
+		sig, err = signer.Sign(rand.Reader, data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign keypair challenge: %v", err)
+	}
+
+	return ssh.Marshal(sig), nil
+}
@@ -9,60 +9,335 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/hcl"
 	"github.com/spiffe/spire-plugin-sdk/pluginmain"
 	nodeattestorv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/agent/nodeattestor/v1"
 	configv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/service/common/config/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
 	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
 )
 
+const (
+	// The metadata service may serve cached metadata for a while, so the nonce written by the
+	// server doesn't appear immediately.
+	defaultMetadataPollInterval = 2 * time.Second
+	defaultMetadataPollTimeout  = time.Minute
+
+	defaultMetadataRetryInterval = time.Second
+
+	defaultCloudMetadataKey = "spire_cloud"
+
+	payloadNonceSize = 16
+)
+
 // IIDAttestorPlugin implements the nodeattestor Plugin interface
 type IIDAttestorPlugin struct {
 	nodeattestorv1.UnsafeNodeAttestorServer
 	configv1.UnsafeConfigServer
 
 	logger hclog.Logger
+	config *IIDAttestorPluginConfig
+	mtx    *sync.RWMutex
+
+	getMetadataHandler   func() (*openstack.Metadata, error)
+	getVendorDataHandler func() (openstack.VendorData, error)
+	// getServiceMetadataHandler reads the metadata service regardless of metadata_sources, since only it
+	// sees the metadata the server plugin sets during the attestation.
+	getServiceMetadataHandler func() (*openstack.Metadata, error)
 
-	getMetadataHandler func() (*openstack.Metadata, error)
+	metadataPollInterval time.Duration
+	metadataPollTimeout  time.Duration
+}
+
+type IIDAttestorPluginConfig struct {
+	// PrivateKeyPath is the path to the private key of the Nova keypair the instance was booted with.
+	// It is required to answer the keypair challenge.
+	//
+	//  plugin_data {
+	//     private_key_path = "/etc/spire/agent/keypair.pem"
+	//  }
+	//
+	PrivateKeyPath string `hcl:"private_key_path"`
+	// MetadataSources is the ordered list of sources to read the instance metadata from.
+	// The sources are tried in turn until the instance UUID is found, and the later sources fill in
+	// the fields the earlier sources don't provide. Defaults to ["metadata_service"].
+	// "ec2" doesn't provide the instance UUID, so it must be combined with another source.
+	// The metadata challenge is always answered from the metadata service, since the config drive
+	// and cloud-init don't see the nonce the server plugin sets.
+	//
+	//  plugin_data {
+	//     // "metadata_service", "config_drive", "cloud_init" or "ec2"
+	//     metadata_sources = ["metadata_service", "config_drive"]
+	//     // optional, the config drive is mounted temporarily if empty
+	//     config_drive_path = "/mnt/config"
+	//  }
+	//
+	MetadataSources []string `hcl:"metadata_sources"`
+	ConfigDrivePath string   `hcl:"config_drive_path"`
+	// MetadataService configures how the metadata service is accessed. It is used by the
+	// "metadata_service" and "ec2" sources. Agents often start before the network is fully up,
+	// so requests are retried with exponential backoff.
+	//
+	//  plugin_data {
+	//     // optional, defaults to "http://169.254.169.254"
+	//     metadata_url = "http://169.254.169.254"
+	//     // optional, use the IPv6 link-local address fe80::a9fe:a9fe through the interface instead
+	//     metadata_ipv6_interface = "eth0"
+	//     // optional, tried in order while the metadata service responds 404
+	//     metadata_versions = ["latest", "2018-08-27"]
+	//     // optional, the timeout of each request, defaults to "10s"
+	//     metadata_timeout = "5s"
+	//     // optional, defaults to 0
+	//     metadata_retries = 5
+	//     // optional, the interval before the first retry, defaults to "1s"
+	//     metadata_retry_interval = "2s"
+	//  }
+	//
+	MetadataURL           string   `hcl:"metadata_url"`
+	MetadataIPv6Interface string   `hcl:"metadata_ipv6_interface"`
+	MetadataVersions      []string `hcl:"metadata_versions"`
+	MetadataTimeout       string   `hcl:"metadata_timeout"`
+	MetadataRetries       int      `hcl:"metadata_retries"`
+	MetadataRetryInterval string   `hcl:"metadata_retry_interval"`
+	// CloudMetadataKey is the instance metadata key which holds the identifier of the cloud the instance is on.
+	// The agent states the cloud to the server plugin, which attests instances of multiple clouds.
+	//
+	//  plugin_data {
+	//     // optional, defaults to "spire_cloud"
+	//     cloud_metadata_key = "spire_cloud"
+	//  }
+	//
+	CloudMetadataKey string `hcl:"cloud_metadata_key"`
+
+	sources         openstack.MetadataSources
+	metadataService *openstack.MetadataService
 }
 
 func newPlugin() *IIDAttestorPlugin {
-	return &IIDAttestorPlugin{
-		getMetadataHandler: openstack.GetMetadataFromMetadataService,
+	p := &IIDAttestorPlugin{
+		mtx:                  &sync.RWMutex{},
+		metadataPollInterval: defaultMetadataPollInterval,
+		metadataPollTimeout:  defaultMetadataPollTimeout,
 	}
+	p.getMetadataHandler = p.getMetadata
+	p.getVendorDataHandler = p.getVendorData
+	p.getServiceMetadataHandler = p.getServiceMetadata
+	return p
 }
 
-func (p *IIDAttestorPlugin) Configure(_ context.Context, _ *configv1.ConfigureRequest) (*configv1.ConfigureResponse, error) {
+func (p *IIDAttestorPlugin) Configure(_ context.Context, req *configv1.ConfigureRequest) (*configv1.ConfigureResponse, error) {
+	config := &IIDAttestorPluginConfig{}
+	if err := hcl.Decode(config, req.HclConfiguration); err != nil {
+		return nil, fmt.Errorf("failed to decode configuration file: %w", err)
+	}
+
+	if config.CloudMetadataKey == "" {
+		config.CloudMetadataKey = defaultCloudMetadataKey
+	}
+	if len(config.MetadataSources) == 0 {
+		config.MetadataSources = []string{openstack.MetadataSourceMetadataService}
+	}
+	serviceOpts, err := metadataServiceOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	providesUUID := false
+	for _, name := range config.MetadataSources {
+		source, err := openstack.NewMetadataSource(name, openstack.MetadataSourceOptions{
+			ConfigDrivePath: config.ConfigDrivePath,
+			MetadataService: serviceOpts,
+		})
+		if err != nil {
+			return nil, err
+		}
+		config.sources = append(config.sources, source)
+		providesUUID = providesUUID || name != openstack.MetadataSourceEC2
+	}
+	if !providesUUID {
+		return nil, fmt.Errorf("metadata_sources requires %q, %q or %q, which provide the instance uuid",
+			openstack.MetadataSourceMetadataService, openstack.MetadataSourceConfigDrive, openstack.MetadataSourceCloudInit)
+	}
+	config.metadataService = openstack.NewMetadataService(serviceOpts)
+
+	p.setConfig(config)
+
 	return &configv1.ConfigureResponse{}, nil
 }
 
+// metadataServiceOptions returns the options to access the metadata service from the configuration.
+func metadataServiceOptions(config *IIDAttestorPluginConfig) (openstack.MetadataServiceOptions, error) {
+	opts := openstack.MetadataServiceOptions{
+		URL:           config.MetadataURL,
+		Versions:      config.MetadataVersions,
+		Retries:       config.MetadataRetries,
+		RetryInterval: defaultMetadataRetryInterval,
+	}
+
+	if config.MetadataIPv6Interface != "" {
+		if config.MetadataURL != "" {
+			return opts, errors.New("metadata_url and metadata_ipv6_interface are mutually exclusive")
+		}
+		opts.URL = openstack.MetadataIPv6URL(config.MetadataIPv6Interface)
+	}
+	opts.URL = strings.TrimSuffix(opts.URL, "/")
+	if config.MetadataTimeout != "" {
+		d, err := time.ParseDuration(config.MetadataTimeout)
+		if err != nil {
+			return opts, fmt.Errorf("invalid metadata_timeout: %v", err)
+		}
+		if d <= 0 {
+			return opts, errors.New("metadata_timeout must be positive")
+		}
+		opts.Timeout = d
+	}
+	if config.MetadataRetries < 0 {
+		return opts, errors.New("metadata_retries must not be negative")
+	}
+	if config.MetadataRetryInterval != "" {
+		d, err := time.ParseDuration(config.MetadataRetryInterval)
+		if err != nil {
+			return opts, fmt.Errorf("invalid metadata_retry_interval: %v", err)
+		}
+		if d < 0 {
+			return opts, errors.New("metadata_retry_interval must not be negative")
+		}
+		opts.RetryInterval = d
+	}
+
+	return opts, nil
+}
+
 func (p *IIDAttestorPlugin) AidAttestation(stream nodeattestorv1.NodeAttestor_AidAttestationServer) error {
 	p.logger.Info("Prepare Attestation Request")
 
 	if p.getMetadataHandler == nil {
 		return errors.New("handler not found, plugin not initialized")
 	}
+	config, err := p.getConfig()
+	if err != nil {
+		return err
+	}
 
 	meta, err := p.getMetadataHandler()
 	if err != nil {
 		return fmt.Errorf("failed to retrieve openstack metadata: %v", err)
 	}
 
-	return stream.Send(&nodeattestorv1.PayloadOrChallengeResponse{
-		Data: &nodeattestorv1.PayloadOrChallengeResponse_Payload{
-			Payload: []byte(meta.UUID),
+	nonce := make([]byte, payloadNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	payload, err := json.Marshal(&common.AttestationPayload{
+		Version: common.PayloadVersion,
+		UUID:    meta.UUID,
+		Cloud:   meta.Meta[config.CloudMetadataKey],
+		Evidence: &common.Evidence{
+			Name:             meta.Name,
+			AvailabilityZone: meta.AvailabilityZone,
+			ProjectID:        meta.ProjectID,
+			Hostname:         meta.Hostname,
 		},
+		Nonce:     hex.EncodeToString(nonce),
+		Timestamp: time.Now().UTC(),
 	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal attestation payload: %v", err)
+	}
+
+	if err := stream.Send(&nodeattestorv1.PayloadOrChallengeResponse{
+		Data: &nodeattestorv1.PayloadOrChallengeResponse_Payload{
+			Payload: payload,
+		},
+	}); err != nil {
+		return err
+	}
+
+	for {
+		req, err := stream.Recv()
+		switch {
+		case errors.Is(err, io.EOF), status.Code(err) == codes.Canceled:
+			// The server finished the attestation without any more challenges.
+			return nil
+		case err != nil:
+			return err
+		}
+
+		resp, err := p.handleChallenge(stream.Context(), req.GetChallenge())
+		if err != nil {
+			return err
+		}
+
+		if err := stream.Send(&nodeattestorv1.PayloadOrChallengeResponse{
+			Data: &nodeattestorv1.PayloadOrChallengeResponse_ChallengeResponse{
+				ChallengeResponse: resp,
+			},
+		}); err != nil {
+			return err
+		}
+	}
 }
 
 func (p *IIDAttestorPlugin) SetLogger(log hclog.Logger) {
 	p.logger = log
 }
 
+// getMetadata reads the instance metadata from the configured sources.
+func (p *IIDAttestorPlugin) getMetadata() (*openstack.Metadata, error) {
+	config, err := p.getConfig()
+	if err != nil {
+		return nil, err
+	}
+	return config.sources.Metadata()
+}
+
+// getServiceMetadata reads the instance metadata from the metadata service.
+func (p *IIDAttestorPlugin) getServiceMetadata() (*openstack.Metadata, error) {
+	config, err := p.getConfig()
+	if err != nil {
+		return nil, err
+	}
+	return config.metadataService.Metadata()
+}
+
+// getVendorData reads the dynamic vendordata from the configured sources.
+func (p *IIDAttestorPlugin) getVendorData() (openstack.VendorData, error) {
+	config, err := p.getConfig()
+	if err != nil {
+		return nil, err
+	}
+	return config.sources.VendorData()
+}
+
+func (p *IIDAttestorPlugin) setConfig(config *IIDAttestorPluginConfig) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.config = config
+}
+
+func (p *IIDAttestorPlugin) getConfig() (*IIDAttestorPluginConfig, error) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	if p.config == nil {
+		return nil, errors.New("plugin not configured")
+	}
+	return p.config, nil
+}
+
 func main() {
 	p := newPlugin()
 	pluginmain.Serve(
@@ -8,10 +8,28 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
+	configv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/service/common/config/v1"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
 	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
 	"github.com/zlabjp/spire-openstack-plugin/pkg/testutil"
 	fake_agent "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/agent"
@@ -19,7 +37,11 @@ import (
 
 func newTestPlugin() *IIDAttestorPlugin {
 	return &IIDAttestorPlugin{
-		logger: testutil.TestLogger(),
+		logger:               testutil.TestLogger(),
+		config:               &IIDAttestorPluginConfig{},
+		mtx:                  &sync.RWMutex{},
+		metadataPollInterval: time.Millisecond,
+		metadataPollTimeout:  100 * time.Millisecond,
 	}
 }
 
@@ -27,9 +49,11 @@ func TestAidAttestation(t *testing.T) {
 	p := newTestPlugin()
 	p.getMetadataHandler = func() (*openstack.Metadata, error) {
 		return &openstack.Metadata{
-			UUID:      "alpha",
-			Name:      "bravo",
-			ProjectID: "charlie",
+			UUID:             "alpha",
+			Name:             "bravo",
+			AvailabilityZone: "delta",
+			ProjectID:        "charlie",
+			Hostname:         "bravo.novalocal",
 		}, nil
 	}
 
@@ -38,8 +62,135 @@ func TestAidAttestation(t *testing.T) {
 	if err := p.AidAttestation(f); err != nil {
 		t.Errorf("unexpected error from FetchAttestationData(): %v", err)
 	}
-	if _, err := f.Recv(); err != nil {
-		t.Errorf("unexptected error from stream.Recv(): %v", err)
+	payload := &common.AttestationPayload{}
+	if err := json.Unmarshal(f.Payload(), payload); err != nil {
+		t.Fatalf("failed to unmarshal payload: %v", err)
+	}
+	if payload.Version != common.PayloadVersion || payload.UUID != "alpha" {
+		t.Errorf("unexpected payload: %+v", payload)
+	}
+	want := &common.Evidence{
+		Name:             "bravo",
+		AvailabilityZone: "delta",
+		ProjectID:        "charlie",
+		Hostname:         "bravo.novalocal",
+	}
+	if !reflect.DeepEqual(payload.Evidence, want) {
+		t.Errorf("got evidence %+v, want %+v", payload.Evidence, want)
+	}
+	if payload.Nonce == "" || time.Since(payload.Timestamp) > time.Minute {
+		t.Errorf("unexpected nonce or timestamp: %+v", payload)
+	}
+	if payload.Cloud != "" {
+		t.Errorf("got cloud %q, want empty", payload.Cloud)
+	}
+}
+
+func TestAidAttestationCloud(t *testing.T) {
+	p := newTestPlugin()
+	p.config.CloudMetadataKey = defaultCloudMetadataKey
+	p.getMetadataHandler = func() (*openstack.Metadata, error) {
+		return &openstack.Metadata{
+			UUID: "alpha",
+			Meta: map[string]string{defaultCloudMetadataKey: "east"},
+		}, nil
+	}
+
+	f := fake_agent.NewAidAttestationStream()
+
+	if err := p.AidAttestation(f); err != nil {
+		t.Errorf("unexpected error from AidAttestation(): %v", err)
+	}
+	payload := &common.AttestationPayload{}
+	if err := json.Unmarshal(f.Payload(), payload); err != nil {
+		t.Fatalf("failed to unmarshal payload: %v", err)
+	}
+	if payload.Cloud != "east" {
+		t.Errorf("got cloud %q, want %q", payload.Cloud, "east")
+	}
+}
+
+func TestAidAttestationMetadataChallenge(t *testing.T) {
+	p := newTestPlugin()
+	p.getMetadataHandler = func() (*openstack.Metadata, error) {
+		return &openstack.Metadata{
+			UUID: "alpha",
+		}, nil
+	}
+	calls := 0
+	p.getServiceMetadataHandler = func() (*openstack.Metadata, error) {
+		calls++
+		meta := &openstack.Metadata{
+			UUID: "alpha",
+		}
+		// the nonce appears after the metadata service cache expired
+		if calls > 2 {
+			meta.Meta = map[string]string{"nonce-key": "delta"}
+		}
+		return meta, nil
+	}
+
+	challenge, _ := json.Marshal(&common.Challenge{
+		Type:        common.ChallengeTypeMetadataNonce,
+		MetadataKey: "nonce-key",
+	})
+	f := fake_agent.NewAidAttestationStream(challenge)
+
+	if err := p.AidAttestation(f); err != nil {
+		t.Fatalf("unexpected error from AidAttestation(): %v", err)
+	}
+
+	responses := f.ChallengeResponses()
+	if len(responses) != 1 {
+		t.Fatalf("got %v challenge responses, want 1", len(responses))
+	}
+	resp := &common.ChallengeResponse{}
+	if err := json.Unmarshal(responses[0], resp); err != nil {
+		t.Fatalf("failed to unmarshal challenge response: %v", err)
+	}
+	if resp.Type != common.ChallengeTypeMetadataNonce || resp.Nonce != "delta" {
+		t.Errorf("unexpected challenge response: %+v", resp)
+	}
+}
+
+func TestAidAttestationMetadataChallengeTimeout(t *testing.T) {
+	p := newTestPlugin()
+	p.getMetadataHandler = func() (*openstack.Metadata, error) {
+		return &openstack.Metadata{
+			UUID: "alpha",
+		}, nil
+	}
+	p.getServiceMetadataHandler = p.getMetadataHandler
+
+	challenge, _ := json.Marshal(&common.Challenge{
+		Type:        common.ChallengeTypeMetadataNonce,
+		MetadataKey: "nonce-key",
+	})
+	f := fake_agent.NewAidAttestationStream(challenge)
+
+	if err := p.AidAttestation(f); err == nil {
+		t.Error("expected an error, got nil")
+	}
+}
+
+func TestAidAttestationUnsupportedChallenge(t *testing.T) {
+	p := newTestPlugin()
+	p.getMetadataHandler = func() (*openstack.Metadata, error) {
+		return &openstack.Metadata{
+			UUID: "alpha",
+		}, nil
+	}
+
+	challenge, _ := json.Marshal(&common.Challenge{
+		Type: "unknown",
+	})
+	f := fake_agent.NewAidAttestationStream(challenge)
+
+	wantErr := `unsupported challenge type: "unknown"`
+	if err := p.AidAttestation(f); err == nil {
+		t.Error("expected an error, got nil")
+	} else if err.Error() != wantErr {
+		t.Errorf("got %v, want %v", err, wantErr)
 	}
 }
 
@@ -79,3 +230,376 @@ func TestFetchAttestationDataMetadataHandlerNotFound(t *testing.T) {
 		}
 	}
 }
+
+func TestAidAttestationIdentityDocumentChallenge(t *testing.T) {
+	p := newTestPlugin()
+	p.getMetadataHandler = func() (*openstack.Metadata, error) {
+		return &openstack.Metadata{
+			UUID: "alpha",
+		}, nil
+	}
+	p.getVendorDataHandler = func() (openstack.VendorData, error) {
+		return openstack.VendorData{
+			"spire": json.RawMessage(`{"identity_document": "signed-token"}`),
+		}, nil
+	}
+
+	challenge, _ := json.Marshal(&common.Challenge{
+		Type:           common.ChallengeTypeIdentityDocument,
+		VendorDataName: "spire",
+	})
+	f := fake_agent.NewAidAttestationStream(challenge)
+
+	if err := p.AidAttestation(f); err != nil {
+		t.Fatalf("unexpected error from AidAttestation(): %v", err)
+	}
+
+	responses := f.ChallengeResponses()
+	if len(responses) != 1 {
+		t.Fatalf("got %v challenge responses, want 1", len(responses))
+	}
+	resp := &common.ChallengeResponse{}
+	if err := json.Unmarshal(responses[0], resp); err != nil {
+		t.Fatalf("failed to unmarshal challenge response: %v", err)
+	}
+	if resp.IdentityDocument != "signed-token" {
+		t.Errorf("got identity document %v, want %v", resp.IdentityDocument, "signed-token")
+	}
+}
+
+func TestAidAttestationKeyPairChallenge(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "keypair.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+
+	p := newTestPlugin()
+	conf := fmt.Sprintf(`private_key_path = "%s"`, keyPath)
+	if _, err := p.Configure(context.Background(), &configv1.ConfigureRequest{HclConfiguration: conf}); err != nil {
+		t.Fatalf("unexpected error from Configure(): %v", err)
+	}
+	p.getMetadataHandler = func() (*openstack.Metadata, error) {
+		return &openstack.Metadata{
+			UUID: "alpha",
+		}, nil
+	}
+
+	challenge, _ := json.Marshal(&common.Challenge{
+		Type:  common.ChallengeTypeKeyPair,
+		Nonce: "bravo",
+	})
+	f := fake_agent.NewAidAttestationStream(challenge)
+
+	if err := p.AidAttestation(f); err != nil {
+		t.Fatalf("unexpected error from AidAttestation(): %v", err)
+	}
+
+	responses := f.ChallengeResponses()
+	if len(responses) != 1 {
+		t.Fatalf("got %v challenge responses, want 1", len(responses))
+	}
+	resp := &common.ChallengeResponse{}
+	if err := json.Unmarshal(responses[0], resp); err != nil {
+		t.Fatalf("failed to unmarshal challenge response: %v", err)
+	}
+	sig := &ssh.Signature{}
+	if err := ssh.Unmarshal(resp.Signature, sig); err != nil {
+		t.Fatalf("failed to unmarshal signature: %v", err)
+	}
+	if sig.Format != ssh.SigAlgoRSASHA2256 {
+		t.Errorf("got signature format %v, want %v", sig.Format, ssh.SigAlgoRSASHA2256)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to create public key: %v", err)
+	}
+	if err := pub.Verify(common.KeyPairChallengeData("alpha", "bravo"), sig); err != nil {
+		t.Errorf("invalid signature: %v", err)
+	}
+}
+
+func TestAidAttestationKeyPairChallengeNoKey(t *testing.T) {
+	p := newTestPlugin()
+	p.getMetadataHandler = func() (*openstack.Metadata, error) {
+		return &openstack.Metadata{
+			UUID: "alpha",
+		}, nil
+	}
+
+	challenge, _ := json.Marshal(&common.Challenge{
+		Type:  common.ChallengeTypeKeyPair,
+		Nonce: "bravo",
+	})
+	f := fake_agent.NewAidAttestationStream(challenge)
+
+	wantErr := "private_key_path is required to answer the keypair challenge"
+	if err := p.AidAttestation(f); err == nil {
+		t.Error("expected an error, got nil")
+	} else if err.Error() != wantErr {
+		t.Errorf("got %v, want %v", err, wantErr)
+	}
+}
+
+func TestAidAttestationBootstrapTokenChallenge(t *testing.T) {
+	p := newTestPlugin()
+	p.getMetadataHandler = func() (*openstack.Metadata, error) {
+		return &openstack.Metadata{
+			UUID: "alpha",
+			Meta: map[string]string{"spire_bootstrap_token": "bravo"},
+		}, nil
+	}
+
+	challenge, _ := json.Marshal(&common.Challenge{
+		Type:        common.ChallengeTypeBootstrapToken,
+		MetadataKey: "spire_bootstrap_token",
+	})
+	f := fake_agent.NewAidAttestationStream(challenge)
+
+	if err := p.AidAttestation(f); err != nil {
+		t.Fatalf("unexpected error from AidAttestation(): %v", err)
+	}
+
+	responses := f.ChallengeResponses()
+	if len(responses) != 1 {
+		t.Fatalf("got %v challenge responses, want 1", len(responses))
+	}
+	resp := &common.ChallengeResponse{}
+	if err := json.Unmarshal(responses[0], resp); err != nil {
+		t.Fatalf("failed to unmarshal challenge response: %v", err)
+	}
+	if resp.Type != common.ChallengeTypeBootstrapToken || resp.Nonce != "bravo" {
+		t.Errorf("unexpected challenge response: %+v", resp)
+	}
+}
+
+func TestAidAttestationConfigDrive(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "openstack", "latest"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	metaData := `{"uuid": "alpha", "name": "bravo", "availability_zone": "charlie", "project_id": "delta"}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "openstack", "latest", "meta_data.json"), []byte(metaData), 0644); err != nil {
+		t.Fatalf("failed to write metadata: %v", err)
+	}
+
+	p := newTestPlugin()
+	p.getMetadataHandler = p.getMetadata
+	conf := fmt.Sprintf(`
+	metadata_sources = ["config_drive"]
+	config_drive_path = "%s"
+	`, dir)
+	if _, err := p.Configure(context.Background(), &configv1.ConfigureRequest{HclConfiguration: conf}); err != nil {
+		t.Fatalf("unexpected error from Configure(): %v", err)
+	}
+
+	f := fake_agent.NewAidAttestationStream()
+	if err := p.AidAttestation(f); err != nil {
+		t.Fatalf("unexpected error from AidAttestation(): %v", err)
+	}
+	payload := &common.AttestationPayload{}
+	if err := json.Unmarshal(f.Payload(), payload); err != nil {
+		t.Fatalf("failed to unmarshal payload: %v", err)
+	}
+	if payload.UUID != "alpha" || payload.Evidence.ProjectID != "delta" {
+		t.Errorf("unexpected payload: %+v", payload)
+	}
+}
+
+func TestConfigureMetadataSourcesError(t *testing.T) {
+	for i, tc := range []struct {
+		conf    string
+		wantErr string
+	}{
+		// 0: unknown source
+		{
+			conf:    `metadata_sources = ["metadata_service", "unknown"]`,
+			wantErr: `unknown metadata source: "unknown"`,
+		},
+		// 1: no source provides the instance uuid
+		{
+			conf:    `metadata_sources = ["ec2"]`,
+			wantErr: `metadata_sources requires "metadata_service", "config_drive" or "cloud_init", which provide the instance uuid`,
+		},
+	} {
+		p := newTestPlugin()
+		_, err := p.Configure(context.Background(), &configv1.ConfigureRequest{HclConfiguration: tc.conf})
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
+
+func TestAidAttestationMetadataChallengeConfigDrive(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "openstack", "latest"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "openstack", "latest", "meta_data.json"), []byte(`{"uuid": "alpha"}`), 0644); err != nil {
+		t.Fatalf("failed to write metadata: %v", err)
+	}
+	// Only the metadata service sees the nonce set during the attestation.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/openstack/latest/meta_data.json" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"uuid": "alpha", "meta": {"nonce-key": "delta"}}`)
+	}))
+	defer ts.Close()
+
+	p := newTestPlugin()
+	p.getMetadataHandler = p.getMetadata
+	p.getServiceMetadataHandler = p.getServiceMetadata
+	conf := fmt.Sprintf(`
+	metadata_sources = ["config_drive", "metadata_service"]
+	config_drive_path = "%s"
+	metadata_url = "%s"
+	`, dir, ts.URL)
+	if _, err := p.Configure(context.Background(), &configv1.ConfigureRequest{HclConfiguration: conf}); err != nil {
+		t.Fatalf("unexpected error from Configure(): %v", err)
+	}
+
+	challenge, _ := json.Marshal(&common.Challenge{
+		Type:        common.ChallengeTypeMetadataNonce,
+		MetadataKey: "nonce-key",
+	})
+	f := fake_agent.NewAidAttestationStream(challenge)
+	if err := p.AidAttestation(f); err != nil {
+		t.Fatalf("unexpected error from AidAttestation(): %v", err)
+	}
+
+	responses := f.ChallengeResponses()
+	if len(responses) != 1 {
+		t.Fatalf("got %v challenge responses, want 1", len(responses))
+	}
+	resp := &common.ChallengeResponse{}
+	if err := json.Unmarshal(responses[0], resp); err != nil {
+		t.Fatalf("failed to unmarshal challenge response: %v", err)
+	}
+	if resp.Nonce != "delta" {
+		t.Errorf("unexpected challenge response: %+v", resp)
+	}
+}
+
+func TestAidAttestationMetadataServiceURL(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/openstack/2018-08-27/meta_data.json" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"uuid": "alpha", "project_id": "delta"}`)
+	}))
+	defer ts.Close()
+
+	p := newTestPlugin()
+	p.getMetadataHandler = p.getMetadata
+	conf := fmt.Sprintf(`
+	metadata_url = "%s/"
+	metadata_versions = ["latest", "2018-08-27"]
+	metadata_timeout = "1s"
+	`, ts.URL)
+	if _, err := p.Configure(context.Background(), &configv1.ConfigureRequest{HclConfiguration: conf}); err != nil {
+		t.Fatalf("unexpected error from Configure(): %v", err)
+	}
+
+	f := fake_agent.NewAidAttestationStream()
+	if err := p.AidAttestation(f); err != nil {
+		t.Fatalf("unexpected error from AidAttestation(): %v", err)
+	}
+	payload := &common.AttestationPayload{}
+	if err := json.Unmarshal(f.Payload(), payload); err != nil {
+		t.Fatalf("failed to unmarshal payload: %v", err)
+	}
+	if payload.UUID != "alpha" {
+		t.Errorf("unexpected payload: %+v", payload)
+	}
+}
+
+func TestMetadataServiceOptions(t *testing.T) {
+	for i, tc := range []struct {
+		config    *IIDAttestorPluginConfig
+		expectErr string
+		want      openstack.MetadataServiceOptions
+	}{
+		// 0: defaults
+		{
+			config: &IIDAttestorPluginConfig{},
+			want:   openstack.MetadataServiceOptions{RetryInterval: time.Second},
+		},
+		// 1: all options
+		{
+			config: &IIDAttestorPluginConfig{
+				MetadataURL:           "http://metadata.example.com/",
+				MetadataVersions:      []string{"latest", "2018-08-27"},
+				MetadataTimeout:       "5s",
+				MetadataRetries:       3,
+				MetadataRetryInterval: "2s",
+			},
+			want: openstack.MetadataServiceOptions{
+				URL:           "http://metadata.example.com",
+				Versions:      []string{"latest", "2018-08-27"},
+				Timeout:       5 * time.Second,
+				Retries:       3,
+				RetryInterval: 2 * time.Second,
+			},
+		},
+		// 2: IPv6 link-local address
+		{
+			config: &IIDAttestorPluginConfig{MetadataIPv6Interface: "eth0"},
+			want: openstack.MetadataServiceOptions{
+				URL:           "http://[fe80::a9fe:a9fe%25eth0]",
+				RetryInterval: time.Second,
+			},
+		},
+		// 3: both URL and IPv6 interface
+		{
+			config:    &IIDAttestorPluginConfig{MetadataURL: "http://metadata.example.com", MetadataIPv6Interface: "eth0"},
+			expectErr: "metadata_url and metadata_ipv6_interface are mutually exclusive",
+		},
+		// 4: invalid timeout
+		{
+			config:    &IIDAttestorPluginConfig{MetadataTimeout: "alpha"},
+			expectErr: `invalid metadata_timeout: time: invalid duration "alpha"`,
+		},
+		// 5: negative retries
+		{
+			config:    &IIDAttestorPluginConfig{MetadataRetries: -1},
+			expectErr: "metadata_retries must not be negative",
+		},
+		// 6: zero timeout
+		{
+			config:    &IIDAttestorPluginConfig{MetadataTimeout: "0s"},
+			expectErr: "metadata_timeout must be positive",
+		},
+		// 7: negative timeout
+		{
+			config:    &IIDAttestorPluginConfig{MetadataTimeout: "-1s"},
+			expectErr: "metadata_timeout must be positive",
+		},
+		// 8: negative retry interval
+		{
+			config:    &IIDAttestorPluginConfig{MetadataRetryInterval: "-1s"},
+			expectErr: "metadata_retry_interval must not be negative",
+		},
+	} {
+		got, err := metadataServiceOptions(tc.config)
+		if tc.expectErr != "" {
+			if err == nil || err.Error() != tc.expectErr {
+				t.Errorf("#%v: got error %v, want %v", i, err, tc.expectErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("#%v: got %+v, want %+v", i, got, tc.want)
+		}
+	}
+}
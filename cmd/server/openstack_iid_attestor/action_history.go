@@ -0,0 +1,99 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+const (
+	actionHistoryModeDeny = "deny"
+	actionHistoryModeFlag = "flag"
+)
+
+var (
+	defaultDisallowedActions = []string{"rebuild", "rescue", "evacuate", "resize"}
+)
+
+// ActionHistory makes the plugin check the action history (os-instance-actions) of the instance.
+// An instance whose disk was rebuilt from another image is a different trust subject, even though
+// it has the same UUID.
+type ActionHistory struct {
+	// DisallowedActions are the names of the actions which must not have happened.
+	// Defaults to ["rebuild", "rescue", "evacuate", "resize"].
+	DisallowedActions []string `hcl:"disallowed_actions"`
+	// Since is the RFC 3339 time after which the actions must not have happened.
+	// Defaults to the creation time of the instance.
+	Since string `hcl:"since"`
+	// Mode is either "deny", which rejects the instance, or "flag", which admits the instance
+	// with "action:<name>" Selectors. Defaults to "deny".
+	Mode string `hcl:"mode"`
+
+	since time.Time
+}
+
+// validate checks the configuration and sets the default values.
+func (c *ActionHistory) validate() error {
+	if len(c.DisallowedActions) == 0 {
+		c.DisallowedActions = defaultDisallowedActions
+	}
+	switch c.Mode {
+	case "":
+		c.Mode = actionHistoryModeDeny
+	case actionHistoryModeDeny, actionHistoryModeFlag:
+	default:
+		return fmt.Errorf("invalid action_history.mode: %q", c.Mode)
+	}
+	if c.Since != "" {
+		t, err := time.Parse(time.RFC3339, c.Since)
+		if err != nil {
+			return fmt.Errorf("invalid action_history.since: %v", err)
+		}
+		c.since = t
+	}
+	return nil
+}
+
+// checkActionHistory looks for disallowed actions in the action history of the instance.
+// It returns an error in the deny mode, and the Selector values of the actions in the flag mode.
+func (p *IIDAttestorPlugin) checkActionHistory(ctx context.Context, instance openstack.InstanceClient, s *openstack.Server, c *ActionHistory) ([]string, error) {
+	actions, err := instance.ListActions(ctx, s.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance actions: %w", err)
+	}
+
+	since := s.Created
+	if c.since.After(since) {
+		since = c.since
+	}
+
+	var svs []string
+	flagged := make(map[string]bool)
+	for _, a := range actions {
+		if !contains(c.DisallowedActions, a.Action) || !a.StartTime.After(since) {
+			continue
+		}
+
+		if c.Mode == actionHistoryModeDeny {
+			p.logger.Warn("Instance has a disallowed action", "uuid", s.ID, "action", a.Action, "request_id", a.RequestID, "start_time", a.StartTime)
+			return nil, fmt.Errorf("instance has a disallowed action %q (request %s) at %v", a.Action, a.RequestID, a.StartTime.Format(time.RFC3339))
+		}
+
+		p.logger.Warn("Flagging instance with a disallowed action", "uuid", s.ID, "action", a.Action, "request_id", a.RequestID, "start_time", a.StartTime)
+		if !flagged[a.Action] {
+			flagged[a.Action] = true
+			svs = append(svs, fmt.Sprintf("action:%s", a.Action))
+		}
+	}
+
+	return svs, nil
+}
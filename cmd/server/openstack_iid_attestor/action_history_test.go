@@ -0,0 +1,116 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/instanceactions"
+
+	fake_openstack "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/openstack"
+	fake_server "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/server"
+)
+
+func TestAttestActionHistory(t *testing.T) {
+	created := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+	actions := []instanceactions.InstanceAction{
+		{Action: "create", RequestID: "req-1", StartTime: created},
+		{Action: "stop", RequestID: "req-2", StartTime: created.Add(time.Hour)},
+		{Action: "rebuild", RequestID: "req-3", StartTime: created.Add(2 * time.Hour)},
+		{Action: "rebuild", RequestID: "req-4", StartTime: created.Add(3 * time.Hour)},
+	}
+
+	for i, tc := range []struct {
+		config    *ActionHistory
+		wantErr   string
+		wantSVs   []string
+		noActions bool
+	}{
+		// 0: deny rebuilt instance
+		{
+			config:  &ActionHistory{},
+			wantErr: `instance has a disallowed action "rebuild" (request req-3) at 2021-09-01T02:00:00Z`,
+		},
+		// 1: flag rebuilt instance
+		{
+			config:  &ActionHistory{Mode: "flag"},
+			wantSVs: []string{"action:rebuild"},
+		},
+		// 2: rebuilt before the configured time
+		{
+			config:  &ActionHistory{Since: "2021-09-01T04:00:00Z"},
+			wantSVs: nil,
+		},
+		// 3: other disallowed actions
+		{
+			config:  &ActionHistory{DisallowedActions: []string{"stop"}},
+			wantErr: `instance has a disallowed action "stop" (request req-2) at 2021-09-01T01:00:00Z`,
+		},
+		// 4: no actions after creation
+		{
+			config:    &ActionHistory{},
+			noActions: true,
+		},
+	} {
+		if err := tc.config.validate(); err != nil {
+			t.Fatalf("#%v: unexpected error from validate(): %v", i, err)
+		}
+
+		fi := fake_openstack.NewInstance(testProjectID, nil, nil)
+		fi.Created = created
+		fi.Actions = actions
+		if tc.noActions {
+			fi.Actions = actions[:1]
+		}
+
+		p := newTestPlugin()
+		setTestInstance(p, fi, testProjectID)
+		p.config.ActionHistory = tc.config
+		p.attestedBeforeHandler = notAttestedBeforeHandler
+
+		fs := fake_server.NewAttestStream(testPayload)
+
+		err := p.Attest(fs)
+		if tc.wantErr != "" {
+			if err == nil {
+				t.Errorf("#%v: expected an error, got nil", i)
+			} else if err.Error() != tc.wantErr {
+				t.Errorf("#%v: got %v, want %v", i, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error from Attest(): %v", i, err)
+			continue
+		}
+		if got := fs.AgentAttributes().SelectorValues; !reflect.DeepEqual(got, tc.wantSVs) {
+			t.Errorf("#%v: got selectors %v, want %v", i, got, tc.wantSVs)
+		}
+	}
+}
+
+func TestActionHistoryValidate(t *testing.T) {
+	for i, tc := range []struct {
+		config  *ActionHistory
+		wantErr bool
+	}{
+		// 0: default
+		{config: &ActionHistory{}},
+		// 1: invalid mode
+		{config: &ActionHistory{Mode: "ignore"}, wantErr: true},
+		// 2: invalid time
+		{config: &ActionHistory{Since: "yesterday"}, wantErr: true},
+	} {
+		err := tc.config.validate()
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("#%v: got error %v, want error %v", i, err, tc.wantErr)
+		}
+	}
+}
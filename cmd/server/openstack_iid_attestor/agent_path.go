@@ -0,0 +1,121 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+// agentPathData is the data agent_path_template is executed with. It has only the attributes which the users
+// of the instance can't change, otherwise renaming or re-tagging an instance would give it a new agent ID, which
+// has never attested, and bypass the check of whether the instance has attested before.
+type agentPathData struct {
+	PluginName string
+	CloudID    string
+	ProjectID  string
+	InstanceID string
+	// Region is the region of the cloud the instance belongs to, which is given by the cloud configuration.
+	Region string
+}
+
+// parseAgentPathTemplate parses agent_path_template, and checks with sample instances that the paths are valid
+// agent paths under the plugin name and that they include the whole instance IDs, so that different instances
+// get different paths. A part of the ID, such as its first characters, is not enough since real IDs share them.
+// If the plugin attests instances of multiple clouds, instances of different clouds must get different paths too.
+func parseAgentPathTemplate(text string, multiCloud bool) (*template.Template, error) {
+	tmpl, err := template.New("agent_path_template").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid agent_path_template: %v", err)
+	}
+
+	// The cloud ID is empty without the cloud blocks.
+	cloudA, cloudB := "", ""
+	if multiCloud {
+		cloudA, cloudB = "cloud-a", "cloud-b"
+	}
+	render := func(cloudID, instanceID string) (string, error) {
+		path, err := renderAgentPath(tmpl, &agentPathData{
+			PluginName: common.PluginName,
+			CloudID:    cloudID,
+			ProjectID:  "project",
+			InstanceID: instanceID,
+			Region:     "region",
+		})
+		if err != nil {
+			return "", fmt.Errorf("invalid agent_path_template: %v", err)
+		}
+		// The trust domain doesn't matter, the path is checked the same as at the attestation.
+		if _, err := common.GenerateAgentSpiffeID("example.org", path); err != nil {
+			return "", fmt.Errorf("invalid agent_path_template: %v", err)
+		}
+		return path, nil
+	}
+
+	// The sample IDs differ in every character.
+	firstID, secondID := "01234567-89ab-4cde-8f01-23456789abcd", "fedcba98-7654-3210-fedc-ba9876543210"
+	first, err := render(cloudA, firstID)
+	if err != nil {
+		return nil, err
+	}
+	second, err := render(cloudA, secondID)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(first, firstID) || !strings.Contains(second, secondID) {
+		return nil, errors.New("agent_path_template must render the whole instance ID, such as with {{ .InstanceID }}")
+	}
+	if multiCloud {
+		other, err := render(cloudB, firstID)
+		if err != nil {
+			return nil, err
+		}
+		if first == other {
+			return nil, errors.New("agent_path_template must render different paths for different clouds, such as with {{ .CloudID }}")
+		}
+	}
+	return tmpl, nil
+}
+
+// renderAgentPath executes agent_path_template, and checks that the path is under the plugin name,
+// so that the agents attested by this plugin can't get the IDs of the agents attested by the other plugins.
+func renderAgentPath(tmpl *template.Template, data *agentPathData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	path := b.String()
+	if !strings.HasPrefix(path, data.PluginName+"/") {
+		return "", fmt.Errorf("path %q doesn't start with %q, such as with {{ .PluginName }}/", path, data.PluginName+"/")
+	}
+	return path, nil
+}
+
+// agentSpiffeID returns the SPIFFE ID of the agent on the instance, which is rendered with agent_path_template if given.
+func agentSpiffeID(config *IIDAttestorPluginConfig, cloud *Cloud, instance openstack.InstanceClient, s *openstack.Server) (string, error) {
+	if config.agentPathTemplate == nil {
+		return common.GenerateCloudSpiffeID(config.trustDomain, cloud.ID, s.TenantID, s.ID), nil
+	}
+
+	path, err := renderAgentPath(config.agentPathTemplate, &agentPathData{
+		PluginName: common.PluginName,
+		CloudID:    cloud.ID,
+		ProjectID:  s.TenantID,
+		InstanceID: s.ID,
+		Region:     instance.Region(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render agent_path_template: %w", err)
+	}
+	return common.GenerateAgentSpiffeID(config.trustDomain, path)
+}
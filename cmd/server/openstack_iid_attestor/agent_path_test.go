@@ -0,0 +1,204 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+	fake_common "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/common"
+	fake_openstack "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/openstack"
+	fake_server "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/server"
+)
+
+func TestConfigureAgentPathTemplate(t *testing.T) {
+	for i, tc := range []struct {
+		conf    string
+		wantErr string
+	}{
+		// 0: valid template
+		{
+			conf: `
+			cloud_name = "test"
+			projectid_allow_list = ["abc"]
+			agent_path_template = "{{ .PluginName }}/{{ .Region }}/{{ .ProjectID }}/{{ .InstanceID }}"
+			`,
+		},
+		// 1: syntax error
+		{
+			conf: `
+			cloud_name = "test"
+			projectid_allow_list = ["abc"]
+			agent_path_template = "{{ .InstanceID }"
+			`,
+			wantErr: `invalid agent_path_template: template: agent_path_template:1: unexpected "}" in operand`,
+		},
+		// 2: unknown field
+		{
+			conf: `
+			cloud_name = "test"
+			projectid_allow_list = ["abc"]
+			agent_path_template = "{{ .Flavor }}/{{ .InstanceID }}"
+			`,
+			wantErr: `invalid agent_path_template: template: agent_path_template:1:3: executing "agent_path_template" at <.Flavor>: can't evaluate field Flavor in type *main.agentPathData`,
+		},
+		// 3: attribute which can be changed
+		{
+			conf: `
+			cloud_name = "test"
+			projectid_allow_list = ["abc"]
+			agent_path_template = "{{ .PluginName }}/{{ .InstanceName }}/{{ .InstanceID }}"
+			`,
+			wantErr: `invalid agent_path_template: template: agent_path_template:1:21: executing "agent_path_template" at <.InstanceName>: can't evaluate field InstanceName in type *main.agentPathData`,
+		},
+		// 4: not under the plugin name
+		{
+			conf: `
+			cloud_name = "test"
+			projectid_allow_list = ["abc"]
+			agent_path_template = "{{ .ProjectID }}/{{ .InstanceID }}"
+			`,
+			wantErr: `invalid agent_path_template: path "project/01234567-89ab-4cde-8f01-23456789abcd" doesn't start with "openstack_iid/", such as with {{ .PluginName }}/`,
+		},
+		// 5: the same path for different instances
+		{
+			conf: `
+			cloud_name = "test"
+			projectid_allow_list = ["abc"]
+			agent_path_template = "{{ .PluginName }}/{{ .ProjectID }}"
+			`,
+			wantErr: "agent_path_template must render the whole instance ID, such as with {{ .InstanceID }}",
+		},
+		// 6: a part of the instance ID
+		{
+			conf: `
+			cloud_name = "test"
+			projectid_allow_list = ["abc"]
+			agent_path_template = "{{ .PluginName }}/{{ slice .InstanceID 0 8 }}"
+			`,
+			wantErr: "agent_path_template must render the whole instance ID, such as with {{ .InstanceID }}",
+		},
+		// 7: the same path for different clouds
+		{
+			conf: `
+			agent_path_template = "{{ .PluginName }}/{{ .InstanceID }}"
+			cloud "east" {
+				cloud_name = "east"
+				projectid_allow_list = ["abc"]
+			}
+			`,
+			wantErr: "agent_path_template must render different paths for different clouds, such as with {{ .CloudID }}",
+		},
+		// 8: invalid segment
+		{
+			conf: `
+			cloud_name = "test"
+			projectid_allow_list = ["abc"]
+			agent_path_template = "{{ .PluginName }}/bad path/{{ .InstanceID }}/"
+			`,
+			wantErr: `invalid agent_path_template: invalid agent path "openstack_iid/bad path/01234567-89ab-4cde-8f01-23456789abcd/": path has an invalid character ' '`,
+		},
+		// 9: empty cloud ID without the cloud blocks
+		{
+			conf: `
+			cloud_name = "test"
+			projectid_allow_list = ["abc"]
+			agent_path_template = "{{ .PluginName }}/{{ .CloudID }}/{{ .InstanceID }}"
+			`,
+			wantErr: `invalid agent_path_template: invalid agent path "openstack_iid//01234567-89ab-4cde-8f01-23456789abcd": path has an empty segment`,
+		},
+		// 10: unique among the clouds
+		{
+			conf: `
+			agent_path_template = "{{ .PluginName }}/{{ .CloudID }}/{{ .InstanceID }}"
+			cloud "east" {
+				cloud_name = "east"
+				projectid_allow_list = ["abc"]
+			}
+			`,
+		},
+	} {
+		p := newTestPlugin()
+		p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, _ hclog.Logger) (openstack.InstanceClient, error) {
+			return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+		}
+
+		_, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, tc.conf))
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("#%v: unexpected error: %v", i, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
+
+func TestAttestAgentPathTemplate(t *testing.T) {
+	for i, tc := range []struct {
+		template string
+		region   string
+		wantID   string
+		wantErr  string
+	}{
+		// 0: the default path
+		{
+			wantID: "spiffe://example.com/spire/agent/openstack_iid/abc/123",
+		},
+		// 1: region
+		{
+			template: "{{ .PluginName }}/{{ .Region }}/{{ .ProjectID }}/{{ .InstanceID }}",
+			region:   "RegionOne",
+			wantID:   "spiffe://example.com/spire/agent/openstack_iid/RegionOne/abc/123",
+		},
+		// 2: invalid path
+		{
+			template: "{{ .PluginName }}/{{ .Region }}/{{ .InstanceID }}",
+			region:   "Region One",
+			wantErr:  `invalid agent path "openstack_iid/Region One/123": path has an invalid character ' '`,
+		},
+	} {
+		instance := fake_openstack.NewInstance(testProjectID, nil, nil)
+		instance.RegionName = tc.region
+
+		p := newTestPlugin()
+		setTestInstance(p, instance, testProjectID)
+		if tc.template != "" {
+			tmpl, err := parseAgentPathTemplate(tc.template, false)
+			if err != nil {
+				t.Fatalf("#%v: unexpected error from parseAgentPathTemplate(): %v", i, err)
+			}
+			p.config.agentPathTemplate = tmpl
+		}
+		var gotID string
+		p.attestedBeforeHandler = func(_ context.Context, _ *IIDAttestorPlugin, agentID string) (bool, error) {
+			gotID = agentID
+			return false, nil
+		}
+
+		err := p.Attest(fake_server.NewAttestStream(testPayload))
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+			continue
+		}
+		if gotID != tc.wantID {
+			t.Errorf("#%v: got agent ID %v, want %v", i, gotID, tc.wantID)
+		}
+	}
+}
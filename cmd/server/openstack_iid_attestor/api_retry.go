@@ -0,0 +1,93 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+// APIRetry configures the retries of the OpenStack API calls which failed with a connection error,
+// a 5xx or a 429 response. Only idempotent requests, such as GET, are retried.
+type APIRetry struct {
+	// MaxRetries is the maximum number of retries. Defaults to 3, and 0 disables retries.
+	MaxRetries *int `hcl:"max_retries"`
+	// BaseDelay is the delay before the first retry, which doubles on every retry with jitter.
+	// Defaults to "200ms".
+	BaseDelay string `hcl:"base_delay"`
+	// MaxDelay caps the delay before each retry, including the one requested by Retry-After.
+	// Defaults to "5s".
+	MaxDelay string `hcl:"max_delay"`
+}
+
+// CircuitBreaker configures the circuit breaker, which fails the OpenStack API calls fast while
+// the API endpoint keeps failing.
+type CircuitBreaker struct {
+	// FailureThreshold is the number of consecutive failures which opens the circuit.
+	// Defaults to 5, and 0 disables the circuit breaker.
+	FailureThreshold *int `hcl:"failure_threshold"`
+	// ResetTimeout is the time the circuit stays open before a probe request is let through.
+	// Defaults to "30s".
+	ResetTimeout string `hcl:"reset_timeout"`
+}
+
+// providerOptions returns the options of the OpenStack client from the configuration.
+func providerOptions(retry *APIRetry, cb *CircuitBreaker) (openstack.ProviderOptions, error) {
+	opts := openstack.DefaultProviderOptions()
+
+	if retry != nil {
+		if retry.MaxRetries != nil {
+			if *retry.MaxRetries < 0 {
+				return opts, errors.New("api_retry.max_retries must not be negative")
+			}
+			opts.Retry.MaxRetries = *retry.MaxRetries
+		}
+		if err := parseDuration(retry.BaseDelay, "api_retry.base_delay", &opts.Retry.BaseDelay); err != nil {
+			return opts, err
+		}
+		if err := parseDuration(retry.MaxDelay, "api_retry.max_delay", &opts.Retry.MaxDelay); err != nil {
+			return opts, err
+		}
+		if opts.Retry.MaxDelay < opts.Retry.BaseDelay {
+			return opts, errors.New("api_retry.max_delay must not be less than api_retry.base_delay")
+		}
+	}
+
+	if cb != nil {
+		if cb.FailureThreshold != nil {
+			if *cb.FailureThreshold < 0 {
+				return opts, errors.New("circuit_breaker.failure_threshold must not be negative")
+			}
+			opts.CircuitBreaker.FailureThreshold = *cb.FailureThreshold
+		}
+		if err := parseDuration(cb.ResetTimeout, "circuit_breaker.reset_timeout", &opts.CircuitBreaker.ResetTimeout); err != nil {
+			return opts, err
+		}
+	}
+
+	return opts, nil
+}
+
+// parseDuration sets the duration if given value is not empty. The duration must be positive.
+func parseDuration(v, name string, d *time.Duration) error {
+	if v == "" {
+		return nil
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", name, err)
+	}
+	if parsed <= 0 {
+		return fmt.Errorf("%s must be positive", name)
+	}
+	*d = parsed
+	return nil
+}
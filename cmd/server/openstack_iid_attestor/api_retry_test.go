@@ -0,0 +1,101 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+func TestProviderOptions(t *testing.T) {
+	zero := 0
+	negative := -1
+
+	for i, tc := range []struct {
+		retry   *APIRetry
+		cb      *CircuitBreaker
+		want    openstack.ProviderOptions
+		wantErr string
+	}{
+		// 0: defaults
+		{
+			want: openstack.DefaultProviderOptions(),
+		},
+		// 1: configured
+		{
+			retry: &APIRetry{BaseDelay: "1s", MaxDelay: "10s"},
+			cb:    &CircuitBreaker{ResetTimeout: "1m"},
+			want: openstack.ProviderOptions{
+				Retry:          openstack.RetryOptions{MaxRetries: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second},
+				CircuitBreaker: openstack.CircuitBreakerOptions{FailureThreshold: 5, ResetTimeout: time.Minute},
+			},
+		},
+		// 2: disabled
+		{
+			retry: &APIRetry{MaxRetries: &zero},
+			cb:    &CircuitBreaker{FailureThreshold: &zero},
+			want: openstack.ProviderOptions{
+				Retry:          openstack.RetryOptions{BaseDelay: 200 * time.Millisecond, MaxDelay: 5 * time.Second},
+				CircuitBreaker: openstack.CircuitBreakerOptions{ResetTimeout: 30 * time.Second},
+			},
+		},
+		// 3: negative retries
+		{
+			retry:   &APIRetry{MaxRetries: &negative},
+			wantErr: "api_retry.max_retries must not be negative",
+		},
+		// 4: invalid duration
+		{
+			cb:      &CircuitBreaker{ResetTimeout: "alpha"},
+			wantErr: `invalid circuit_breaker.reset_timeout: time: invalid duration "alpha"`,
+		},
+		// 5: negative base delay
+		{
+			retry:   &APIRetry{BaseDelay: "-1s"},
+			wantErr: "api_retry.base_delay must be positive",
+		},
+		// 6: zero max delay
+		{
+			retry:   &APIRetry{MaxDelay: "0s"},
+			wantErr: "api_retry.max_delay must be positive",
+		},
+		// 7: negative max delay
+		{
+			retry:   &APIRetry{MaxDelay: "-5s"},
+			wantErr: "api_retry.max_delay must be positive",
+		},
+		// 8: max delay is less than base delay
+		{
+			retry:   &APIRetry{BaseDelay: "10s", MaxDelay: "1s"},
+			wantErr: "api_retry.max_delay must not be less than api_retry.base_delay",
+		},
+		// 9: zero reset timeout
+		{
+			cb:      &CircuitBreaker{ResetTimeout: "0s"},
+			wantErr: "circuit_breaker.reset_timeout must be positive",
+		},
+	} {
+		got, err := providerOptions(tc.retry, tc.cb)
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("#%v: got %+v, want %+v", i, got, tc.want)
+		}
+	}
+}
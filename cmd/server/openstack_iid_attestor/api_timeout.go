@@ -0,0 +1,90 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/instanceactions"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/keypairs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+const (
+	defaultAPITimeout = 30 * time.Second
+)
+
+// timeoutInstanceClient bounds each call to the OpenStack API with the timeout, in addition to
+// the deadline of the attestation request.
+type timeoutInstanceClient struct {
+	client  openstack.InstanceClient
+	timeout time.Duration
+}
+
+// withAPITimeout returns the InstanceClient which times out each call after given duration.
+func withAPITimeout(client openstack.InstanceClient, timeout time.Duration) openstack.InstanceClient {
+	if timeout <= 0 {
+		return client
+	}
+	return &timeoutInstanceClient{
+		client:  client,
+		timeout: timeout,
+	}
+}
+
+func (c *timeoutInstanceClient) Get(ctx context.Context, uuid string) (*openstack.Server, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.client.Get(ctx, uuid)
+}
+
+func (c *timeoutInstanceClient) SetMetadata(ctx context.Context, uuid, key, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.client.SetMetadata(ctx, uuid, key, value)
+}
+
+func (c *timeoutInstanceClient) DeleteMetadata(ctx context.Context, uuid, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.client.DeleteMetadata(ctx, uuid, key)
+}
+
+func (c *timeoutInstanceClient) GetKeyPair(ctx context.Context, name, userID string) (*keypairs.KeyPair, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.client.GetKeyPair(ctx, name, userID)
+}
+
+func (c *timeoutInstanceClient) ListActions(ctx context.Context, uuid string) ([]instanceactions.InstanceAction, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.client.ListActions(ctx, uuid)
+}
+
+func (c *timeoutInstanceClient) Region() string {
+	return c.client.Region()
+}
+
+// apiCallError turns the errors of timed out or cancelled OpenStack API calls into the corresponding
+// gRPC status, so that the agent can tell them from the attestation failures.
+func apiCallError(err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Errorf(codes.DeadlineExceeded, "OpenStack API call timed out: %v", err)
+	case errors.Is(err, context.Canceled):
+		return status.Errorf(codes.Canceled, "OpenStack API call cancelled: %v", err)
+	default:
+		return err
+	}
+}
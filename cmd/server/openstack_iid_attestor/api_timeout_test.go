@@ -0,0 +1,122 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+	fake_common "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/common"
+	fake_openstack "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/openstack"
+	fake_server "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/server"
+)
+
+func TestAttestAPITimeout(t *testing.T) {
+	fi := fake_openstack.NewInstance(testProjectID, nil, nil)
+	fi.Delay = time.Second
+
+	p := newTestPlugin()
+	setTestInstance(p, fi, testProjectID)
+	p.config.apiTimeout = 10 * time.Millisecond
+	p.attestedBeforeHandler = notAttestedBeforeHandler
+
+	err := p.Attest(fake_server.NewAttestStream(testPayload))
+	if code := status.Code(err); code != codes.DeadlineExceeded {
+		t.Errorf("got %v (%v), want %v", code, err, codes.DeadlineExceeded)
+	}
+}
+
+func TestConfigureAPITimeout(t *testing.T) {
+	for i, tc := range []struct {
+		conf    string
+		want    time.Duration
+		wantErr string
+	}{
+		// 0: default
+		{
+			conf: `projectid_allow_list = ["alpha"]`,
+			want: defaultAPITimeout,
+		},
+		// 1: configured
+		{
+			conf: `projectid_allow_list = ["alpha"]
+			api_timeout = "5s"`,
+			want: 5 * time.Second,
+		},
+		// 2: invalid duration
+		{
+			conf: `projectid_allow_list = ["alpha"]
+			api_timeout = "bravo"`,
+			wantErr: `invalid api_timeout: time: invalid duration "bravo"`,
+		},
+		// 3: not positive
+		{
+			conf: `projectid_allow_list = ["alpha"]
+			api_timeout = "0s"`,
+			wantErr: "api_timeout must be positive",
+		},
+	} {
+		p := newTestPlugin()
+		p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, logger hclog.Logger) (openstack.InstanceClient, error) {
+			return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+		}
+		_, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, tc.conf))
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error from Configure(): %v", i, err)
+			continue
+		}
+		if p.config.apiTimeout != tc.want {
+			t.Errorf("#%v: got %v, want %v", i, p.config.apiTimeout, tc.want)
+		}
+	}
+}
+
+func TestAPICallError(t *testing.T) {
+	for i, tc := range []struct {
+		err  error
+		want codes.Code
+	}{
+		// 0: no error
+		{
+			want: codes.OK,
+		},
+		// 1: timed out
+		{
+			err:  fmt.Errorf("failed to get instance information: %w", context.DeadlineExceeded),
+			want: codes.DeadlineExceeded,
+		},
+		// 2: cancelled
+		{
+			err:  fmt.Errorf("failed to get instance information: %w", context.Canceled),
+			want: codes.Canceled,
+		},
+		// 3: other error
+		{
+			err:  errors.New("invalid attestation request"),
+			want: codes.Unknown,
+		},
+	} {
+		if got := status.Code(apiCallError(tc.err)); got != tc.want {
+			t.Errorf("#%v: got %v, want %v", i, got, tc.want)
+		}
+	}
+}
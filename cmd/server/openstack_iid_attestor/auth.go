@@ -0,0 +1,113 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+// Auth is the Keystone authentication given in the plugin configuration, instead of clouds.yaml.
+// The secret, which is the password or the application credential secret, is read from a file
+// or an environment variable, so that it is not written in the configuration.
+type Auth struct {
+	AuthURL string `hcl:"auth_url"`
+	Region  string `hcl:"region"`
+
+	Username       string `hcl:"username"`
+	UserID         string `hcl:"user_id"`
+	UserDomainName string `hcl:"user_domain_name"`
+	UserDomainID   string `hcl:"user_domain_id"`
+
+	ProjectID         string `hcl:"project_id"`
+	ProjectName       string `hcl:"project_name"`
+	ProjectDomainName string `hcl:"project_domain_name"`
+	ProjectDomainID   string `hcl:"project_domain_id"`
+
+	ApplicationCredentialID   string `hcl:"application_credential_id"`
+	ApplicationCredentialName string `hcl:"application_credential_name"`
+
+	// SecretFile is the path to the file which has the secret.
+	SecretFile string `hcl:"secret_file"`
+	// SecretEnv is the name of the environment variable which has the secret.
+	SecretEnv string `hcl:"secret_env"`
+}
+
+// validate checks the configuration.
+func (c *Auth) validate() error {
+	if c.AuthURL == "" {
+		return errors.New("auth.auth_url is required")
+	}
+	if c.Username == "" && c.UserID == "" && c.ApplicationCredentialID == "" && c.ApplicationCredentialName == "" {
+		return errors.New("auth requires a user or an application credential")
+	}
+	if (c.SecretFile == "") == (c.SecretEnv == "") {
+		return errors.New("auth requires either secret_file or secret_env")
+	}
+	return nil
+}
+
+// secret reads the secret from the file or the environment variable.
+func (c *Auth) secret() (string, error) {
+	if c.SecretFile != "" {
+		b, err := ioutil.ReadFile(c.SecretFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read auth.secret_file: %v", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+
+	v, ok := os.LookupEnv(c.SecretEnv)
+	if !ok || v == "" {
+		return "", fmt.Errorf("environment variable %s given by auth.secret_env is empty", c.SecretEnv)
+	}
+	return v, nil
+}
+
+// authOptions returns the options to authenticate to Keystone with the clouds.yaml entry or the inline authentication.
+func authOptions(cloudName, cloudsYAMLPath string, auth *Auth) (openstack.AuthOptions, error) {
+	opts := openstack.AuthOptions{
+		CloudsYAMLPath: cloudsYAMLPath,
+		CloudName:      cloudName,
+	}
+	if auth == nil {
+		return opts, nil
+	}
+
+	if cloudName != "" {
+		return opts, errors.New("cloud_name and auth are mutually exclusive")
+	}
+	if err := auth.validate(); err != nil {
+		return opts, err
+	}
+	secret, err := auth.secret()
+	if err != nil {
+		return opts, err
+	}
+
+	a := auth
+	opts.AuthURL = a.AuthURL
+	opts.RegionName = a.Region
+	opts.Username = a.Username
+	opts.UserID = a.UserID
+	opts.UserDomainName = a.UserDomainName
+	opts.UserDomainID = a.UserDomainID
+	opts.ProjectID = a.ProjectID
+	opts.ProjectName = a.ProjectName
+	opts.ProjectDomainName = a.ProjectDomainName
+	opts.ProjectDomainID = a.ProjectDomainID
+	opts.ApplicationCredentialID = a.ApplicationCredentialID
+	opts.ApplicationCredentialName = a.ApplicationCredentialName
+	opts.Secret = secret
+	return opts, nil
+}
@@ -0,0 +1,102 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthOptions(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("alpha\n"), 0600); err != nil {
+		t.Fatalf("failed to write secret: %v", err)
+	}
+	os.Setenv("TEST_OPENSTACK_SECRET", "bravo")
+	defer os.Unsetenv("TEST_OPENSTACK_SECRET")
+
+	for i, tc := range []struct {
+		cloud      *Cloud
+		wantErr    string
+		wantSecret string
+	}{
+		// 0: clouds.yaml
+		{
+			cloud: &Cloud{CloudName: "charlie", CloudsYAMLPath: "/etc/spire/server/clouds.yaml"},
+		},
+		// 1: secret from file
+		{
+			cloud: &Cloud{Auth: &Auth{
+				AuthURL:    "https://keystone.example.com:5000/v3",
+				Username:   "delta",
+				SecretFile: secretFile,
+			}},
+			wantSecret: "alpha",
+		},
+		// 2: secret from environment variable
+		{
+			cloud: &Cloud{Auth: &Auth{
+				AuthURL:                 "https://keystone.example.com:5000/v3",
+				ApplicationCredentialID: "echo",
+				SecretEnv:               "TEST_OPENSTACK_SECRET",
+			}},
+			wantSecret: "bravo",
+		},
+		// 3: both cloud_name and auth
+		{
+			cloud: &Cloud{CloudName: "charlie", Auth: &Auth{
+				AuthURL:   "https://keystone.example.com:5000/v3",
+				Username:  "delta",
+				SecretEnv: "TEST_OPENSTACK_SECRET",
+			}},
+			wantErr: "cloud_name and auth are mutually exclusive",
+		},
+		// 4: no auth_url
+		{
+			cloud:   &Cloud{Auth: &Auth{Username: "delta", SecretEnv: "TEST_OPENSTACK_SECRET"}},
+			wantErr: "auth.auth_url is required",
+		},
+		// 5: no secret source
+		{
+			cloud: &Cloud{Auth: &Auth{
+				AuthURL:  "https://keystone.example.com:5000/v3",
+				Username: "delta",
+			}},
+			wantErr: "auth requires either secret_file or secret_env",
+		},
+		// 6: empty environment variable
+		{
+			cloud: &Cloud{Auth: &Auth{
+				AuthURL:   "https://keystone.example.com:5000/v3",
+				Username:  "delta",
+				SecretEnv: "TEST_OPENSTACK_SECRET_UNSET",
+			}},
+			wantErr: "environment variable TEST_OPENSTACK_SECRET_UNSET given by auth.secret_env is empty",
+		},
+	} {
+		got, err := authOptions(tc.cloud.CloudName, tc.cloud.CloudsYAMLPath, tc.cloud.Auth)
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+			continue
+		}
+		if got.CloudName != tc.cloud.CloudName || got.CloudsYAMLPath != tc.cloud.CloudsYAMLPath {
+			t.Errorf("#%v: unexpected auth options: %+v", i, got)
+		}
+		if got.Secret != tc.wantSecret {
+			t.Errorf("#%v: got secret %q, want %q", i, got.Secret, tc.wantSecret)
+		}
+	}
+}
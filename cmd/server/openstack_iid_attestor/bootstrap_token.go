@@ -0,0 +1,54 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	nodeattestorv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/nodeattestor/v1"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+const (
+	defaultBootstrapTokenKey = "spire_bootstrap_token"
+)
+
+// BootstrapToken makes the plugin require the one-time token which the provisioning pipeline put into
+// the instance metadata at boot. The agent reads the token from the metadata service, and the plugin
+// deletes it from the instance after a successful attestation so that it can't be replayed.
+type BootstrapToken struct {
+	// Key is the instance metadata key which holds the token.
+	Key string `hcl:"key"`
+}
+
+// bootstrapTokenChallenge asks the agent for the bootstrap token, and compares it with the one in the
+// instance metadata. The token is left in place, the caller deletes it once attestation succeeded.
+func (p *IIDAttestorPlugin) bootstrapTokenChallenge(stream nodeattestorv1.NodeAttestor_AttestServer, s *openstack.Server, c *BootstrapToken) error {
+	token := s.Metadata[c.Key]
+	if token == "" {
+		return errors.New("bootstrap token challenge failed: instance has no bootstrap token")
+	}
+
+	resp, err := sendChallenge(stream, &common.Challenge{
+		Type:        common.ChallengeTypeBootstrapToken,
+		MetadataKey: c.Key,
+	})
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(resp.Nonce), []byte(token)) != 1 {
+		return errors.New("bootstrap token challenge failed: token mismatch")
+	}
+
+	p.logger.Debug("Bootstrap token challenge succeeded", "uuid", s.ID)
+
+	return nil
+}
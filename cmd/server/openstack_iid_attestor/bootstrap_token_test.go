@@ -0,0 +1,65 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
+	fake_openstack "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/openstack"
+	fake_server "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/server"
+)
+
+// bootstrapTokenConfig sets the bootstrap token challenge, with the selectors of all the metadata.
+func bootstrapTokenConfig(c *IIDAttestorPluginConfig) {
+	c.CustomMetaData = &CustomMetadata{}
+	c.BootstrapToken = &BootstrapToken{Key: defaultBootstrapTokenKey}
+}
+
+func TestAttestBootstrapTokenFailure(t *testing.T) {
+	for i, tc := range []struct {
+		meta    map[string]string
+		token   string
+		wantErr string
+	}{
+		// 0: token mismatch
+		{
+			meta:    map[string]string{defaultBootstrapTokenKey: "secret-token"},
+			token:   "guessed",
+			wantErr: "bootstrap token challenge failed: token mismatch",
+		},
+		// 1: no token in the instance metadata, e.g. it has been consumed
+		{
+			meta:    nil,
+			token:   "secret-token",
+			wantErr: "bootstrap token challenge failed: instance has no bootstrap token",
+		},
+	} {
+		fi := fake_openstack.NewInstance(testProjectID, tc.meta, nil)
+		p := newAttestTestPlugin(fi, bootstrapTokenConfig)
+
+		fs := fake_server.NewAttestStream(testPayload)
+		token := tc.token
+		fs.ChallengeHandler = func(b []byte) ([]byte, error) {
+			return json.Marshal(&common.ChallengeResponse{
+				Type:  common.ChallengeTypeBootstrapToken,
+				Nonce: token,
+			})
+		}
+
+		if err := p.Attest(fs); err == nil {
+			t.Errorf("#%v: expected an error, got nil", i)
+		} else if err.Error() != tc.wantErr {
+			t.Errorf("#%v: got %v, want %v", i, err, tc.wantErr)
+		}
+		if fs.AgentAttributes() != nil {
+			t.Errorf("#%v: agent attributes should not be sent", i)
+		}
+	}
+}
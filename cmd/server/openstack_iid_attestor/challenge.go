@@ -0,0 +1,124 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	nodeattestorv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/nodeattestor/v1"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+const (
+	defaultMetadataChallengeKey = "spire_attestation_nonce"
+	nonceSize                   = 32
+	// cleanupTimeout is the timeout of removing the nonce after the challenge failed, which is done
+	// even if the attestation has been cancelled.
+	cleanupTimeout = 10 * time.Second
+)
+
+// MetadataChallenge makes the plugin prove that the agent runs on the instance.
+// The plugin writes a random nonce into the instance metadata and the agent has to read it back
+// from the metadata service, which is reachable only from the instance.
+type MetadataChallenge struct {
+	// Key is the instance metadata key which the nonce is written to.
+	Key string `hcl:"key"`
+}
+
+// metadataChallenge runs the nonce challenge against the agent, and removes the nonce from the
+// instance metadata afterwards.
+func (p *IIDAttestorPlugin) metadataChallenge(stream nodeattestorv1.NodeAttestor_AttestServer, instance openstack.InstanceClient, uuid string, c *MetadataChallenge) error {
+	nonce, err := generateNonce()
+	if err != nil {
+		return err
+	}
+
+	if err := instance.SetMetadata(stream.Context(), uuid, c.Key, nonce); err != nil {
+		return fmt.Errorf("failed to write challenge nonce to instance metadata: %w", err)
+	}
+
+	resp, err := sendChallenge(stream, &common.Challenge{
+		Type:        common.ChallengeTypeMetadataNonce,
+		MetadataKey: c.Key,
+	})
+	if err != nil {
+		p.deleteMetadata(instance, uuid, c.Key)
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(resp.Nonce), []byte(nonce)) != 1 {
+		p.deleteMetadata(instance, uuid, c.Key)
+		return errors.New("metadata challenge failed: nonce mismatch")
+	}
+
+	if err := instance.DeleteMetadata(stream.Context(), uuid, c.Key); err != nil {
+		return fmt.Errorf("failed to delete challenge nonce from instance metadata: %w", err)
+	}
+
+	p.logger.Debug("Metadata challenge succeeded", "uuid", uuid)
+
+	return nil
+}
+
+// deleteMetadata removes given key from the instance metadata, only logging failures. It doesn't use the context
+// of the attestation, which is often done when the challenge fails, so that the key isn't left in the metadata.
+func (p *IIDAttestorPlugin) deleteMetadata(instance openstack.InstanceClient, uuid, key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	if err := instance.DeleteMetadata(ctx, uuid, key); err != nil {
+		p.logger.Warn("Failed to delete instance metadata", "uuid", uuid, "key", key, "error", err)
+	}
+}
+
+// sendChallenge sends the challenge to the agent and waits for its response.
+func sendChallenge(stream nodeattestorv1.NodeAttestor_AttestServer, challenge *common.Challenge) (*common.ChallengeResponse, error) {
+	b, err := json.Marshal(challenge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal challenge: %v", err)
+	}
+
+	if err := stream.Send(&nodeattestorv1.AttestResponse{
+		Response: &nodeattestorv1.AttestResponse_Challenge{
+			Challenge: b,
+		},
+	}); err != nil {
+		return nil, err
+	}
+
+	req, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &common.ChallengeResponse{}
+	if err := json.Unmarshal(req.GetChallengeResponse(), resp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal challenge response: %v", err)
+	}
+	if resp.Type != challenge.Type {
+		return nil, fmt.Errorf("unexpected challenge response type: %q", resp.Type)
+	}
+
+	return resp, nil
+}
+
+// generateNonce returns a random hex encoded nonce.
+func generateNonce() (string, error) {
+	b := make([]byte, nonceSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,172 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+// cloudIDPattern restricts the cloud IDs to the characters which are safe in the SPIFFE ID path.
+var cloudIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Cloud is an OpenStack cloud whose instances the plugin attests. The agent states the cloud it is on,
+// and the ID of the cloud is a part of the SPIFFE ID and the Selectors of the agent, so that instances
+// of different clouds never get the same identity.
+type Cloud struct {
+	ID string `hcl:",key"`
+
+	CloudName          string   `hcl:"cloud_name"`
+	CloudsYAMLPath     string   `hcl:"clouds_yaml_path"`
+	Auth               *Auth    `hcl:"auth"`
+	ProjectIDAllowList []string `hcl:"projectid_allow_list"`
+	// ProjectCredentials replace CloudName and Auth with a credential per project. The projects with
+	// the credentials are allowed, instead of ProjectIDAllowList.
+	ProjectCredentials []*ProjectCredential `hcl:"project_credential"`
+	// ProjectRules allow and deny the projects by their names, domains and parents, in addition to ProjectIDAllowList.
+	ProjectRules *ProjectRules `hcl:"project_rules"`
+
+	// Region, EndpointInterface, ComputeMicroversion and TLS default to the top-level ones.
+	Region              string `hcl:"region"`
+	EndpointInterface   string `hcl:"endpoint_interface"`
+	ComputeMicroversion string `hcl:"compute_microversion"`
+	TLS                 *TLS   `hcl:"tls"`
+
+	authOptions     openstack.AuthOptions
+	providerOptions openstack.ProviderOptions
+	computeOptions  openstack.ComputeOptions
+}
+
+// configureClouds returns the clouds given by the cloud blocks, keyed by their IDs. Without cloud blocks,
+// the top-level configuration is the only cloud, which has no ID.
+func configureClouds(config *IIDAttestorPluginConfig, providerOpts openstack.ProviderOptions) (map[string]*Cloud, error) {
+	if len(config.Clouds) == 0 {
+		c := &Cloud{
+			CloudName:          config.CloudName,
+			CloudsYAMLPath:     config.CloudsYAMLPath,
+			Auth:               config.Auth,
+			ProjectIDAllowList: config.ProjectIDAllowList,
+			ProjectCredentials: config.ProjectCredentials,
+			ProjectRules:       config.ProjectRules,
+		}
+		if err := c.configure(config, providerOpts); err != nil {
+			return nil, err
+		}
+		return map[string]*Cloud{"": c}, nil
+	}
+
+	if config.CloudName != "" || config.Auth != nil || len(config.ProjectIDAllowList) > 0 || len(config.ProjectCredentials) > 0 {
+		return nil, errors.New("cloud_name, auth, projectid_allow_list and project_credential must be given in the cloud blocks")
+	}
+	if config.ProjectRules != nil {
+		return nil, errors.New("project_rules must be given in the cloud blocks")
+	}
+	m := make(map[string]*Cloud, len(config.Clouds))
+	for _, c := range config.Clouds {
+		if !cloudIDPattern.MatchString(c.ID) {
+			return nil, fmt.Errorf("invalid cloud ID %q, must consist of alphanumerics, '.', '_' and '-'", c.ID)
+		}
+		if _, ok := m[c.ID]; ok {
+			return nil, fmt.Errorf("duplicate cloud ID %q", c.ID)
+		}
+		if c.CloudsYAMLPath == "" {
+			c.CloudsYAMLPath = config.CloudsYAMLPath
+		}
+		if err := c.configure(config, providerOpts); err != nil {
+			return nil, fmt.Errorf("cloud %q: %v", c.ID, err)
+		}
+		m[c.ID] = c
+	}
+	return m, nil
+}
+
+// configure validates the cloud, and resolves the options to build the client of the cloud with.
+func (c *Cloud) configure(config *IIDAttestorPluginConfig, providerOpts openstack.ProviderOptions) error {
+	if c.ProjectRules != nil {
+		if len(c.ProjectCredentials) > 0 {
+			// Listing the projects requires a credential which sees all of them.
+			return errors.New("project_rules can't be combined with project_credential")
+		}
+		if err := c.ProjectRules.validate(); err != nil {
+			return err
+		}
+	}
+	if len(c.ProjectCredentials) > 0 {
+		if err := c.configureProjectCredentials(); err != nil {
+			return err
+		}
+	} else {
+		switch {
+		case c.ProjectRules != nil && c.ProjectRules.Allow == nil && len(c.ProjectIDAllowList) == 0:
+			return errors.New("project_rules.allow is required without projectid_allow_list")
+		case c.ProjectRules == nil && len(c.ProjectIDAllowList) == 0:
+			return errors.New("projectid_allow_list is required")
+		}
+		authOpts, err := authOptions(c.CloudName, c.CloudsYAMLPath, c.Auth)
+		if err != nil {
+			return err
+		}
+		c.authOptions = authOpts
+	}
+
+	tlsConfig := c.TLS
+	if tlsConfig == nil {
+		tlsConfig = config.TLS
+	}
+	tlsOpts, err := tlsConfig.options()
+	if err != nil {
+		return err
+	}
+	c.providerOptions = providerOpts
+	c.providerOptions.TLS = tlsOpts
+
+	c.computeOptions = openstack.ComputeOptions{
+		Region:         valueOrDefault(c.Region, config.Region),
+		Interface:      valueOrDefault(c.EndpointInterface, config.EndpointInterface),
+		Microversion:   valueOrDefault(c.ComputeMicroversion, config.ComputeMicroversion),
+		ServerLocked:   config.needsServerLocked(),
+		ServerTags:     config.TagSelector || config.needsServerTags(),
+		EmbeddedFlavor: config.FlavorSelector || config.needsEmbeddedFlavor(),
+		KeyPairs:       config.needsKeyPairs(),
+	}
+	return nil
+}
+
+// allowsProject returns true if the project is allowed in the cloud.
+func (c *Cloud) allowsProject(projectID string) bool {
+	if c.ProjectRules == nil {
+		return isProjectAllowed(c.ProjectIDAllowList, projectID)
+	}
+	return c.ProjectRules.allows(c.ProjectIDAllowList, projectID)
+}
+
+// selectCloud returns the cloud the agent states it is on.
+// Without cloud blocks, the agent is on the only cloud whatever it states.
+func selectCloud(config *IIDAttestorPluginConfig, id string) (*Cloud, error) {
+	if c, ok := config.clouds[""]; ok {
+		return c, nil
+	}
+	if id == "" {
+		return nil, errors.New("attestation payload has no cloud")
+	}
+	c, ok := config.clouds[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown cloud: %q", id)
+	}
+	return c, nil
+}
+
+func valueOrDefault(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,262 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+	fake_common "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/common"
+	fake_openstack "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/openstack"
+	fake_server "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/server"
+)
+
+func newTestCloudPayload(cloud string) string {
+	b, err := json.Marshal(&common.AttestationPayload{
+		Version: common.PayloadVersion,
+		UUID:    testUUID,
+		Cloud:   cloud,
+		Evidence: &common.Evidence{
+			Name:             "bravo",
+			AvailabilityZone: "nova",
+			ProjectID:        testProjectID,
+		},
+		Nonce:     "nonce",
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+func TestConfigureClouds(t *testing.T) {
+	p := newTestPlugin()
+	got := make(map[string]*Cloud)
+	p.getInstanceHandler = func(_ context.Context, cloud *Cloud, _ openstack.AuthOptions, logger hclog.Logger) (openstack.InstanceClient, error) {
+		got[cloud.ID] = cloud
+		return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+	}
+
+	conf := `
+	clouds_yaml_path = "/etc/spire/server/clouds.yaml"
+	region = "RegionOne"
+	endpoint_interface = "internal"
+	cloud "east" {
+		cloud_name = "east"
+		projectid_allow_list = ["alpha"]
+	}
+	cloud "west" {
+		cloud_name = "west"
+		clouds_yaml_path = "/etc/spire/server/west.yaml"
+		projectid_allow_list = ["bravo"]
+		region = "RegionTwo"
+	}
+	`
+	if _, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, conf)); err != nil {
+		t.Fatalf("unexpected error from Configure(): %v", err)
+	}
+
+	for id, want := range map[string]struct {
+		cloudsYAMLPath string
+		region         string
+		allowList      []string
+	}{
+		"east": {cloudsYAMLPath: "/etc/spire/server/clouds.yaml", region: "RegionOne", allowList: []string{"alpha"}},
+		"west": {cloudsYAMLPath: "/etc/spire/server/west.yaml", region: "RegionTwo", allowList: []string{"bravo"}},
+	} {
+		c, ok := got[id]
+		if !ok {
+			t.Errorf("%s: no client is built", id)
+			continue
+		}
+		if c.authOptions.CloudName != id || c.authOptions.CloudsYAMLPath != want.cloudsYAMLPath {
+			t.Errorf("%s: unexpected auth options: %+v", id, c.authOptions)
+		}
+		if c.computeOptions.Region != want.region || c.computeOptions.Interface != "internal" {
+			t.Errorf("%s: unexpected compute options: %+v", id, c.computeOptions)
+		}
+		if !reflect.DeepEqual(c.ProjectIDAllowList, want.allowList) {
+			t.Errorf("%s: got allow list %v, want %v", id, c.ProjectIDAllowList, want.allowList)
+		}
+	}
+
+	_, instances, err := p.getConfig()
+	if err != nil {
+		t.Fatalf("unexpected error from getConfig(): %v", err)
+	}
+	if len(instances) != 2 || instances[instanceKey{cloud: "east"}] == nil || instances[instanceKey{cloud: "west"}] == nil {
+		t.Errorf("unexpected clients: %v", instances)
+	}
+}
+
+func TestConfigureCloudsError(t *testing.T) {
+	for i, tc := range []struct {
+		conf    string
+		wantErr string
+	}{
+		// 0: top-level cloud with cloud blocks
+		{
+			conf: `
+			cloud_name = "test"
+			cloud "east" {
+				cloud_name = "east"
+				projectid_allow_list = ["alpha"]
+			}
+			`,
+			wantErr: "cloud_name, auth, projectid_allow_list and project_credential must be given in the cloud blocks",
+		},
+		// 1: invalid ID
+		{
+			conf: `
+			cloud "east/1" {
+				cloud_name = "east"
+				projectid_allow_list = ["alpha"]
+			}
+			`,
+			wantErr: `invalid cloud ID "east/1", must consist of alphanumerics, '.', '_' and '-'`,
+		},
+		// 2: duplicate ID
+		{
+			conf: `
+			cloud "east" {
+				cloud_name = "east"
+				projectid_allow_list = ["alpha"]
+			}
+			cloud "east" {
+				cloud_name = "west"
+				projectid_allow_list = ["bravo"]
+			}
+			`,
+			wantErr: `duplicate cloud ID "east"`,
+		},
+		// 3: no allow list
+		{
+			conf: `
+			cloud "east" {
+				cloud_name = "east"
+			}
+			`,
+			wantErr: `cloud "east": projectid_allow_list is required`,
+		},
+		// 4: client error
+		{
+			conf: `
+			cloud "east" {
+				cloud_name = "east"
+				projectid_allow_list = ["alpha"]
+			}
+			cloud "west" {
+				cloud_name = "charlie"
+				projectid_allow_list = ["bravo"]
+			}
+			`,
+			wantErr: `failed to prepare OpenStack Client for cloud "west": authentication failed`,
+		},
+	} {
+		p := newTestPlugin()
+		p.getInstanceHandler = func(_ context.Context, cloud *Cloud, _ openstack.AuthOptions, logger hclog.Logger) (openstack.InstanceClient, error) {
+			if cloud.CloudName == "charlie" {
+				return nil, errors.New("authentication failed")
+			}
+			return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+		}
+
+		_, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, tc.conf))
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
+
+func TestAttestClouds(t *testing.T) {
+	for i, tc := range []struct {
+		cloud         string
+		wantErr       string
+		wantSpiffeID  string
+		wantSelectors []string
+	}{
+		// 0: east
+		{
+			cloud:         "east",
+			wantSpiffeID:  "spiffe://example.com/spire/agent/openstack_iid/east/abc/123",
+			wantSelectors: []string{"cloud:east"},
+		},
+		// 1: the project is not allowed in west
+		{
+			cloud:   "west",
+			wantErr: "invalid attestation request",
+		},
+		// 2: no cloud
+		{
+			wantErr: "attestation payload has no cloud",
+		},
+		// 3: unknown cloud
+		{
+			cloud:   "north",
+			wantErr: `unknown cloud: "north"`,
+		},
+	} {
+		p := newTestPlugin()
+		p.config.clouds = map[string]*Cloud{
+			"east": {ID: "east", ProjectIDAllowList: []string{testProjectID}},
+			"west": {ID: "west", ProjectIDAllowList: []string{"delta"}},
+		}
+		p.instances = map[instanceKey]openstack.InstanceClient{
+			{cloud: "east"}: fake_openstack.NewInstance(testProjectID, nil, nil),
+			{cloud: "west"}: fake_openstack.NewInstance(testProjectID, nil, nil),
+		}
+		p.attestedBeforeHandler = notAttestedBeforeHandler
+
+		fs := fake_server.NewAttestStream(newTestCloudPayload(tc.cloud))
+		err := p.Attest(fs)
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error from Attest(): %v", i, err)
+			continue
+		}
+
+		attrs := fs.AgentAttributes()
+		if attrs.SpiffeId != tc.wantSpiffeID {
+			t.Errorf("#%v: got SPIFFE ID %v, want %v", i, attrs.SpiffeId, tc.wantSpiffeID)
+		}
+		got := append([]string(nil), attrs.SelectorValues...)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.wantSelectors) {
+			t.Errorf("#%v: got selectors %v, want %v", i, got, tc.wantSelectors)
+		}
+	}
+}
+
+func TestAttestSingleCloudIgnoresStatedCloud(t *testing.T) {
+	p := newTestPlugin()
+	setTestInstance(p, fake_openstack.NewInstance(testProjectID, nil, nil), testProjectID)
+	p.attestedBeforeHandler = notAttestedBeforeHandler
+
+	fs := fake_server.NewAttestStream(newTestCloudPayload("east"))
+	if err := p.Attest(fs); err != nil {
+		t.Fatalf("unexpected error from Attest(): %v", err)
+	}
+	if got, want := fs.AgentAttributes().SpiffeId, common.GenerateSpiffeID("example.com", testProjectID, testUUID); got != want {
+		t.Errorf("got SPIFFE ID %v, want %v", got, want)
+	}
+}
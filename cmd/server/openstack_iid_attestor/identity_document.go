@@ -0,0 +1,183 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	nodeattestorv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/nodeattestor/v1"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+const (
+	defaultVendorDataName = "spire"
+	defaultJWKSRefresh    = 5 * time.Minute
+	// Unknown key IDs make the plugin refresh the JWKS at most once in this interval.
+	minJWKSRefresh = 30 * time.Second
+	jwksTimeout    = 10 * time.Second
+)
+
+// IdentityDocument makes the plugin verify a signed instance identity document, which is served
+// to the instance through the Nova DynamicJSON vendordata.
+type IdentityDocument struct {
+	// VendorDataName is the name of the vendordata entry (the name part of
+	// `vendordata_dynamic_targets` in nova.conf) which holds the identity document.
+	VendorDataName string `hcl:"vendordata_name"`
+	// Audience is the expected "aud" claim of the identity document.
+	Audience string `hcl:"audience"`
+	// PublicKeys are PEM encoded public keys which the identity document is signed with.
+	PublicKeys []string `hcl:"public_keys"`
+	// JWKSURL is the URL of the JWKS endpoint which serves the keys the identity document is signed with,
+	// such as the one served by vendordata-signer.
+	JWKSURL string `hcl:"jwks_url"`
+	// JWKSRefreshInterval is the interval to refresh the keys served at JWKSURL.
+	JWKSRefreshInterval string `hcl:"jwks_refresh_interval"`
+	// MaxAge is the maximum age of the identity document since it was issued.
+	// If MaxAge is empty, only the expiration time of the document is checked.
+	MaxAge string `hcl:"max_age"`
+
+	keys        *jose.JSONWebKeySet
+	maxAge      time.Duration
+	jwksRefresh time.Duration
+
+	jwksMtx       sync.Mutex
+	jwks          *jose.JSONWebKeySet
+	jwksFetchedAt time.Time
+}
+
+// validate checks the configuration and prepares the verification keys.
+func (c *IdentityDocument) validate() error {
+	if c.VendorDataName == "" {
+		c.VendorDataName = defaultVendorDataName
+	}
+	if c.Audience == "" {
+		return errors.New("identity_document.audience is required")
+	}
+	if len(c.PublicKeys) == 0 && c.JWKSURL == "" {
+		return errors.New("identity_document.public_keys or identity_document.jwks_url is required")
+	}
+
+	keys, err := openstack.ParsePublicKeys(c.PublicKeys)
+	if err != nil {
+		return fmt.Errorf("invalid identity_document.public_keys: %v", err)
+	}
+	c.keys = keys
+
+	if c.JWKSURL != "" {
+		if _, err := url.ParseRequestURI(c.JWKSURL); err != nil {
+			return fmt.Errorf("invalid identity_document.jwks_url: %v", err)
+		}
+	}
+	c.jwksRefresh = defaultJWKSRefresh
+	if c.JWKSRefreshInterval != "" {
+		d, err := time.ParseDuration(c.JWKSRefreshInterval)
+		if err != nil {
+			return fmt.Errorf("invalid identity_document.jwks_refresh_interval: %v", err)
+		}
+		c.jwksRefresh = d
+	}
+
+	if c.MaxAge != "" {
+		d, err := time.ParseDuration(c.MaxAge)
+		if err != nil {
+			return fmt.Errorf("invalid identity_document.max_age: %v", err)
+		}
+		c.maxAge = d
+	}
+
+	return nil
+}
+
+// keySet returns the keys which identity documents are verified with.
+// The keys served at JWKSURL are cached, and fetched again when the cache is stale or
+// when forced, at most once per minJWKSRefresh.
+func (c *IdentityDocument) keySet(force bool) (*jose.JSONWebKeySet, error) {
+	if c.JWKSURL == "" {
+		return c.keys, nil
+	}
+
+	c.jwksMtx.Lock()
+	defer c.jwksMtx.Unlock()
+
+	age := time.Since(c.jwksFetchedAt)
+	if c.jwks == nil || age > c.jwksRefresh || (force && age > minJWKSRefresh) {
+		jwks, err := openstack.FetchJWKS(&http.Client{Timeout: jwksTimeout}, c.JWKSURL)
+		switch {
+		case err != nil && c.jwks == nil:
+			return nil, fmt.Errorf("failed to fetch identity document keys: %v", err)
+		case err == nil:
+			c.jwks = jwks
+			c.jwksFetchedAt = time.Now()
+		}
+		// Otherwise keep using the cached keys until the JWKS endpoint recovers.
+	}
+
+	keys := &jose.JSONWebKeySet{}
+	keys.Keys = append(keys.Keys, c.keys.Keys...)
+	keys.Keys = append(keys.Keys, c.jwks.Keys...)
+	return keys, nil
+}
+
+// identityDocumentChallenge asks the agent for the identity document, and verifies it against the instance.
+func (p *IIDAttestorPlugin) identityDocumentChallenge(stream nodeattestorv1.NodeAttestor_AttestServer, s *openstack.Server, c *IdentityDocument) error {
+	resp, err := sendChallenge(stream, &common.Challenge{
+		Type:           common.ChallengeTypeIdentityDocument,
+		VendorDataName: c.VendorDataName,
+	})
+	if err != nil {
+		return err
+	}
+
+	keys, err := c.keySet(false)
+	if err != nil {
+		return err
+	}
+	doc, err := openstack.VerifyIdentityDocument(resp.IdentityDocument, keys, c.Audience, c.maxAge, time.Now())
+	if errors.Is(err, openstack.ErrUnknownKeyID) && c.JWKSURL != "" {
+		// The signer may have rotated its key.
+		if keys, err = c.keySet(true); err != nil {
+			return err
+		}
+		doc, err = openstack.VerifyIdentityDocument(resp.IdentityDocument, keys, c.Audience, c.maxAge, time.Now())
+	}
+	if err != nil {
+		return err
+	}
+	if err := matchIdentityDocument(doc, s); err != nil {
+		return err
+	}
+
+	p.logger.Debug("Identity document verified", "uuid", s.ID)
+
+	return nil
+}
+
+// matchIdentityDocument checks that the identity document describes given instance.
+func matchIdentityDocument(doc *openstack.IdentityDocument, s *openstack.Server) error {
+	if doc.InstanceID != s.ID {
+		return fmt.Errorf("identity document instance_id mismatch: got %q, want %q", doc.InstanceID, s.ID)
+	}
+	if doc.ProjectID != s.TenantID {
+		return fmt.Errorf("identity document project_id mismatch: got %q, want %q", doc.ProjectID, s.TenantID)
+	}
+	if doc.ImageID != "" {
+		// The image of a volume-backed instance is empty.
+		if imageID := s.ImageID(); doc.ImageID != imageID {
+			return fmt.Errorf("identity document image_id mismatch: got %q, want %q", doc.ImageID, imageID)
+		}
+	}
+	return nil
+}
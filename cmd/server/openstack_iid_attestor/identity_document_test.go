@@ -0,0 +1,218 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+	fake_common "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/common"
+	fake_openstack "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/openstack"
+	fake_server "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/server"
+)
+
+func newIdentityDocumentKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// identityDocumentChallengeHandler answers the identity document challenge with a document signed by given key.
+func identityDocumentChallengeHandler(t *testing.T, key *ecdsa.PrivateKey, projectID string) func([]byte) ([]byte, error) {
+	return identityDocumentChallengeHandlerWithKeyID(t, key, "", projectID)
+}
+
+func identityDocumentChallengeHandlerWithKeyID(t *testing.T, key *ecdsa.PrivateKey, kid, projectID string) func([]byte) ([]byte, error) {
+	return func(b []byte) ([]byte, error) {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jose.JSONWebKey{Key: key, KeyID: kid}}, nil)
+		if err != nil {
+			t.Fatalf("failed to create signer: %v", err)
+		}
+		now := time.Now()
+		token, err := openstack.SignIdentityDocument(&openstack.IdentityDocument{
+			Claims: jwt.Claims{
+				Audience: jwt.Audience{"spire-server"},
+				IssuedAt: jwt.NewNumericDate(now),
+				Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+			},
+			InstanceID: testUUID,
+			ProjectID:  projectID,
+		}, signer)
+		if err != nil {
+			t.Fatalf("failed to sign identity document: %v", err)
+		}
+		return json.Marshal(&common.ChallengeResponse{
+			Type:             common.ChallengeTypeIdentityDocument,
+			IdentityDocument: token,
+		})
+	}
+}
+
+// identityDocumentConfig returns the configuration which requires the identity documents signed by given key.
+func identityDocumentConfig(t *testing.T, pubPEM string) func(*IIDAttestorPluginConfig) {
+	return func(c *IIDAttestorPluginConfig) {
+		c.IdentityDocument = &IdentityDocument{
+			Audience:   "spire-server",
+			PublicKeys: []string{pubPEM},
+		}
+		if err := c.IdentityDocument.validate(); err != nil {
+			t.Fatalf("unexpected error from validate(): %v", err)
+		}
+	}
+}
+
+func TestAttestIdentityDocumentFailure(t *testing.T) {
+	key, pubPEM := newIdentityDocumentKey(t)
+	otherKey, _ := newIdentityDocumentKey(t)
+
+	for i, tc := range []struct {
+		key       *ecdsa.PrivateKey
+		projectID string
+		wantErr   string
+	}{
+		// 0: project mismatch
+		{
+			key:       key,
+			projectID: "another-project",
+			wantErr:   fmt.Sprintf("identity document project_id mismatch: got %q, want %q", "another-project", testProjectID),
+		},
+		// 1: signed with an unknown key
+		{
+			key:       otherKey,
+			projectID: testProjectID,
+			wantErr:   "identity document has an invalid signature",
+		},
+	} {
+		p := newAttestTestPlugin(fake_openstack.NewInstance(testProjectID, nil, nil), identityDocumentConfig(t, pubPEM))
+
+		fs := fake_server.NewAttestStream(testPayload)
+		fs.ChallengeHandler = identityDocumentChallengeHandler(t, tc.key, tc.projectID)
+
+		if err := p.Attest(fs); err == nil {
+			t.Errorf("#%v: expected an error, got nil", i)
+		} else if err.Error() != tc.wantErr {
+			t.Errorf("#%v: got %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
+
+func TestAttestIdentityDocumentJWKS(t *testing.T) {
+	key, _ := newIdentityDocumentKey(t)
+	jwks := &jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: "rotated-key", Use: "sig"}},
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jwks)
+	}))
+	defer ts.Close()
+
+	p := newAttestTestPlugin(fake_openstack.NewInstance(testProjectID, nil, nil), func(c *IIDAttestorPluginConfig) {
+		c.IdentityDocument = &IdentityDocument{
+			Audience: "spire-server",
+			JWKSURL:  ts.URL,
+		}
+		if err := c.IdentityDocument.validate(); err != nil {
+			t.Fatalf("unexpected error from validate(): %v", err)
+		}
+	})
+
+	fs := fake_server.NewAttestStream(testPayload)
+	fs.ChallengeHandler = identityDocumentChallengeHandlerWithKeyID(t, key, "rotated-key", testProjectID)
+
+	if err := p.Attest(fs); err != nil {
+		t.Fatalf("Attestation error: %v", err)
+	}
+}
+
+func TestConfigureIdentityDocument(t *testing.T) {
+	_, pubPEM := newIdentityDocumentKey(t)
+
+	for i, tc := range []struct {
+		conf    string
+		wantErr string
+	}{
+		// 0: normal case
+		{
+			conf: fmt.Sprintf(`
+	projectid_allow_list = ["alpha"]
+	identity_document = {
+		audience = "spire-server"
+		public_keys = [<<EOF
+%sEOF
+		]
+		max_age = "10m"
+	}
+	`, pubPEM),
+		},
+		// 1: no audience
+		{
+			conf: `
+	projectid_allow_list = ["alpha"]
+	identity_document = {
+		public_keys = ["key"]
+	}
+	`,
+			wantErr: "identity_document.audience is required",
+		},
+		// 2: no public keys
+		{
+			conf: `
+	projectid_allow_list = ["alpha"]
+	identity_document = {
+		audience = "spire-server"
+	}
+	`,
+			wantErr: "identity_document.public_keys or identity_document.jwks_url is required",
+		},
+	} {
+		p := newTestPlugin()
+		p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, logger hclog.Logger) (openstack.InstanceClient, error) {
+			return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+		}
+
+		req := fake_common.NewConfigureRequest(globalConfig, tc.conf)
+		_, err := p.Configure(context.Background(), req)
+		if tc.wantErr != "" {
+			if err == nil {
+				t.Errorf("#%v: expected an error, got nil", i)
+			} else if err.Error() != tc.wantErr {
+				t.Errorf("#%v: got %v, want %v", i, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error from Configure(): %v", i, err)
+			continue
+		}
+		if c := p.config.IdentityDocument; c.VendorDataName != defaultVendorDataName || c.maxAge != 10*time.Minute || len(c.keys.Keys) != 1 {
+			t.Errorf("#%v: unexpected identity_document config: %+v", i, c)
+		}
+	}
+}
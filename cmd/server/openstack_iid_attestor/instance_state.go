@@ -0,0 +1,79 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+const (
+	defaultAllowedStatus = "ACTIVE"
+)
+
+// InstanceState restricts the lifecycle state of instances which can be attested.
+type InstanceState struct {
+	// AllowedStatuses are the allowed values of the instance status, such as "ACTIVE" or "SHUTOFF".
+	// Defaults to ["ACTIVE"].
+	AllowedStatuses []string `hcl:"allowed_statuses"`
+	// AllowedPowerStates are the allowed values of the power state (OS-EXT-STS:power_state),
+	// such as "RUNNING". If empty, the power state is not checked.
+	AllowedPowerStates []string `hcl:"allowed_power_states"`
+	// DenyTaskInProgress rejects instances which have a task in progress (OS-EXT-STS:task_state),
+	// such as rebuilding or migrating.
+	DenyTaskInProgress bool `hcl:"deny_task_in_progress"`
+	// DenyRescued rejects instances in rescue mode, which boot another image on the same UUID.
+	DenyRescued bool `hcl:"deny_rescued"`
+	// DenyLocked rejects locked instances.
+	DenyLocked bool `hcl:"deny_locked"`
+}
+
+// validate checks the configuration and sets the default values.
+func (c *InstanceState) validate() error {
+	if len(c.AllowedStatuses) == 0 {
+		c.AllowedStatuses = []string{defaultAllowedStatus}
+	}
+	return nil
+}
+
+// check returns an error if the instance is not in an allowed state.
+func (c *InstanceState) check(s *openstack.Server) error {
+	if !contains(c.AllowedStatuses, s.Status) {
+		return fmt.Errorf("instance status %q is not allowed", s.Status)
+	}
+	if len(c.AllowedPowerStates) > 0 && !contains(c.AllowedPowerStates, s.PowerState.String()) {
+		return fmt.Errorf("instance power state %q is not allowed", s.PowerState)
+	}
+	if c.DenyTaskInProgress && s.TaskState != "" {
+		return fmt.Errorf("instance has a task in progress: %q", s.TaskState)
+	}
+	if c.DenyRescued && s.IsRescued() {
+		return errors.New("instance is in rescue mode")
+	}
+	if c.DenyLocked {
+		switch {
+		case s.Locked == nil:
+			return errors.New("lock state of the instance is unknown")
+		case *s.Locked:
+			return errors.New("instance is locked")
+		}
+	}
+	return nil
+}
+
+// contains returns true if given list has the value.
+func contains(list []string, v string) bool {
+	for _, e := range list {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/extendedstatus"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+	fake_common "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/common"
+	fake_openstack "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/openstack"
+	fake_server "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/server"
+)
+
+func newServer(status, vmState, taskState string, powerState extendedstatus.PowerState, locked *bool) *openstack.Server {
+	return &openstack.Server{
+		Server: servers.Server{ID: testUUID, Status: status},
+		ServerExtendedStatusExt: extendedstatus.ServerExtendedStatusExt{
+			VmState:    vmState,
+			TaskState:  taskState,
+			PowerState: powerState,
+		},
+		ServerLockedExt: openstack.ServerLockedExt{Locked: locked},
+	}
+}
+
+func TestInstanceStateCheck(t *testing.T) {
+	locked, unlocked := true, false
+	strict := &InstanceState{
+		AllowedPowerStates: []string{"RUNNING"},
+		DenyTaskInProgress: true,
+		DenyRescued:        true,
+		DenyLocked:         true,
+	}
+
+	for i, tc := range []struct {
+		state   *InstanceState
+		server  *openstack.Server
+		wantErr string
+	}{
+		// 0: active instance with the default config
+		{
+			state:  &InstanceState{},
+			server: newServer("ACTIVE", "active", "", extendedstatus.RUNNING, nil),
+		},
+		// 1: stopped instance with the default config
+		{
+			state:   &InstanceState{},
+			server:  newServer("SHUTOFF", "stopped", "", extendedstatus.SHUTDOWN, nil),
+			wantErr: `instance status "SHUTOFF" is not allowed`,
+		},
+		// 2: active instance with the strict config
+		{
+			state:  strict,
+			server: newServer("ACTIVE", "active", "", extendedstatus.RUNNING, &unlocked),
+		},
+		// 3: paused instance
+		{
+			state:   &InstanceState{AllowedStatuses: []string{"ACTIVE", "PAUSED"}, AllowedPowerStates: []string{"RUNNING"}},
+			server:  newServer("PAUSED", "paused", "", extendedstatus.PAUSED, nil),
+			wantErr: `instance power state "PAUSED" is not allowed`,
+		},
+		// 4: instance being rebuilt
+		{
+			state:   strict,
+			server:  newServer("ACTIVE", "active", "rebuilding", extendedstatus.RUNNING, &unlocked),
+			wantErr: `instance has a task in progress: "rebuilding"`,
+		},
+		// 5: rescued instance
+		{
+			state:   &InstanceState{AllowedStatuses: []string{"ACTIVE", "RESCUE"}, DenyRescued: true},
+			server:  newServer("RESCUE", "rescued", "", extendedstatus.RUNNING, nil),
+			wantErr: "instance is in rescue mode",
+		},
+		// 6: locked instance
+		{
+			state:   strict,
+			server:  newServer("ACTIVE", "active", "", extendedstatus.RUNNING, &locked),
+			wantErr: "instance is locked",
+		},
+		// 7: unknown lock state
+		{
+			state:   strict,
+			server:  newServer("ACTIVE", "active", "", extendedstatus.RUNNING, nil),
+			wantErr: "lock state of the instance is unknown",
+		},
+	} {
+		if err := tc.state.validate(); err != nil {
+			t.Fatalf("#%v: unexpected error from validate(): %v", i, err)
+		}
+		err := tc.state.check(tc.server)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("#%v: unexpected error from check(): %v", i, err)
+		case tc.wantErr != "" && err == nil:
+			t.Errorf("#%v: expected an error, got nil", i)
+		case tc.wantErr != "" && err.Error() != tc.wantErr:
+			t.Errorf("#%v: got %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
+
+func TestAttestInstanceState(t *testing.T) {
+	fi := fake_openstack.NewInstance(testProjectID, nil, nil)
+	fi.Status = "SHUTOFF"
+
+	p := newTestPlugin()
+	p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, logger hclog.Logger) (openstack.InstanceClient, error) {
+		return fi, nil
+	}
+	p.attestedBeforeHandler = notAttestedBeforeHandler
+
+	// The default config admits ACTIVE instances only.
+	req := fake_common.NewConfigureRequest(globalConfig, `projectid_allow_list = ["abc"]`)
+	if _, err := p.Configure(context.Background(), req); err != nil {
+		t.Fatalf("unexpected error from Configure(): %v", err)
+	}
+
+	fs := fake_server.NewAttestStream(testPayload)
+
+	wantErr := `instance status "SHUTOFF" is not allowed`
+	if err := p.Attest(fs); err == nil {
+		t.Errorf("an error expected, got nil")
+	} else if err.Error() != wantErr {
+		t.Errorf("got %v, want %v", err, wantErr)
+	}
+}
+
+func TestConfigureInstanceStateComputeOptions(t *testing.T) {
+	for i, tc := range []struct {
+		conf string
+		want bool
+	}{
+		// 0: the lock state is not required
+		{
+			conf: `projectid_allow_list = ["abc"]`,
+			want: false,
+		},
+		// 1: deny_locked
+		{
+			conf: `
+			projectid_allow_list = ["abc"]
+			instance_state = {
+				deny_locked = true
+			}
+			`,
+			want: true,
+		},
+		// 2: deny_locked of a project
+		{
+			conf: `
+			projectid_allow_list = ["abc"]
+			project "abc" {
+				instance_state = {
+					deny_locked = true
+				}
+			}
+			`,
+			want: true,
+		},
+	} {
+		p := newTestPlugin()
+		var got openstack.ComputeOptions
+		p.getInstanceHandler = func(_ context.Context, cloud *Cloud, _ openstack.AuthOptions, _ hclog.Logger) (openstack.InstanceClient, error) {
+			got = cloud.computeOptions
+			return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+		}
+
+		if _, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, tc.conf)); err != nil {
+			t.Fatalf("#%v: unexpected error from Configure(): %v", i, err)
+		}
+		if got.ServerLocked != tc.want {
+			t.Errorf("#%v: got lock state required %v, want %v", i, got.ServerLocked, tc.want)
+		}
+	}
+}
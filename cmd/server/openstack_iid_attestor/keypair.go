@@ -0,0 +1,72 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	nodeattestorv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/nodeattestor/v1"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+// KeyPairChallenge makes the plugin require a proof of possession of the private key of the Nova keypair
+// the instance was booted with. The agent signs a nonce with the key, and the plugin verifies the signature
+// with the public key registered in Nova. RSA keys must sign with "rsa-sha2-256" or "rsa-sha2-512", SHA-1 based
+// "ssh-rsa" signatures are rejected.
+//
+// The keypair is owned by the user who booted the instance, so the plugin gets it with the user ID, which requires
+// the admin role under the default Nova policy. The access is checked when the plugin is configured.
+type KeyPairChallenge struct{}
+
+// keyPairChallenge runs the keypair challenge against the agent.
+func (p *IIDAttestorPlugin) keyPairChallenge(stream nodeattestorv1.NodeAttestor_AttestServer, instance openstack.InstanceClient, s *openstack.Server) error {
+	if s.KeyName == "" {
+		return errors.New("keypair challenge failed: instance has no keypair")
+	}
+
+	kp, err := instance.GetKeyPair(stream.Context(), s.KeyName, s.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to get keypair information: %w", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(kp.PublicKey))
+	if err != nil {
+		return fmt.Errorf("failed to parse public key of keypair %q: %v", s.KeyName, err)
+	}
+
+	nonce, err := generateNonce()
+	if err != nil {
+		return err
+	}
+
+	resp, err := sendChallenge(stream, &common.Challenge{
+		Type:  common.ChallengeTypeKeyPair,
+		Nonce: nonce,
+	})
+	if err != nil {
+		return err
+	}
+
+	sig := &ssh.Signature{}
+	if err := ssh.Unmarshal(resp.Signature, sig); err != nil {
+		return fmt.Errorf("keypair challenge failed: invalid signature: %v", err)
+	}
+	if pub.Type() == ssh.KeyAlgoRSA && sig.Format != ssh.SigAlgoRSASHA2256 && sig.Format != ssh.SigAlgoRSASHA2512 {
+		return fmt.Errorf("keypair challenge failed: signature algorithm %q is not allowed, use %q or %q", sig.Format, ssh.SigAlgoRSASHA2256, ssh.SigAlgoRSASHA2512)
+	}
+	if err := pub.Verify(common.KeyPairChallengeData(s.ID, nonce), sig); err != nil {
+		return fmt.Errorf("keypair challenge failed: %v", err)
+	}
+
+	p.logger.Debug("Keypair challenge succeeded", "uuid", s.ID, "keypair", s.KeyName)
+
+	return nil
+}
@@ -0,0 +1,114 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
+	fake_openstack "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/openstack"
+	fake_server "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/server"
+)
+
+const testKeyName = "alpha-key"
+
+func newSSHSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	return signer
+}
+
+func newRSASSHSigner(t *testing.T) ssh.Signer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	return signer
+}
+
+// keyPairChallengeHandler answers the keypair challenge with a signature made by given signer.
+func keyPairChallengeHandler(t *testing.T, signer ssh.Signer) func([]byte) ([]byte, error) {
+	return func(b []byte) ([]byte, error) {
+		c := &common.Challenge{}
+		if err := json.Unmarshal(b, c); err != nil {
+			t.Fatalf("failed to unmarshal challenge: %v", err)
+		}
+		sig, err := signer.Sign(rand.Reader, common.KeyPairChallengeData(testUUID, c.Nonce))
+		if err != nil {
+			t.Fatalf("failed to sign challenge: %v", err)
+		}
+		return json.Marshal(&common.ChallengeResponse{
+			Type:      common.ChallengeTypeKeyPair,
+			Signature: ssh.Marshal(sig),
+		})
+	}
+}
+
+func TestAttestKeyPairChallengeFailure(t *testing.T) {
+	signer := newSSHSigner(t)
+	authorizedKey := string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	rsaSigner := newRSASSHSigner(t)
+	rsaAuthorizedKey := string(ssh.MarshalAuthorizedKey(rsaSigner.PublicKey()))
+
+	for i, tc := range []struct {
+		keyName string
+		signer  ssh.Signer
+		wantErr string
+	}{
+		// 0: instance without keypair
+		{
+			keyName: "",
+			signer:  signer,
+			wantErr: "keypair challenge failed: instance has no keypair",
+		},
+		// 1: signed with another key
+		{
+			keyName: testKeyName,
+			signer:  newSSHSigner(t),
+			wantErr: "keypair challenge failed: ssh: signature did not verify",
+		},
+		// 2: SHA-1 based RSA signature
+		{
+			keyName: "bravo-key",
+			signer:  rsaSigner,
+			wantErr: `keypair challenge failed: signature algorithm "ssh-rsa" is not allowed, use "rsa-sha2-256" or "rsa-sha2-512"`,
+		},
+	} {
+		fi := fake_openstack.NewInstance(testProjectID, nil, nil)
+		fi.KeyName = tc.keyName
+		fi.KeyPairs = map[string]string{testKeyName: authorizedKey, "bravo-key": rsaAuthorizedKey}
+		p := newAttestTestPlugin(fi, func(c *IIDAttestorPluginConfig) {
+			c.KeyPairChallenge = &KeyPairChallenge{}
+		})
+
+		fs := fake_server.NewAttestStream(testPayload)
+		fs.ChallengeHandler = keyPairChallengeHandler(t, tc.signer)
+
+		if err := p.Attest(fs); err == nil {
+			t.Errorf("#%v: expected an error, got nil", i)
+		} else if err.Error() != tc.wantErr {
+			t.Errorf("#%v: got %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
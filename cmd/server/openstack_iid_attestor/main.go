@@ -13,9 +13,10 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"text/template"
+	"time"
 
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/secgroups"
-	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/hcl"
 	"github.com/mitchellh/mapstructure"
@@ -24,7 +25,6 @@ import (
 	configv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/service/common/config/v1"
 	nodeattestorbase "github.com/spiffe/spire/pkg/server/plugin/nodeattestor/base"
 
-	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
 	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
 )
 
@@ -34,20 +34,108 @@ type IIDAttestorPlugin struct {
 	nodeattestorv1.UnsafeNodeAttestorServer
 	configv1.UnsafeConfigServer
 
-	logger   hclog.Logger
-	config   *IIDAttestorPluginConfig
-	instance openstack.InstanceClient
+	logger    hclog.Logger
+	config    *IIDAttestorPluginConfig
+	instances map[instanceKey]openstack.InstanceClient
 
 	mtx *sync.RWMutex
 
-	getInstanceHandler    func(string, hclog.Logger) (openstack.InstanceClient, error)
+	getInstanceHandler    func(context.Context, *Cloud, openstack.AuthOptions, hclog.Logger) (openstack.InstanceClient, error)
+	getIdentityHandler    func(context.Context, *Cloud, openstack.AuthOptions, hclog.Logger) (openstack.IdentityClient, error)
 	attestedBeforeHandler func(ctx context.Context, p *IIDAttestorPlugin, agentID string) (bool, error)
 }
 
 type IIDAttestorPluginConfig struct {
-	trustDomain        string
-	CloudName          string   `hcl:"cloud_name"`
+	trustDomain string
+	// CloudName is the name of the cloud entry in clouds.yaml, which is looked up in CloudsYAMLPath
+	// or the standard locations. secure.yaml next to CloudsYAMLPath, if any, is merged into the entry.
+	//
+	//  plugin_data {
+	//     cloud_name = "test"
+	//     // optional
+	//     clouds_yaml_path = "/etc/spire/server/clouds.yaml"
+	//  }
+	//
+	CloudName      string `hcl:"cloud_name"`
+	CloudsYAMLPath string `hcl:"clouds_yaml_path"`
+	// If Auth is not nil, the plugin authenticates to Keystone with it instead of clouds.yaml.
+	//
+	//  plugin_data {
+	//     auth = {
+	//         auth_url = "https://keystone.example.com:5000/v3"
+	//         region = "RegionOne"
+	//         application_credential_id = "..."
+	//         // either of them
+	//         secret_file = "/run/secrets/openstack"
+	//         secret_env = "OS_APPLICATION_CREDENTIAL_SECRET"
+	//     }
+	//  }
+	//
+	Auth               *Auth    `hcl:"auth"`
 	ProjectIDAllowList []string `hcl:"projectid_allow_list"`
+	// ProjectCredentials are the credentials to look up the instances of each project with, instead of
+	// CloudName or Auth, for the clouds which don't grant a single credential the read access to the
+	// instances of every project. The projects with the credentials are allowed instead of ProjectIDAllowList,
+	// and the plugin looks up the instance only in the project the agent states. The instance which
+	// is not found in the project is denied.
+	//
+	//  plugin_data {
+	//     project_credential "alpha" {
+	//         cloud_name = "alpha"
+	//     }
+	//     project_credential "bravo" {
+	//         auth = {
+	//             auth_url = "https://keystone.example.com:5000/v3"
+	//             application_credential_id = "..."
+	//             secret_file = "/run/secrets/openstack-bravo"
+	//         }
+	//     }
+	//  }
+	//
+	ProjectCredentials []*ProjectCredential `hcl:"project_credential"`
+	// ProjectRules allow the projects by their names, domains and parents in Keystone, in addition to
+	// ProjectIDAllowList, so that new sub-projects are covered. Deny takes precedence over the allowed ones.
+	// The plugin lists the projects, which requires a credential that sees all of them, every RefreshInterval
+	// in the background, and logs the changes of the allowed projects.
+	//
+	//  plugin_data {
+	//     project_rules = {
+	//         allow = {
+	//             // optional, "<domain ID>/<name>"
+	//             names = ["default/web"]
+	//             // optional
+	//             domain_ids = ["c9f8a8b0e5c34b8b9c1c2d3e4f5a6b7c"]
+	//             // optional, the projects and their descendants
+	//             parent_ids = ["8d9e7f6a5b4c4d3e2f1a0b9c8d7e6f5a"]
+	//         }
+	//         deny = {
+	//             ids = ["0a1b2c3d4e5f4a6b7c8d9e0f1a2b3c4d"]
+	//         }
+	//         // optional, defaults to "10m"
+	//         refresh_interval = "5m"
+	//     }
+	//  }
+	//
+	ProjectRules *ProjectRules `hcl:"project_rules"`
+	// Clouds are the OpenStack clouds to attest the instances of, instead of the single cloud given by
+	// CloudName or Auth. The agent states the cloud it is on, and the SPIFFE ID and the Selectors of the
+	// agent include the cloud ID. clouds_yaml_path, region, endpoint_interface, compute_microversion and tls
+	// given at the top level are the defaults of the clouds.
+	//
+	//  plugin_data {
+	//     cloud "east" {
+	//         cloud_name = "east"
+	//         projectid_allow_list = ["alpha"]
+	//     }
+	//     cloud "west" {
+	//         auth = {...}
+	//         projectid_allow_list = ["bravo"]
+	//         // optional
+	//         region = "RegionTwo"
+	//     }
+	//  }
+	//
+	Clouds []*Cloud `hcl:"cloud"`
 	// If CustomMetaData is not nil, the plugin makes custom metadata Selectors.
 	//
 	//  plugin_data {
@@ -61,6 +149,239 @@ type IIDAttestorPluginConfig struct {
 	//  }
 	//
 	CustomMetaData *CustomMetadata `hcl:"custom_metadata"`
+	// If MetadataChallenge is not nil, the plugin challenges the agent with a nonce
+	// delivered through the instance metadata before attesting it.
+	//
+	//  plugin_data {
+	//     metadata_challenge = {
+	//         // optional, defaults to "spire_attestation_nonce"
+	//         key = "spire_attestation_nonce"
+	//     }
+	//  }
+	//
+	MetadataChallenge *MetadataChallenge `hcl:"metadata_challenge"`
+	// If IdentityDocument is not nil, the plugin requires the agent to present a signed identity
+	// document served through the Nova DynamicJSON vendordata.
+	//
+	//  plugin_data {
+	//     identity_document = {
+	//         // optional, defaults to "spire"
+	//         vendordata_name = "spire"
+	//         audience = "spire-server"
+	//         public_keys = [<<EOF
+	//  -----BEGIN PUBLIC KEY-----
+	//  ...
+	//  -----END PUBLIC KEY-----
+	//  EOF
+	//         ]
+	//         // optional
+	//         max_age = "10m"
+	//     }
+	//  }
+	//
+	IdentityDocument *IdentityDocument `hcl:"identity_document"`
+	// If KeyPairChallenge is not nil, the plugin requires the agent to sign a nonce with the private key
+	// of the Nova keypair the instance was booted with.
+	//
+	//  plugin_data {
+	//     keypair_challenge = {}
+	//  }
+	//
+	KeyPairChallenge *KeyPairChallenge `hcl:"keypair_challenge"`
+	// If BootstrapToken is not nil, the plugin requires the agent to present the one-time token
+	// found in the instance metadata, and deletes the token after the attestation.
+	// The token is never made into a custom metadata Selector.
+	//
+	//  plugin_data {
+	//     bootstrap_token = {
+	//         // optional, defaults to "spire_bootstrap_token"
+	//         key = "spire_bootstrap_token"
+	//     }
+	//  }
+	//
+	BootstrapToken *BootstrapToken `hcl:"bootstrap_token"`
+	// InstanceState restricts the lifecycle state of instances. If InstanceState is nil, only ACTIVE
+	// instances are attested.
+	//
+	//  plugin_data {
+	//     instance_state = {
+	//         // optional, defaults to ["ACTIVE"]
+	//         allowed_statuses = ["ACTIVE"]
+	//         allowed_power_states = ["RUNNING"]
+	//         deny_task_in_progress = true
+	//         deny_rescued = true
+	//         deny_locked = true
+	//     }
+	//  }
+	//
+	InstanceState *InstanceState `hcl:"instance_state"`
+	// If ActionHistory is not nil, the plugin checks that disallowed actions, such as rebuild,
+	// didn't happen to the instance.
+	//
+	//  plugin_data {
+	//     action_history = {
+	//         // optional, defaults to ["rebuild", "rescue", "evacuate", "resize"]
+	//         disallowed_actions = ["rebuild", "rescue", "evacuate", "resize"]
+	//         // optional, defaults to the creation time of the instance
+	//         since = "2021-10-01T00:00:00Z"
+	//         // optional, "deny" or "flag", defaults to "deny"
+	//         mode = "deny"
+	//     }
+	//  }
+	//
+	ActionHistory *ActionHistory `hcl:"action_history"`
+	// If AttestationPolicy is not nil, the plugin admits only the instances which satisfy all of the rules.
+	// The rules are boolean expressions over the instance attributes, see the document for the syntax.
+	//
+	//  plugin_data {
+	//     attestation_policy {
+	//         rule "web" {
+	//             expression = "project in ['abc'] and metadata.role == 'web' and az != 'dmz'"
+	//         }
+	//     }
+	//  }
+	//
+	AttestationPolicy *AttestationPolicy `hcl:"attestation_policy"`
+	// MaxInstanceAge is the window since the instance creation in which an instance can be attested,
+	// so that an old instance can't be attested by anyone who learns its UUID. It also limits re-attestation.
+	//
+	//  plugin_data {
+	//     max_instance_age = "1h"
+	//     // optional, allowed difference between the clocks of Nova and the SPIRE Server
+	//     clock_skew = "1m"
+	//  }
+	//
+	MaxInstanceAge string `hcl:"max_instance_age"`
+	ClockSkew      string `hcl:"clock_skew"`
+	// If AllowReattestation is true, an instance attested before can be attested again with the same
+	// SPIFFE ID, after a metadata challenge or a keypair challenge succeeded. The image ID and the updated
+	// time of the instance must be the same as those recorded in ReattestationStatePath at the last attestation.
+	//
+	//  plugin_data {
+	//     allow_reattestation = true
+	//     reattestation_state_path = "/opt/spire/data/server/openstack_iid_attestations.json"
+	//     metadata_challenge = {}
+	//  }
+	//
+	AllowReattestation     bool   `hcl:"allow_reattestation"`
+	ReattestationStatePath string `hcl:"reattestation_state_path"`
+	// If AllowLegacyPayload is true, the plugin accepts the legacy attestation payload, which is the
+	// raw UUID sent by the older agent plugins, without the evidence to compare with Nova.
+	// Enable it only while rolling out the agent plugin.
+	//
+	//  plugin_data {
+	//     allow_legacy_payload = true
+	//  }
+	//
+	AllowLegacyPayload bool `hcl:"allow_legacy_payload"`
+	// APITimeout is the timeout of each OpenStack API call. Defaults to "30s".
+	// Calls are also cancelled when the attestation request is cancelled.
+	//
+	//  plugin_data {
+	//     api_timeout = "10s"
+	//  }
+	//
+	APITimeout string `hcl:"api_timeout"`
+	// APIRetry and CircuitBreaker make the OpenStack API calls resilient to transient failures.
+	// Both are enabled with the default values if omitted.
+	//
+	//  plugin_data {
+	//     api_retry = {
+	//         // optional, defaults to 3, 0 disables retries
+	//         max_retries = 3
+	//         // optional, defaults to "200ms"
+	//         base_delay = "200ms"
+	//         // optional, defaults to "5s"
+	//         max_delay = "5s"
+	//     }
+	//     circuit_breaker = {
+	//         // optional, defaults to 5, 0 disables the circuit breaker
+	//         failure_threshold = 5
+	//         // optional, defaults to "30s"
+	//         reset_timeout = "30s"
+	//     }
+	//  }
+	//
+	APIRetry       *APIRetry       `hcl:"api_retry"`
+	CircuitBreaker *CircuitBreaker `hcl:"circuit_breaker"`
+	// TLS configures TLS of the connections to every OpenStack API endpoint.
+	//
+	//  plugin_data {
+	//     tls = {
+	//         ca_file = "/etc/spire/server/openstack-ca.pem"
+	//         // optional, client certificate
+	//         cert_file = "/etc/spire/server/openstack-client.pem"
+	//         key_file = "/etc/spire/server/openstack-client-key.pem"
+	//         // optional
+	//         server_name = "openstack.example.com"
+	//         // optional, "1.0", "1.1", "1.2" or "1.3"
+	//         min_version = "1.2"
+	//     }
+	//  }
+	//
+	TLS *TLS `hcl:"tls"`
+	// Region, EndpointInterface and ComputeMicroversion select the compute API endpoint and the microversion.
+	// Region defaults to the region of the authentication. ComputeMicroversion defaults to the lowest one
+	// the configured features require, or none if they require none. If a microversion is given or required,
+	// the configuration fails if the compute API doesn't support it.
+	//
+	//  plugin_data {
+	//     region = "RegionOne"
+	//     // optional, "public", "internal" or "admin", defaults to "public"
+	//     endpoint_interface = "internal"
+	//     // optional
+	//     compute_microversion = "2.60"
+	//  }
+	//
+	Region              string `hcl:"region"`
+	EndpointInterface   string `hcl:"endpoint_interface"`
+	ComputeMicroversion string `hcl:"compute_microversion"`
+	// If FlavorSelector is true, the plugin makes the flavor Selector, which requires compute API microversion 2.47.
+	// If TagSelector is true, the plugin makes the server tag Selectors, which requires compute API microversion 2.26.
+	//
+	//  plugin_data {
+	//     flavor_selector = true
+	//     tag_selector = true
+	//  }
+	//
+	FlavorSelector bool `hcl:"flavor_selector"`
+	TagSelector    bool `hcl:"tag_selector"`
+	// AgentPathTemplate is the Go template of the agent SPIFFE ID path under "/spire/agent". It is executed with
+	// PluginName, CloudID, ProjectID, InstanceID and Region of the instance, which the users of the instance can't
+	// change. The path must start with "openstack_iid/", and different instances must get different paths.
+	// Defaults to "openstack_iid/<project ID>/<instance ID>", with the cloud ID before the project ID if the cloud
+	// blocks are given.
+	//
+	//  plugin_data {
+	//     agent_path_template = "{{ .PluginName }}/{{ .Region }}/{{ .ProjectID }}/{{ .InstanceID }}"
+	//  }
+	//
+	AgentPathTemplate string `hcl:"agent_path_template"`
+	// Projects override custom_metadata, instance_state, attestation_policy, max_instance_age,
+	// agent_path_template and the challenges for the instances of each project. The projects
+	// without a block use the global settings.
+	//
+	//  plugin_data {
+	//     project "abc" {
+	//         custom_metadata = {
+	//             keys = ["role"]
+	//         }
+	//         max_instance_age = "10m"
+	//         keypair_challenge = {}
+	//         // optional, the global challenges the project doesn't require
+	//         disabled_challenges = ["metadata_challenge"]
+	//     }
+	//  }
+	//
+	Projects []*ProjectOverride `hcl:"project"`
+
+	apiTimeout        time.Duration
+	clouds            map[string]*Cloud
+	agentPathTemplate *template.Template
+	projects          map[string]*IIDAttestorPluginConfig
+	maxInstanceAge    time.Duration
+	clockSkew         time.Duration
+	attestations      *attestationStore
 }
 
 type CustomMetadata struct {
@@ -73,6 +394,7 @@ func newPlugin() *IIDAttestorPlugin {
 	return &IIDAttestorPlugin{
 		mtx:                   &sync.RWMutex{},
 		getInstanceHandler:    getOpenStackInstance,
+		getIdentityHandler:    getOpenStackIdentity,
 		attestedBeforeHandler: attestedBefore,
 	}
 }
@@ -80,71 +402,165 @@ func newPlugin() *IIDAttestorPlugin {
 func (p *IIDAttestorPlugin) Attest(stream nodeattestorv1.NodeAttestor_AttestServer) error {
 	p.logger.Info("Received attestation request")
 
-	config, err := p.getConfig()
+	return apiCallError(p.attest(stream))
+}
+
+func (p *IIDAttestorPlugin) attest(stream nodeattestorv1.NodeAttestor_AttestServer) error {
+	config, instances, err := p.getConfig()
 	if err != nil {
 		return err
 	}
+	ctx := stream.Context()
 
-	p.mtx.RLock()
-	instance := p.instance
-	p.mtx.RUnlock()
-
-	if instance == nil {
-		instance, err = p.getInstanceHandler(config.CloudName, p.logger)
-		if err != nil {
-			return fmt.Errorf("failed to prepare OpenStack Client: %v", err)
-		}
-		p.mtx.Lock()
-		p.instance = instance
-		p.mtx.Unlock()
+	req, err := stream.Recv()
+	if err != nil {
+		return err
 	}
 
-	req, err := stream.Recv()
+	payload, err := parsePayload(req.GetPayload(), config, time.Now())
 	if err != nil {
 		return err
 	}
+	p.logger.Debug("Received attestation payload", "uuid", payload.UUID, "cloud", payload.Cloud, "version", payload.Version, "nonce", payload.Nonce)
 
-	iid := string(req.GetPayload())
-	s, err := instance.Get(iid)
+	cloud, err := selectCloud(config, payload.Cloud)
+	if err != nil {
+		return err
+	}
+	var projectID string
+	if payload.Evidence != nil {
+		projectID = payload.Evidence.ProjectID
+	}
+	key, err := cloud.instanceKey(projectID)
+	if err != nil {
+		return err
+	}
+	instance := withAPITimeout(instances[key], config.apiTimeout)
+
+	iid := payload.UUID
+	s, err := instance.Get(ctx, iid)
+	if key.project != "" && isNotFound(err) {
+		// The credential of the project can't see the instance, which is in another project, if any.
+		p.logger.Warn("Instance is not found in the project the agent states", "uuid", iid, "project_id", key.project)
+		return errors.New("invalid attestation request")
+	}
 	if err != nil {
-		return fmt.Errorf("failed to get instance information: %v", err)
+		return fmt.Errorf("failed to get instance information: %w", err)
 	}
 
 	p.logger.Debug("Got instance data successfully")
 
-	agentID := common.GenerateSpiffeID(config.trustDomain, s.TenantID, iid)
+	// Nova tells the project of the instance, whose settings apply from here.
+	config = config.forProject(s.TenantID)
 
-	attested, err := p.attestedBeforeHandler(stream.Context(), p, agentID)
-	switch {
-	case err != nil:
+	agentID, err := agentSpiffeID(config, cloud, instance, s)
+	if err != nil {
 		return err
+	}
+
+	attested, err := p.attestedBeforeHandler(ctx, p, agentID)
+	if err != nil {
+		return err
+	}
+	if config.maxInstanceAge > 0 {
+		if err := p.checkInstanceAge(s, config, time.Now()); err != nil {
+			return err
+		}
+	}
+	switch {
+	case attested && config.AllowReattestation:
+		if err := p.checkReattestation(s, cloud.ID, config.attestations); err != nil {
+			return err
+		}
 	case attested:
 		return fmt.Errorf("IID has already been used to attest an agent: %v", iid)
 	}
 
-	svs, err := p.makeSelectorValues(s)
+	if !cloud.allowsProject(s.TenantID) {
+		return errors.New("invalid attestation request")
+	}
+
+	if err := p.matchPayload(payload, s); err != nil {
+		return err
+	}
+
+	if config.InstanceState != nil {
+		if err := config.InstanceState.check(s); err != nil {
+			p.logger.Warn("Instance is not in an allowed state", "uuid", iid, "status", s.Status, "power_state", s.PowerState, "task_state", s.TaskState, "error", err)
+			return err
+		}
+	}
+
+	if config.AttestationPolicy != nil {
+		if err := config.AttestationPolicy.check(s, cloud.ID, config); err != nil {
+			p.logger.Warn("Instance doesn't satisfy the attestation policy", "uuid", iid, "error", err)
+			return err
+		}
+	}
+
+	svs, err := makeSelectorValues(s, cloud.ID, config)
 	if err != nil {
 		return err
 	}
 
-	for _, pid := range config.ProjectIDAllowList {
-		if s.TenantID == pid {
-			resp := &nodeattestorv1.AttestResponse{
-				Response: &nodeattestorv1.AttestResponse_AgentAttributes{
-					AgentAttributes: &nodeattestorv1.AgentAttributes{
-						SpiffeId:       agentID,
-						SelectorValues: svs,
-					},
-				},
-			}
-			return stream.Send(resp)
+	if config.ActionHistory != nil {
+		actionSelectors, err := p.checkActionHistory(ctx, instance, s, config.ActionHistory)
+		if err != nil {
+			return err
+		}
+		svs = append(svs, actionSelectors...)
+		sort.Strings(svs)
+	}
+
+	if config.BootstrapToken != nil {
+		if err := p.bootstrapTokenChallenge(stream, s, config.BootstrapToken); err != nil {
+			return err
+		}
+	}
+
+	if config.IdentityDocument != nil {
+		if err := p.identityDocumentChallenge(stream, s, config.IdentityDocument); err != nil {
+			return err
+		}
+	}
+
+	if config.KeyPairChallenge != nil {
+		if err := p.keyPairChallenge(stream, instance, s); err != nil {
+			return err
 		}
 	}
 
-	return errors.New("invalid attestation request")
+	if config.MetadataChallenge != nil {
+		if err := p.metadataChallenge(stream, instance, iid, config.MetadataChallenge); err != nil {
+			return err
+		}
+	}
+
+	if config.BootstrapToken != nil {
+		// Consume the token, so that it can't be replayed.
+		if err := instance.DeleteMetadata(ctx, iid, config.BootstrapToken.Key); err != nil {
+			return fmt.Errorf("failed to delete bootstrap token from instance metadata: %w", err)
+		}
+	}
+
+	if config.AllowReattestation {
+		if err := p.recordAttestation(ctx, instance, cloud.ID, iid, config.attestations); err != nil {
+			return err
+		}
+	}
+
+	resp := &nodeattestorv1.AttestResponse{
+		Response: &nodeattestorv1.AttestResponse_AgentAttributes{
+			AgentAttributes: &nodeattestorv1.AgentAttributes{
+				SpiffeId:       agentID,
+				SelectorValues: svs,
+			},
+		},
+	}
+	return stream.Send(resp)
 }
 
-func (p *IIDAttestorPlugin) Configure(_ context.Context, req *configv1.ConfigureRequest) (*configv1.ConfigureResponse, error) {
+func (p *IIDAttestorPlugin) Configure(ctx context.Context, req *configv1.ConfigureRequest) (*configv1.ConfigureResponse, error) {
 	if p.getInstanceHandler == nil {
 		return nil, errors.New("handler not found, plugin not initialized")
 	}
@@ -159,13 +575,125 @@ func (p *IIDAttestorPlugin) Configure(_ context.Context, req *configv1.Configure
 	if req.CoreConfiguration.TrustDomain == "" {
 		return nil, errors.New("trust_domain is required")
 	}
-	if len(config.ProjectIDAllowList) == 0 {
-		return nil, errors.New("projectid_allow_list is required")
+	if config.MetadataChallenge != nil && config.MetadataChallenge.Key == "" {
+		config.MetadataChallenge.Key = defaultMetadataChallengeKey
+	}
+	if config.BootstrapToken != nil && config.BootstrapToken.Key == "" {
+		config.BootstrapToken.Key = defaultBootstrapTokenKey
+	}
+
+	if config.IdentityDocument != nil {
+		if err := config.IdentityDocument.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.InstanceState == nil {
+		config.InstanceState = &InstanceState{}
+	}
+	if err := config.InstanceState.validate(); err != nil {
+		return nil, err
+	}
+
+	if config.ActionHistory != nil {
+		if err := config.ActionHistory.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.AttestationPolicy != nil {
+		if err := config.AttestationPolicy.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateProjectOverrides(config); err != nil {
+		return nil, err
+	}
+
+	config.apiTimeout = defaultAPITimeout
+	if config.APITimeout != "" {
+		d, err := time.ParseDuration(config.APITimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid api_timeout: %v", err)
+		}
+		if d <= 0 {
+			return nil, errors.New("api_timeout must be positive")
+		}
+		config.apiTimeout = d
+	}
+
+	providerOpts, err := providerOptions(config.APIRetry, config.CircuitBreaker)
+	if err != nil {
+		return nil, err
+	}
+	clouds, err := configureClouds(config, providerOpts)
+	if err != nil {
+		return nil, err
+	}
+	config.clouds = clouds
+
+	if config.AgentPathTemplate != "" {
+		tmpl, err := parseAgentPathTemplate(config.AgentPathTemplate, len(config.Clouds) > 0)
+		if err != nil {
+			return nil, err
+		}
+		config.agentPathTemplate = tmpl
+	}
+
+	if config.MaxInstanceAge != "" {
+		d, err := time.ParseDuration(config.MaxInstanceAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_instance_age: %v", err)
+		}
+		if d < 0 {
+			return nil, errors.New("max_instance_age must not be negative")
+		}
+		config.maxInstanceAge = d
+	}
+	if config.ClockSkew != "" {
+		d, err := time.ParseDuration(config.ClockSkew)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clock_skew: %v", err)
+		}
+		if d < 0 {
+			return nil, errors.New("clock_skew must not be negative")
+		}
+		config.clockSkew = d
+	}
+
+	if config.AllowReattestation {
+		if config.MetadataChallenge == nil && config.KeyPairChallenge == nil {
+			return nil, errors.New("allow_reattestation requires metadata_challenge or keypair_challenge")
+		}
+		if config.ReattestationStatePath == "" {
+			return nil, errors.New("reattestation_state_path is required to allow re-attestation")
+		}
+		config.attestations = newAttestationStore(config.ReattestationStatePath)
 	}
 
 	config.trustDomain = req.CoreConfiguration.TrustDomain
 
-	p.setConfig(config)
+	config.projects = make(map[string]*IIDAttestorPluginConfig)
+	for _, o := range config.Projects {
+		pc, err := o.apply(config)
+		if err != nil {
+			return nil, err
+		}
+		config.projects[o.ProjectID] = pc
+	}
+
+	// Build the clients for the new configuration, which also authenticate to Keystone,
+	// and check the compute API microversion, so that a misconfiguration fails here instead of at the first attestation.
+	instances, err := p.newInstances(ctx, clouds, config.apiTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.resolveProjectRules(ctx, clouds, config.apiTimeout); err != nil {
+		return nil, err
+	}
+
+	p.setConfig(config, instances)
 
 	return &configv1.ConfigureResponse{}, nil
 }
@@ -175,17 +703,132 @@ func attestedBefore(ctx context.Context, p *IIDAttestorPlugin, agentID string) (
 	return p.IsAttested(ctx, agentID)
 }
 
-// getOpenStackInstance returns authenticated openstack compute client.
-func getOpenStackInstance(cloud string, logger hclog.Logger) (openstack.InstanceClient, error) {
-	provider, err := openstack.NewProvider(cloud)
+// checkInstanceAge returns an error if the instance was created longer ago than max_instance_age.
+func (p *IIDAttestorPlugin) checkInstanceAge(s *openstack.Server, config *IIDAttestorPluginConfig, now time.Time) error {
+	age := now.Sub(s.Created)
+	if age <= config.maxInstanceAge+config.clockSkew {
+		return nil
+	}
+
+	p.logger.Warn("Instance is older than max_instance_age", "uuid", s.ID, "created", s.Created, "age", age.Round(time.Second), "max_instance_age", config.maxInstanceAge)
+	return fmt.Errorf("instance was created %v ago, which exceeds max_instance_age", age.Round(time.Second))
+}
+
+// isProjectAllowed returns true if given projectID is in the allow list
+func isProjectAllowed(allowList []string, projectID string) bool {
+	for _, pid := range allowList {
+		if projectID == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// newInstances builds the clients of the clouds, one for each project credential if the cloud has them.
+// The API calls at the build time out after given timeout.
+func (p *IIDAttestorPlugin) newInstances(ctx context.Context, clouds map[string]*Cloud, timeout time.Duration) (map[instanceKey]openstack.InstanceClient, error) {
+	instances := make(map[instanceKey]openstack.InstanceClient)
+	for id, cloud := range clouds {
+		auths := map[string]openstack.AuthOptions{"": cloud.authOptions}
+		if len(cloud.ProjectCredentials) > 0 {
+			auths = make(map[string]openstack.AuthOptions, len(cloud.ProjectCredentials))
+			for _, pc := range cloud.ProjectCredentials {
+				auths[pc.ProjectID] = pc.authOptions
+			}
+		}
+
+		for project, auth := range auths {
+			callCtx, cancel := context.WithTimeout(ctx, timeout)
+			instance, err := p.getInstanceHandler(callCtx, cloud, auth, p.logger)
+			cancel()
+			if err != nil {
+				msg := "failed to prepare OpenStack Client"
+				if id != "" {
+					msg += fmt.Sprintf(" for cloud %q", id)
+				}
+				if project != "" {
+					msg += fmt.Sprintf(" for project %q", project)
+				}
+				return nil, fmt.Errorf("%s: %v", msg, err)
+			}
+			instances[instanceKey{cloud: id, project: project}] = instance
+		}
+	}
+	return instances, nil
+}
+
+// resolveProjectRules lists the projects of the clouds which have project_rules, so that the rules which can't
+// be resolved fail the configuration instead of the attestations. Once all of them are resolved, they are
+// refreshed in the background until the configuration is replaced.
+func (p *IIDAttestorPlugin) resolveProjectRules(ctx context.Context, clouds map[string]*Cloud, timeout time.Duration) error {
+	identities := make(map[string]openstack.IdentityClient)
+	for id, cloud := range clouds {
+		if cloud.ProjectRules == nil {
+			continue
+		}
+		if p.getIdentityHandler == nil {
+			return errors.New("handler not found, plugin not initialized")
+		}
+		callCtx, cancel := context.WithTimeout(ctx, timeout)
+		identity, err := p.getIdentityHandler(callCtx, cloud, cloud.authOptions, p.logger)
+		if err == nil {
+			err = cloud.ProjectRules.refreshProjects(callCtx, identity, p.logger.With("cloud", id))
+		}
+		cancel()
+		if err != nil {
+			msg := "failed to resolve project_rules"
+			if id != "" {
+				msg += fmt.Sprintf(" for cloud %q", id)
+			}
+			return fmt.Errorf("%s: %v", msg, err)
+		}
+		identities[id] = identity
+	}
+	for id, identity := range identities {
+		clouds[id].ProjectRules.start(identity, timeout, p.logger.With("cloud", id))
+	}
+	return nil
+}
+
+// getOpenStackInstance returns authenticated openstack compute client of the cloud, which authenticates with given options.
+func getOpenStackInstance(ctx context.Context, cloud *Cloud, auth openstack.AuthOptions, logger hclog.Logger) (openstack.InstanceClient, error) {
+	computeOpts := cloud.computeOptions
+	if computeOpts.Region == "" {
+		region, err := auth.Region()
+		if err != nil {
+			return nil, err
+		}
+		computeOpts.Region = region
+	}
+	provider, err := openstack.NewProvider(auth, cloud.providerOptions)
+	if err != nil {
+		return nil, err
+	}
+	return openstack.NewInstance(ctx, provider, computeOpts, logger)
+}
+
+// getOpenStackIdentity returns authenticated openstack identity client of the cloud, which authenticates with given options.
+func getOpenStackIdentity(_ context.Context, cloud *Cloud, auth openstack.AuthOptions, logger hclog.Logger) (openstack.IdentityClient, error) {
+	identityOpts := openstack.IdentityOptions{
+		Region:    cloud.computeOptions.Region,
+		Interface: cloud.computeOptions.Interface,
+	}
+	if identityOpts.Region == "" {
+		region, err := auth.Region()
+		if err != nil {
+			return nil, err
+		}
+		identityOpts.Region = region
+	}
+	provider, err := openstack.NewProvider(auth, cloud.providerOptions)
 	if err != nil {
 		return nil, err
 	}
-	return openstack.NewInstance(provider, logger)
+	return openstack.NewIdentity(provider, identityOpts, logger)
 }
 
 // makeSelectorValues returns Selector sets related to instance
-func (p *IIDAttestorPlugin) makeSelectorValues(server *servers.Server) ([]string, error) {
+func makeSelectorValues(server *openstack.Server, cloudID string, config *IIDAttestorPluginConfig) ([]string, error) {
 	sgSelector, err := genSGSelectorValues(server.SecurityGroups)
 	if err != nil {
 		return nil, err
@@ -193,11 +836,29 @@ func (p *IIDAttestorPlugin) makeSelectorValues(server *servers.Server) ([]string
 	var svs []string
 	svs = append(svs, sgSelector...)
 
-	if p.config.CustomMetaData != nil {
-		metaSelector := genCustomMetaSelectorValues(server.Metadata, p.config.CustomMetaData.Keys)
+	if config.CustomMetaData != nil {
+		meta := server.Metadata
+		if config.BootstrapToken != nil {
+			meta = withoutKey(meta, config.BootstrapToken.Key)
+		}
+		metaSelector := genCustomMetaSelectorValues(meta, config.CustomMetaData.Keys)
 		svs = append(svs, metaSelector...)
 	}
 
+	if cloudID != "" {
+		svs = append(svs, fmt.Sprintf("cloud:%s", cloudID))
+	}
+	if config.FlavorSelector {
+		if name := server.FlavorName(); name != "" {
+			svs = append(svs, fmt.Sprintf("flavor:name:%s", name))
+		}
+	}
+	if config.TagSelector && server.Tags != nil {
+		for _, tag := range *server.Tags {
+			svs = append(svs, fmt.Sprintf("tag:%s", tag))
+		}
+	}
+
 	sort.Strings(svs)
 
 	return svs, nil
@@ -248,24 +909,46 @@ func genCustomMetaSelectorValues(meta map[string]string, acceptKeys []string) []
 	return sList
 }
 
+// withoutKey returns a copy of the metadata without given key.
+func withoutKey(meta map[string]string, key string) map[string]string {
+	m := make(map[string]string, len(meta))
+	for k, v := range meta {
+		if k != key {
+			m[k] = v
+		}
+	}
+	return m
+}
+
 func (p *IIDAttestorPlugin) SetLogger(log hclog.Logger) {
 	p.logger = log
 }
 
-func (p *IIDAttestorPlugin) setConfig(config *IIDAttestorPluginConfig) {
+// setConfig swaps the configuration and the clients built for it at once, and stops the background refresh of the previous configuration.
+func (p *IIDAttestorPlugin) setConfig(config *IIDAttestorPluginConfig, instances map[instanceKey]openstack.InstanceClient) {
 	p.mtx.Lock()
-	defer p.mtx.Unlock()
+	old := p.config
 	p.config = config
+	p.instances = instances
+	p.mtx.Unlock()
+
+	if old != nil {
+		for _, cloud := range old.clouds {
+			if cloud.ProjectRules != nil {
+				cloud.ProjectRules.Close()
+			}
+		}
+	}
 }
 
-func (p *IIDAttestorPlugin) getConfig() (*IIDAttestorPluginConfig, error) {
+func (p *IIDAttestorPlugin) getConfig() (*IIDAttestorPluginConfig, map[instanceKey]openstack.InstanceClient, error) {
 	p.mtx.RLock()
 	defer p.mtx.RUnlock()
 
-	if p.config == nil {
-		return nil, errors.New("plugin not configured")
+	if p.config == nil || len(p.instances) == 0 {
+		return nil, nil, errors.New("plugin not configured")
 	}
-	return p.config, nil
+	return p.config, p.instances, nil
 }
 
 func main() {
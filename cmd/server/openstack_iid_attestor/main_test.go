@@ -9,12 +9,19 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"golang.org/x/crypto/ssh"
 
 	"github.com/hashicorp/go-hclog"
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
 	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
 
 	configv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/service/common/config/v1"
@@ -31,6 +38,13 @@ const (
 )
 
 var (
+	// testPayload matches the instance returned by fake_openstack.NewInstance(testProjectID, ...)
+	testPayload = newTestPayload(testUUID, &common.Evidence{
+		Name:             "bravo",
+		AvailabilityZone: "nova",
+		ProjectID:        testProjectID,
+	}, time.Now())
+
 	globalConfig = &configv1.CoreConfiguration{
 		TrustDomain: "example.com",
 	}
@@ -44,6 +58,20 @@ var (
 	`
 )
 
+func newTestPayload(uuid string, evidence *common.Evidence, timestamp time.Time) string {
+	b, err := json.Marshal(&common.AttestationPayload{
+		Version:   common.PayloadVersion,
+		UUID:      uuid,
+		Evidence:  evidence,
+		Nonce:     "nonce",
+		Timestamp: timestamp,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
 func newTestPlugin() *IIDAttestorPlugin {
 	return &IIDAttestorPlugin{
 		config: &IIDAttestorPluginConfig{
@@ -54,6 +82,26 @@ func newTestPlugin() *IIDAttestorPlugin {
 	}
 }
 
+// setTestInstance configures the plugin to attest the instances of the single cloud, whose client is given.
+func setTestInstance(p *IIDAttestorPlugin, instance openstack.InstanceClient, projectIDs ...string) {
+	p.config.clouds = map[string]*Cloud{
+		"": {ProjectIDAllowList: projectIDs},
+	}
+	p.instances = map[instanceKey]openstack.InstanceClient{{}: instance}
+}
+
+// newAttestTestPlugin returns the plugin which attests the instances of the test project with given client,
+// as if they have never been attested. configure, if not nil, sets the challenges and the other settings to test.
+func newAttestTestPlugin(instance openstack.InstanceClient, configure func(*IIDAttestorPluginConfig)) *IIDAttestorPlugin {
+	p := newTestPlugin()
+	setTestInstance(p, instance, testProjectID)
+	if configure != nil {
+		configure(p.config)
+	}
+	p.attestedBeforeHandler = notAttestedBeforeHandler
+	return p
+}
+
 func notAttestedBeforeHandler(_ context.Context, _ *IIDAttestorPlugin, _ string) (bool, error) {
 	return false, nil
 }
@@ -64,7 +112,7 @@ func onceAttestedBeforeHandler(_ context.Context, _ *IIDAttestorPlugin, _ string
 
 func TestConfigure(t *testing.T) {
 	p := newTestPlugin()
-	p.getInstanceHandler = func(n string, logger hclog.Logger) (openstack.InstanceClient, error) {
+	p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, logger hclog.Logger) (openstack.InstanceClient, error) {
 		return fake_openstack.NewInstance(testProjectID, nil, nil), nil
 	}
 	p.attestedBeforeHandler = notAttestedBeforeHandler
@@ -80,7 +128,7 @@ func TestConfigure(t *testing.T) {
 
 func TestConfigureError(t *testing.T) {
 	p := newTestPlugin()
-	p.getInstanceHandler = func(n string, logger hclog.Logger) (openstack.InstanceClient, error) {
+	p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, logger hclog.Logger) (openstack.InstanceClient, error) {
 		return fake_openstack.NewInstance(testProjectID, nil, nil), nil
 	}
 	p.attestedBeforeHandler = notAttestedBeforeHandler
@@ -96,7 +144,7 @@ func TestConfigureError(t *testing.T) {
 
 func TestConfigureEmptyProjectID(t *testing.T) {
 	p := newTestPlugin()
-	p.getInstanceHandler = func(n string, logger hclog.Logger) (openstack.InstanceClient, error) {
+	p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, logger hclog.Logger) (openstack.InstanceClient, error) {
 		return fake_openstack.NewInstance(testProjectID, nil, nil), nil
 	}
 	p.attestedBeforeHandler = notAttestedBeforeHandler
@@ -117,18 +165,148 @@ func TestConfigureEmptyProjectID(t *testing.T) {
 	}
 }
 
-func TestAttest(t *testing.T) {
+func TestConfigureClientError(t *testing.T) {
 	p := newTestPlugin()
-	p.getInstanceHandler = func(n string, logger hclog.Logger) (openstack.InstanceClient, error) {
-		return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+	p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, logger hclog.Logger) (openstack.InstanceClient, error) {
+		return nil, errors.New("authentication failed")
+	}
+
+	req := fake_common.NewConfigureRequest(globalConfig, pluginConfig)
+
+	wantError := "failed to prepare OpenStack Client: authentication failed"
+	if _, err := p.Configure(context.Background(), req); err == nil {
+		t.Error("expected error, got nil")
+	} else if err.Error() != wantError {
+		t.Errorf("got %v, want %v", err, wantError)
+	}
+}
+
+func TestConfigureRebuildsClient(t *testing.T) {
+	clients := map[string]openstack.InstanceClient{
+		"alpha": fake_openstack.NewInstance(testProjectID, nil, nil),
+		"bravo": fake_openstack.NewInstance(testProjectID, nil, nil),
+	}
+
+	p := newTestPlugin()
+	p.config = nil
+	p.getInstanceHandler = func(_ context.Context, cloud *Cloud, _ openstack.AuthOptions, logger hclog.Logger) (openstack.InstanceClient, error) {
+		if cloud.CloudName == "charlie" {
+			return nil, errors.New("authentication failed")
+		}
+		return clients[cloud.CloudName], nil
+	}
+
+	for i, tc := range []struct {
+		cloudName string
+		wantErr   bool
+		want      string
+	}{
+		// 0: initial configuration
+		{cloudName: "alpha", want: "alpha"},
+		// 1: changed cloud
+		{cloudName: "bravo", want: "bravo"},
+		// 2: failed configuration keeps the current client
+		{cloudName: "charlie", wantErr: true, want: "bravo"},
+	} {
+		conf := fmt.Sprintf(`
+		cloud_name = "%s"
+		projectid_allow_list = ["%s"]
+		`, tc.cloudName, testProjectID)
+		_, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, conf))
+		if tc.wantErr != (err != nil) {
+			t.Errorf("#%v: unexpected error from Configure(): %v", i, err)
+		}
+
+		config, instances, err := p.getConfig()
+		if err != nil {
+			t.Fatalf("#%v: unexpected error from getConfig(): %v", i, err)
+		}
+		if config.CloudName != tc.want || instances[instanceKey{}] != clients[tc.want] {
+			t.Errorf("#%v: got cloud %q, want %q", i, config.CloudName, tc.want)
+		}
 	}
-	p.config.ProjectIDAllowList = []string{testProjectID}
+}
+
+func TestAttestNotConfigured(t *testing.T) {
+	p := newTestPlugin()
 	p.attestedBeforeHandler = notAttestedBeforeHandler
 
-	fs := fake_server.NewAttestStream(testUUID)
+	wantError := "plugin not configured"
+	if err := p.Attest(fake_server.NewAttestStream(testPayload)); err == nil {
+		t.Error("expected error, got nil")
+	} else if err.Error() != wantError {
+		t.Errorf("got %v, want %v", err, wantError)
+	}
+}
 
-	if err := p.Attest(fs); err != nil {
-		t.Errorf("Attestation error: %v", err)
+func TestAttest(t *testing.T) {
+	idKey, idPubPEM := newIdentityDocumentKey(t)
+	sshSigner := newSSHSigner(t)
+	keyPairInstance := fake_openstack.NewInstance(testProjectID, nil, nil)
+	keyPairInstance.KeyName = testKeyName
+	keyPairInstance.KeyPairs = map[string]string{testKeyName: string(ssh.MarshalAuthorizedKey(sshSigner.PublicKey()))}
+	bootstrapTokenInstance := fake_openstack.NewInstance(testProjectID, map[string]string{
+		"role":                   "web",
+		defaultBootstrapTokenKey: "secret-token",
+	}, nil)
+
+	for i, tc := range []struct {
+		instance         *fake_openstack.Instance
+		configure        func(*IIDAttestorPluginConfig)
+		challengeHandler func([]byte) ([]byte, error)
+		wantSVs          []string
+		// wantDeleted is the metadata key which must be deleted from the instance after the attestation.
+		wantDeleted string
+	}{
+		// 0: no challenge
+		{
+			instance: fake_openstack.NewInstance(testProjectID, nil, nil),
+		},
+		// 1: identity document
+		{
+			instance:         fake_openstack.NewInstance(testProjectID, nil, nil),
+			configure:        identityDocumentConfig(t, idPubPEM),
+			challengeHandler: identityDocumentChallengeHandler(t, idKey, testProjectID),
+		},
+		// 2: keypair challenge
+		{
+			instance: keyPairInstance,
+			configure: func(c *IIDAttestorPluginConfig) {
+				c.KeyPairChallenge = &KeyPairChallenge{}
+			},
+			challengeHandler: keyPairChallengeHandler(t, sshSigner),
+		},
+		// 3: bootstrap token, which is consumed and not leaked through the selectors
+		{
+			instance:         bootstrapTokenInstance,
+			configure:        bootstrapTokenConfig,
+			challengeHandler: metadataChallengeHandler(bootstrapTokenInstance),
+			wantSVs:          []string{"meta:role:web"},
+			wantDeleted:      defaultBootstrapTokenKey,
+		},
+	} {
+		p := newAttestTestPlugin(tc.instance, tc.configure)
+
+		fs := fake_server.NewAttestStream(testPayload)
+		fs.ChallengeHandler = tc.challengeHandler
+
+		if err := p.Attest(fs); err != nil {
+			t.Errorf("#%v: Attestation error: %v", i, err)
+			continue
+		}
+		if fs.AgentAttributes() == nil {
+			t.Errorf("#%v: expected agent attributes, got nil", i)
+			continue
+		}
+		if got := fs.AgentAttributes().SelectorValues; tc.wantSVs != nil && !reflect.DeepEqual(got, tc.wantSVs) {
+			t.Errorf("#%v: got selectors %v, want %v", i, got, tc.wantSVs)
+		}
+		if tc.wantDeleted != "" {
+			s, _ := tc.instance.Get(context.Background(), testUUID)
+			if _, ok := s.Metadata[tc.wantDeleted]; ok {
+				t.Errorf("#%v: %s was not deleted from the instance metadata", i, tc.wantDeleted)
+			}
+		}
 	}
 }
 
@@ -214,13 +392,13 @@ func TestMakeSelectorValues(t *testing.T) {
 
 		p := newTestPlugin()
 		p.logger = testutil.TestLogger()
-		p.instance = fi
+		setTestInstance(p, fi)
 		p.config.CustomMetaData = &CustomMetadata{
 			Keys: tc.keys,
 		}
 
-		server, _ := p.instance.Get(testUUID)
-		resp, err := p.makeSelectorValues(server)
+		server, _ := fi.Get(context.Background(), testUUID)
+		resp, err := makeSelectorValues(server, "", p.config)
 		if err != nil {
 			t.Errorf("#%v: Error from makeSelectors(): %v", i, err)
 		}
@@ -231,16 +409,93 @@ func TestMakeSelectorValues(t *testing.T) {
 	}
 }
 
+func TestMakeFlavorAndTagSelectorValues(t *testing.T) {
+	for i, tc := range []struct {
+		flavorSelector bool
+		tagSelector    bool
+		flavorName     string
+		tags           []string
+		want           []string
+	}{
+		// 0: flavor and tags
+		{
+			flavorSelector: true,
+			tagSelector:    true,
+			flavorName:     "m1.small",
+			tags:           []string{"web", "prod"},
+			want:           []string{"flavor:name:m1.small", "tag:prod", "tag:web"},
+		},
+		// 1: disabled
+		{
+			flavorName: "m1.small",
+			tags:       []string{"web"},
+		},
+		// 2: no flavor details and no tags
+		{
+			flavorSelector: true,
+			tagSelector:    true,
+		},
+	} {
+		fi := fake_openstack.NewInstance(testProjectID, nil, nil)
+		fi.FlavorName = tc.flavorName
+		fi.Tags = tc.tags
+
+		config := &IIDAttestorPluginConfig{
+			FlavorSelector: tc.flavorSelector,
+			TagSelector:    tc.tagSelector,
+		}
+		server, _ := fi.Get(context.Background(), testUUID)
+		got, err := makeSelectorValues(server, "", config)
+		if err != nil {
+			t.Errorf("#%v: Error from makeSelectorValues(): %v", i, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("#%v: got %v, want %v", i, got, tc.want)
+		}
+	}
+}
+
+func TestConfigureComputeOptions(t *testing.T) {
+	p := newTestPlugin()
+	var got openstack.ComputeOptions
+	p.getInstanceHandler = func(_ context.Context, cloud *Cloud, _ openstack.AuthOptions, logger hclog.Logger) (openstack.InstanceClient, error) {
+		got = cloud.computeOptions
+		return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+	}
+
+	conf := `
+	cloud_name = "test"
+	projectid_allow_list = ["alpha"]
+	region = "RegionTwo"
+	endpoint_interface = "internal"
+	compute_microversion = "2.60"
+	flavor_selector = true
+	tag_selector = true
+	`
+	if _, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, conf)); err != nil {
+		t.Fatalf("unexpected error from Configure(): %v", err)
+	}
+
+	want := openstack.ComputeOptions{
+		Region:         "RegionTwo",
+		Interface:      "internal",
+		Microversion:   "2.60",
+		ServerTags:     true,
+		EmbeddedFlavor: true,
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
 func TestAttestInvalidUUID(t *testing.T) {
 	errMsg := "invalid uuid"
 
 	p := newTestPlugin()
-	p.getInstanceHandler = func(n string, logger hclog.Logger) (openstack.InstanceClient, error) {
-		return fake_openstack.NewErrorInstance(errMsg), nil
-	}
+	setTestInstance(p, fake_openstack.NewErrorInstance(errMsg))
 	p.attestedBeforeHandler = notAttestedBeforeHandler
 
-	fs := fake_server.NewAttestStream(testUUID)
+	fs := fake_server.NewAttestStream(testPayload)
 
 	if err := p.Attest(fs); err == nil {
 		t.Errorf("an error expected, got nil")
@@ -251,13 +506,10 @@ func TestAttestInvalidUUID(t *testing.T) {
 
 func TestAttestInvalidProjectID(t *testing.T) {
 	p := newTestPlugin()
-	p.getInstanceHandler = func(n string, logger hclog.Logger) (openstack.InstanceClient, error) {
-		return fake_openstack.NewInstance("invalid-project-id", nil, nil), nil
-	}
-	p.config.ProjectIDAllowList = []string{testProjectID}
+	setTestInstance(p, fake_openstack.NewInstance("invalid-project-id", nil, nil), testProjectID)
 	p.attestedBeforeHandler = notAttestedBeforeHandler
 
-	fs := fake_server.NewAttestStream(testUUID)
+	fs := fake_server.NewAttestStream(testPayload)
 
 	if err := p.Attest(fs); err == nil {
 		t.Errorf("an error expected, got nil")
@@ -268,14 +520,11 @@ func TestAttestInvalidProjectID(t *testing.T) {
 
 func TestAttestBefore(t *testing.T) {
 	p := newTestPlugin()
-	p.getInstanceHandler = func(n string, logger hclog.Logger) (openstack.InstanceClient, error) {
-		return fake_openstack.NewInstance(testProjectID, nil, nil), nil
-	}
-	p.config.ProjectIDAllowList = []string{testProjectID}
+	setTestInstance(p, fake_openstack.NewInstance(testProjectID, nil, nil), testProjectID)
 
 	p.attestedBeforeHandler = onceAttestedBeforeHandler
 
-	fs := fake_server.NewAttestStream(testUUID)
+	fs := fake_server.NewAttestStream(testPayload)
 
 	if err := p.Attest(fs); err == nil {
 		t.Errorf("an error expected, got nil")
@@ -283,3 +532,231 @@ func TestAttestBefore(t *testing.T) {
 		t.Errorf("unexpected error messsage: %v", err)
 	}
 }
+
+func TestAttestMaxInstanceAge(t *testing.T) {
+	for i, tc := range []struct {
+		age      time.Duration
+		attested bool
+		wantErr  string
+	}{
+		// 0: new instance attested before
+		{
+			age:      30 * time.Minute,
+			attested: true,
+			wantErr:  fmt.Sprintf("IID has already been used to attest an agent: %v", testUUID),
+		},
+		// 1: old instance attested before
+		{
+			age:      2 * time.Hour,
+			attested: true,
+			wantErr:  "instance was created 2h0m0s ago, which exceeds max_instance_age",
+		},
+		// 2: old instance never attested
+		{
+			age:      2 * time.Hour,
+			attested: false,
+			wantErr:  "instance was created 2h0m0s ago, which exceeds max_instance_age",
+		},
+		// 3: new instance never attested
+		{
+			age:      30 * time.Minute,
+			attested: false,
+		},
+	} {
+		fi := fake_openstack.NewInstance(testProjectID, nil, nil)
+		fi.Created = time.Now().Add(-tc.age)
+
+		p := newTestPlugin()
+		setTestInstance(p, fi, testProjectID)
+		p.config.maxInstanceAge = time.Hour
+		p.attestedBeforeHandler = notAttestedBeforeHandler
+		if tc.attested {
+			p.attestedBeforeHandler = onceAttestedBeforeHandler
+		}
+
+		fs := fake_server.NewAttestStream(testPayload)
+
+		err := p.Attest(fs)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("#%v: unexpected error from Attest(): %v", i, err)
+		case tc.wantErr != "" && err == nil:
+			t.Errorf("#%v: expected an error, got nil", i)
+		case tc.wantErr != "" && err.Error() != tc.wantErr:
+			t.Errorf("#%v: got %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
+
+func TestConfigureInstanceAgeError(t *testing.T) {
+	for i, tc := range []struct {
+		conf    string
+		wantErr string
+	}{
+		// 0: invalid max_instance_age
+		{
+			conf:    `max_instance_age = "an hour"`,
+			wantErr: `invalid max_instance_age: time: invalid duration "an hour"`,
+		},
+		// 1: negative max_instance_age
+		{
+			conf:    `max_instance_age = "-1h"`,
+			wantErr: "max_instance_age must not be negative",
+		},
+		// 2: negative clock_skew
+		{
+			conf:    `clock_skew = "-1m"`,
+			wantErr: "clock_skew must not be negative",
+		},
+	} {
+		p := newTestPlugin()
+		p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, _ hclog.Logger) (openstack.InstanceClient, error) {
+			return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+		}
+
+		conf := `
+		cloud_name = "test"
+		projectid_allow_list = ["abc"]
+		` + tc.conf
+		_, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, conf))
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
+
+func TestCheckInstanceAge(t *testing.T) {
+	now := time.Now()
+	config := &IIDAttestorPluginConfig{
+		maxInstanceAge: time.Hour,
+		clockSkew:      time.Minute,
+	}
+
+	for i, tc := range []struct {
+		created time.Time
+		wantErr bool
+	}{
+		// 0: within the window
+		{created: now.Add(-30 * time.Minute)},
+		// 1: within the clock skew allowance
+		{created: now.Add(-time.Hour - 30*time.Second)},
+		// 2: too old
+		{created: now.Add(-time.Hour - 2*time.Minute), wantErr: true},
+	} {
+		p := newTestPlugin()
+		err := p.checkInstanceAge(&openstack.Server{Server: servers.Server{ID: testUUID, Created: tc.created}}, config, now)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("#%v: got error %v, want error %v", i, err, tc.wantErr)
+		}
+	}
+}
+
+// metadataChallengeHandler answers the metadata challenge by reading the instance metadata, as the agent does.
+func metadataChallengeHandler(instance openstack.InstanceClient) func([]byte) ([]byte, error) {
+	return func(b []byte) ([]byte, error) {
+		challenge := &common.Challenge{}
+		if err := json.Unmarshal(b, challenge); err != nil {
+			return nil, err
+		}
+		s, err := instance.Get(context.Background(), testUUID)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(&common.ChallengeResponse{
+			Type:  challenge.Type,
+			Nonce: s.Metadata[challenge.MetadataKey],
+		})
+	}
+}
+
+func TestAttestMetadataChallenge(t *testing.T) {
+	fi := fake_openstack.NewInstance(testProjectID, nil, nil)
+
+	p := newTestPlugin()
+	setTestInstance(p, fi, testProjectID)
+	p.config.MetadataChallenge = &MetadataChallenge{Key: defaultMetadataChallengeKey}
+	p.attestedBeforeHandler = notAttestedBeforeHandler
+
+	fs := fake_server.NewAttestStream(testPayload)
+	fs.ChallengeHandler = metadataChallengeHandler(fi)
+
+	if err := p.Attest(fs); err != nil {
+		t.Fatalf("Attestation error: %v", err)
+	}
+	if fs.AgentAttributes() == nil {
+		t.Error("expected agent attributes, got nil")
+	}
+
+	s, _ := fi.Get(context.Background(), testUUID)
+	if _, ok := s.Metadata[defaultMetadataChallengeKey]; ok {
+		t.Error("challenge nonce was not deleted from the instance metadata")
+	}
+}
+
+// contextInstance fails the metadata deletions with a done context, as the OpenStack client does.
+type contextInstance struct {
+	*fake_openstack.Instance
+}
+
+func (i *contextInstance) DeleteMetadata(ctx context.Context, uuid, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return i.Instance.DeleteMetadata(ctx, uuid, key)
+}
+
+func TestAttestMetadataChallengeCancelled(t *testing.T) {
+	fi := fake_openstack.NewInstance(testProjectID, nil, nil)
+	p := newAttestTestPlugin(&contextInstance{Instance: fi}, func(c *IIDAttestorPluginConfig) {
+		c.MetadataChallenge = &MetadataChallenge{Key: defaultMetadataChallengeKey}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fs := fake_server.NewAttestStream(testPayload)
+	fs.Ctx = ctx
+	fs.ChallengeHandler = func(b []byte) ([]byte, error) {
+		// The agent disconnects while the challenge is pending.
+		cancel()
+		return nil, context.Canceled
+	}
+
+	if err := p.Attest(fs); err == nil {
+		t.Error("an error expected, got nil")
+	}
+	s, _ := fi.Get(context.Background(), testUUID)
+	if _, ok := s.Metadata[defaultMetadataChallengeKey]; ok {
+		t.Error("challenge nonce was not deleted from the instance metadata")
+	}
+}
+
+func TestAttestMetadataChallengeMismatch(t *testing.T) {
+	fi := fake_openstack.NewInstance(testProjectID, nil, nil)
+
+	p := newTestPlugin()
+	setTestInstance(p, fi, testProjectID)
+	p.config.MetadataChallenge = &MetadataChallenge{Key: defaultMetadataChallengeKey}
+	p.attestedBeforeHandler = notAttestedBeforeHandler
+
+	fs := fake_server.NewAttestStream(testPayload)
+	fs.ChallengeHandler = func(b []byte) ([]byte, error) {
+		return json.Marshal(&common.ChallengeResponse{
+			Type:  common.ChallengeTypeMetadataNonce,
+			Nonce: "guessed",
+		})
+	}
+
+	if err := p.Attest(fs); err == nil {
+		t.Errorf("an error expected, got nil")
+	} else if err.Error() != "metadata challenge failed: nonce mismatch" {
+		t.Errorf("unexpected error messsage: %v", err)
+	}
+	if fs.AgentAttributes() != nil {
+		t.Error("agent attributes should not be sent")
+	}
+
+	s, _ := fi.Get(context.Background(), testUUID)
+	if _, ok := s.Metadata[defaultMetadataChallengeKey]; ok {
+		t.Error("challenge nonce was not deleted from the instance metadata")
+	}
+}
@@ -0,0 +1,89 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+const (
+	// maxPayloadSkew is the maximum difference between the payload timestamp and the time of the server.
+	maxPayloadSkew = 5 * time.Minute
+)
+
+// parsePayload parses the attestation payload sent by the agent, and checks its format and freshness.
+func parsePayload(b []byte, config *IIDAttestorPluginConfig, now time.Time) (*common.AttestationPayload, error) {
+	payload, err := common.ParseAttestationPayload(b)
+	if err != nil {
+		return nil, err
+	}
+	if payload.IsLegacy() {
+		if !config.AllowLegacyPayload {
+			return nil, errors.New("legacy attestation payload is not allowed")
+		}
+		return payload, nil
+	}
+
+	if payload.Evidence == nil {
+		return nil, errors.New("attestation payload has no evidence")
+	}
+	if skew := now.Sub(payload.Timestamp); skew > maxPayloadSkew+config.clockSkew || -skew > maxPayloadSkew+config.clockSkew {
+		return nil, fmt.Errorf("attestation payload timestamp is out of range: %v", payload.Timestamp.Format(time.RFC3339))
+	}
+	return payload, nil
+}
+
+// matchPayload compares the evidence in the attestation payload with the instance information returned by Nova.
+// The values are only logged, so that the agent can't learn them from the error.
+// The legacy payload has no evidence to compare.
+func (p *IIDAttestorPlugin) matchPayload(payload *common.AttestationPayload, s *openstack.Server) error {
+	e := payload.Evidence
+	if e == nil {
+		return nil
+	}
+	for _, f := range []struct {
+		name string
+		got  string
+		want string
+		ok   bool
+	}{
+		{name: "name", got: e.Name, want: s.Name, ok: e.Name == s.Name},
+		{name: "availability_zone", got: e.AvailabilityZone, want: s.AvailabilityZone, ok: e.AvailabilityZone == s.AvailabilityZone},
+		{name: "project_id", got: e.ProjectID, want: s.TenantID, ok: e.ProjectID == s.TenantID},
+		{name: "hostname", got: e.Hostname, want: stringValue(s.Hostname), ok: matchHostname(e.Hostname, s.Hostname)},
+	} {
+		if !f.ok {
+			p.logger.Warn("Attestation payload doesn't match the instance", "uuid", s.ID, "nonce", payload.Nonce, "field", f.name, "got", f.got, "want", f.want)
+			return fmt.Errorf("attestation payload mismatch: %s", f.name)
+		}
+	}
+	return nil
+}
+
+// matchHostname returns true if the hostname served by the metadata service matches the one in Nova.
+// The metadata service may append the DHCP domain (e.g. "host.novalocal"). Nova reports the hostname
+// only to admins, so the hostname isn't compared if it is unknown.
+func matchHostname(got string, want *string) bool {
+	if want == nil || *want == "" {
+		return true
+	}
+	return got == *want || strings.HasPrefix(got, *want+".")
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,108 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
+	fake_openstack "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/openstack"
+	fake_server "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/server"
+)
+
+func TestAttestPayload(t *testing.T) {
+	hostname := "bravo"
+	now := time.Now()
+	evidence := func(name, az, projectID, hostname string) *common.Evidence {
+		return &common.Evidence{
+			Name:             name,
+			AvailabilityZone: az,
+			ProjectID:        projectID,
+			Hostname:         hostname,
+		}
+	}
+
+	for i, tc := range []struct {
+		payload     string
+		hostname    *string
+		allowLegacy bool
+		wantErr     string
+	}{
+		// 0: matching payload with the hostname served by the metadata service
+		{
+			payload:  newTestPayload(testUUID, evidence("bravo", "nova", "abc", "bravo.novalocal"), now),
+			hostname: &hostname,
+		},
+		// 1: Nova doesn't report the hostname
+		{
+			payload: newTestPayload(testUUID, evidence("bravo", "nova", "abc", "charlie"), now),
+		},
+		// 2: name mismatch
+		{
+			payload: newTestPayload(testUUID, evidence("charlie", "nova", "abc", ""), now),
+			wantErr: "attestation payload mismatch: name",
+		},
+		// 3: availability zone mismatch
+		{
+			payload: newTestPayload(testUUID, evidence("bravo", "az2", "abc", ""), now),
+			wantErr: "attestation payload mismatch: availability_zone",
+		},
+		// 4: project mismatch
+		{
+			payload: newTestPayload(testUUID, evidence("bravo", "nova", "def", ""), now),
+			wantErr: "attestation payload mismatch: project_id",
+		},
+		// 5: hostname mismatch
+		{
+			payload:  newTestPayload(testUUID, evidence("bravo", "nova", "abc", "bravo2.novalocal"), now),
+			hostname: &hostname,
+			wantErr:  "attestation payload mismatch: hostname",
+		},
+		// 6: no evidence
+		{
+			payload: newTestPayload(testUUID, nil, now),
+			wantErr: "attestation payload has no evidence",
+		},
+		// 7: stale payload
+		{
+			payload: newTestPayload(testUUID, evidence("bravo", "nova", "abc", ""), time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)),
+			wantErr: "attestation payload timestamp is out of range: 2021-10-01T00:00:00Z",
+		},
+		// 8: legacy payload
+		{
+			payload: testUUID,
+			wantErr: "legacy attestation payload is not allowed",
+		},
+		// 9: legacy payload while rolling out the agents
+		{
+			payload:     testUUID,
+			allowLegacy: true,
+		},
+	} {
+		fi := fake_openstack.NewInstance(testProjectID, nil, nil)
+		fi.Hostname = tc.hostname
+
+		p := newTestPlugin()
+		setTestInstance(p, fi, testProjectID)
+		p.config.AllowLegacyPayload = tc.allowLegacy
+		p.attestedBeforeHandler = notAttestedBeforeHandler
+
+		fs := fake_server.NewAttestStream(tc.payload)
+
+		err := p.Attest(fs)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("#%v: unexpected error from Attest(): %v", i, err)
+		case tc.wantErr != "" && err == nil:
+			t.Errorf("#%v: expected an error, got nil", i)
+		case tc.wantErr != "" && err.Error() != tc.wantErr:
+			t.Errorf("#%v: got %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
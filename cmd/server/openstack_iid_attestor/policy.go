@@ -0,0 +1,115 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/secgroups"
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+// AttestationPolicy admits only the instances which satisfy all of the rules.
+type AttestationPolicy struct {
+	// Rules are the named boolean expressions over the instance attributes.
+	Rules []*PolicyRule `hcl:"rule"`
+
+	needsTags   bool
+	needsFlavor bool
+}
+
+// PolicyRule is a named boolean expression, such as
+// "project in ['abc'] and metadata.role == 'web' and az != 'dmz'".
+type PolicyRule struct {
+	Name       string `hcl:",key"`
+	Expression string `hcl:"expression"`
+
+	eval policyBool
+}
+
+// policyEnv holds the instance attributes the rules are evaluated with.
+type policyEnv struct {
+	cloud          string
+	server         *openstack.Server
+	metadata       map[string]string
+	securityGroups []string
+	now            time.Time
+}
+
+// validate compiles the rules.
+func (c *AttestationPolicy) validate() error {
+	if len(c.Rules) == 0 {
+		return errors.New("attestation_policy requires at least one rule")
+	}
+	names := make(map[string]bool)
+	for _, r := range c.Rules {
+		if r.Name == "" {
+			return errors.New("attestation_policy rule requires a name")
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate attestation_policy rule %q", r.Name)
+		}
+		names[r.Name] = true
+
+		cp := &policyCompiler{}
+		eval, err := cp.compile(r.Expression)
+		if err != nil {
+			return fmt.Errorf("invalid attestation_policy rule %q: %v", r.Name, err)
+		}
+		r.eval = eval
+		c.needsTags = c.needsTags || cp.usesTags
+		c.needsFlavor = c.needsFlavor || cp.usesFlavor
+	}
+	return nil
+}
+
+// check returns an error naming the first rule the instance doesn't satisfy.
+func (c *AttestationPolicy) check(s *openstack.Server, cloudID string, config *IIDAttestorPluginConfig) error {
+	env, err := newPolicyEnv(s, cloudID, config)
+	if err != nil {
+		return err
+	}
+	for _, r := range c.Rules {
+		if !r.eval(env) {
+			return fmt.Errorf("instance doesn't satisfy attestation_policy rule %q", r.Name)
+		}
+	}
+	return nil
+}
+
+// newPolicyEnv returns the attributes of the instance. The bootstrap token is not visible to the rules.
+func newPolicyEnv(s *openstack.Server, cloudID string, config *IIDAttestorPluginConfig) (*policyEnv, error) {
+	meta := s.Metadata
+	if config.BootstrapToken != nil {
+		meta = withoutKey(meta, config.BootstrapToken.Key)
+	}
+	var sgs []string
+	for _, m := range s.SecurityGroups {
+		if m == nil {
+			continue
+		}
+		var sg secgroups.SecurityGroup
+		if err := mapstructure.Decode(m, &sg); err != nil {
+			return nil, fmt.Errorf("failed to decode SecurityGroup info: %v", err)
+		}
+		if sg.Name != "" {
+			sgs = append(sgs, sg.Name)
+		}
+	}
+	return &policyEnv{
+		cloud:          cloudID,
+		server:         s,
+		metadata:       meta,
+		securityGroups: sgs,
+		now:            time.Now(),
+	}, nil
+}
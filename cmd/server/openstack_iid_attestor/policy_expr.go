@@ -0,0 +1,531 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The policy expression language:
+//
+//  expr    = and { "or" and }
+//  and     = unary { "and" unary }
+//  unary   = "not" unary | compare
+//  compare = operand [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" | "in" | "not" "in" | "matches" ) operand ]
+//  operand = string | "[" [ string { "," string } ] "]" | attribute | "(" expr ")"
+//
+// The attributes are cloud, project, name, az, flavor, image and metadata.KEY (or metadata['KEY']) of
+// string, tags and security_groups of string list, created of time, and age of duration. Times are compared
+// with RFC 3339 strings, and durations with strings such as '24h'. matches takes a regular expression.
+
+type policyType int
+
+const (
+	policyTypeBool policyType = iota
+	policyTypeString
+	policyTypeList
+	policyTypeTime
+	policyTypeDuration
+)
+
+func (t policyType) String() string {
+	switch t {
+	case policyTypeBool:
+		return "bool"
+	case policyTypeString:
+		return "string"
+	case policyTypeList:
+		return "list"
+	case policyTypeTime:
+		return "time"
+	case policyTypeDuration:
+		return "duration"
+	default:
+		return "unknown"
+	}
+}
+
+type (
+	policyBool     func(env *policyEnv) bool
+	policyString   func(env *policyEnv) string
+	policyList     func(env *policyEnv) []string
+	policyTime     func(env *policyEnv) time.Time
+	policyDuration func(env *policyEnv) time.Duration
+)
+
+// policyOperand is a compiled operand, which has the evaluation function of its type.
+type policyOperand struct {
+	typ policyType
+	pos int
+	// literal is the value of a string literal, which can be converted to a time or a duration.
+	literal *string
+
+	b   policyBool
+	s   policyString
+	l   policyList
+	t   policyTime
+	dur policyDuration
+}
+
+type policyTokenKind int
+
+const (
+	policyTokenEOF policyTokenKind = iota
+	policyTokenIdent
+	policyTokenString
+	policyTokenPunct
+)
+
+type policyToken struct {
+	kind policyTokenKind
+	text string
+	pos  int
+}
+
+func (t policyToken) String() string {
+	switch t.kind {
+	case policyTokenEOF:
+		return "end of expression"
+	case policyTokenString:
+		return fmt.Sprintf("string %q", t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// policyCompiler compiles an expression into an evaluation function.
+type policyCompiler struct {
+	tokens []policyToken
+	next   int
+
+	usesTags   bool
+	usesFlavor bool
+}
+
+func (c *policyCompiler) compile(expr string) (policyBool, error) {
+	tokens, err := tokenizePolicy(expr)
+	if err != nil {
+		return nil, err
+	}
+	c.tokens = tokens
+	c.next = 0
+
+	op, err := c.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := c.peek(); t.kind != policyTokenEOF {
+		return nil, fmt.Errorf("%d: unexpected %v", t.pos, t)
+	}
+	if op.typ != policyTypeBool {
+		return nil, fmt.Errorf("%d: expression must be bool, got %v", op.pos, op.typ)
+	}
+	return op.b, nil
+}
+
+func tokenizePolicy(expr string) ([]policyToken, error) {
+	var tokens []policyToken
+	rs := []rune(expr)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		pos := i + 1
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '_' || unicode.IsLetter(r):
+			j := i
+			for j < len(rs) && (rs[j] == '_' || unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j])) {
+				j++
+			}
+			tokens = append(tokens, policyToken{kind: policyTokenIdent, text: string(rs[i:j]), pos: pos})
+			i = j
+		case r == '\'' || r == '"':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(rs) && rs[j] != r; j++ {
+				if rs[j] == '\\' && j+1 < len(rs) {
+					j++
+				}
+				b.WriteRune(rs[j])
+			}
+			if j == len(rs) {
+				return nil, fmt.Errorf("%d: unterminated string", pos)
+			}
+			tokens = append(tokens, policyToken{kind: policyTokenString, text: b.String(), pos: pos})
+			i = j + 1
+		case strings.ContainsRune("=!<>", r):
+			if i+1 < len(rs) && rs[i+1] == '=' {
+				tokens = append(tokens, policyToken{kind: policyTokenPunct, text: string(rs[i : i+2]), pos: pos})
+				i += 2
+				continue
+			}
+			if r == '=' || r == '!' {
+				return nil, fmt.Errorf("%d: unexpected character %q", pos, r)
+			}
+			tokens = append(tokens, policyToken{kind: policyTokenPunct, text: string(r), pos: pos})
+			i++
+		case strings.ContainsRune("()[],.", r):
+			tokens = append(tokens, policyToken{kind: policyTokenPunct, text: string(r), pos: pos})
+			i++
+		default:
+			return nil, fmt.Errorf("%d: unexpected character %q", pos, r)
+		}
+	}
+	return append(tokens, policyToken{kind: policyTokenEOF, pos: len(rs) + 1}), nil
+}
+
+func (c *policyCompiler) peek() policyToken {
+	return c.tokens[c.next]
+}
+
+func (c *policyCompiler) peekAt(n int) policyToken {
+	if c.next+n >= len(c.tokens) {
+		return c.tokens[len(c.tokens)-1]
+	}
+	return c.tokens[c.next+n]
+}
+
+func (c *policyCompiler) advance() policyToken {
+	t := c.tokens[c.next]
+	if t.kind != policyTokenEOF {
+		c.next++
+	}
+	return t
+}
+
+// accept consumes the next token if it is given identifier or punctuation.
+func (c *policyCompiler) accept(text string) bool {
+	if t := c.peek(); (t.kind == policyTokenIdent || t.kind == policyTokenPunct) && t.text == text {
+		c.next++
+		return true
+	}
+	return false
+}
+
+func (c *policyCompiler) expect(text string) error {
+	if !c.accept(text) {
+		t := c.peek()
+		return fmt.Errorf("%d: expected %q, got %v", t.pos, text, t)
+	}
+	return nil
+}
+
+func (c *policyCompiler) parseOr() (*policyOperand, error) {
+	left, err := c.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for c.peek().text == "or" && c.peek().kind == policyTokenIdent {
+		t := c.advance()
+		right, err := c.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkBool(t, left, right); err != nil {
+			return nil, err
+		}
+		l, r := left.b, right.b
+		left = &policyOperand{typ: policyTypeBool, pos: left.pos, b: func(env *policyEnv) bool { return l(env) || r(env) }}
+	}
+	return left, nil
+}
+
+func (c *policyCompiler) parseAnd() (*policyOperand, error) {
+	left, err := c.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for c.peek().text == "and" && c.peek().kind == policyTokenIdent {
+		t := c.advance()
+		right, err := c.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkBool(t, left, right); err != nil {
+			return nil, err
+		}
+		l, r := left.b, right.b
+		left = &policyOperand{typ: policyTypeBool, pos: left.pos, b: func(env *policyEnv) bool { return l(env) && r(env) }}
+	}
+	return left, nil
+}
+
+func (c *policyCompiler) parseUnary() (*policyOperand, error) {
+	if t := c.peek(); t.kind == policyTokenIdent && t.text == "not" {
+		c.advance()
+		op, err := c.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkBool(t, op); err != nil {
+			return nil, err
+		}
+		b := op.b
+		return &policyOperand{typ: policyTypeBool, pos: t.pos, b: func(env *policyEnv) bool { return !b(env) }}, nil
+	}
+	return c.parseCompare()
+}
+
+func checkBool(op policyToken, operands ...*policyOperand) error {
+	for _, o := range operands {
+		if o.typ != policyTypeBool {
+			return fmt.Errorf("%d: %q requires bool, got %v", o.pos, op.text, o.typ)
+		}
+	}
+	return nil
+}
+
+func (c *policyCompiler) parseCompare() (*policyOperand, error) {
+	left, err := c.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	t := c.peek()
+	op := t.text
+	switch {
+	case t.kind == policyTokenPunct && (op == "==" || op == "!=" || op == "<" || op == "<=" || op == ">" || op == ">="):
+	case t.kind == policyTokenIdent && (op == "in" || op == "matches"):
+	case t.kind == policyTokenIdent && op == "not" && c.peekAt(1).kind == policyTokenIdent && c.peekAt(1).text == "in":
+		c.advance()
+		op = "not in"
+	default:
+		return left, nil
+	}
+	c.advance()
+
+	right, err := c.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return compareOperands(t, op, left, right)
+}
+
+func (c *policyCompiler) parseOperand() (*policyOperand, error) {
+	t := c.advance()
+	switch {
+	case t.kind == policyTokenString:
+		s := t.text
+		return &policyOperand{typ: policyTypeString, pos: t.pos, literal: &s, s: func(*policyEnv) string { return s }}, nil
+	case t.kind == policyTokenPunct && t.text == "[":
+		var list []string
+		for !c.accept("]") {
+			if len(list) > 0 {
+				if err := c.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			e := c.advance()
+			if e.kind != policyTokenString {
+				return nil, fmt.Errorf("%d: list elements must be strings, got %v", e.pos, e)
+			}
+			list = append(list, e.text)
+		}
+		return &policyOperand{typ: policyTypeList, pos: t.pos, l: func(*policyEnv) []string { return list }}, nil
+	case t.kind == policyTokenPunct && t.text == "(":
+		op, err := c.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := c.expect(")"); err != nil {
+			return nil, err
+		}
+		return op, nil
+	case t.kind == policyTokenIdent:
+		return c.attribute(t)
+	default:
+		return nil, fmt.Errorf("%d: unexpected %v", t.pos, t)
+	}
+}
+
+// attribute returns the operand of the instance attribute.
+func (c *policyCompiler) attribute(t policyToken) (*policyOperand, error) {
+	str := func(f policyString) (*policyOperand, error) {
+		return &policyOperand{typ: policyTypeString, pos: t.pos, s: f}, nil
+	}
+	switch t.text {
+	case "cloud":
+		return str(func(env *policyEnv) string { return env.cloud })
+	case "project":
+		return str(func(env *policyEnv) string { return env.server.TenantID })
+	case "name":
+		return str(func(env *policyEnv) string { return env.server.Name })
+	case "az":
+		return str(func(env *policyEnv) string { return env.server.AvailabilityZone })
+	case "image":
+		return str(func(env *policyEnv) string { return env.server.ImageID() })
+	case "flavor":
+		c.usesFlavor = true
+		return str(func(env *policyEnv) string { return env.server.FlavorName() })
+	case "metadata":
+		var key string
+		switch {
+		case c.accept("."):
+			k := c.advance()
+			if k.kind != policyTokenIdent {
+				return nil, fmt.Errorf("%d: expected metadata key, got %v", k.pos, k)
+			}
+			key = k.text
+		case c.accept("["):
+			k := c.advance()
+			if k.kind != policyTokenString {
+				return nil, fmt.Errorf("%d: expected metadata key, got %v", k.pos, k)
+			}
+			key = k.text
+			if err := c.expect("]"); err != nil {
+				return nil, err
+			}
+		default:
+			n := c.peek()
+			return nil, fmt.Errorf("%d: expected metadata key, got %v", n.pos, n)
+		}
+		return str(func(env *policyEnv) string { return env.metadata[key] })
+	case "tags":
+		c.usesTags = true
+		return &policyOperand{typ: policyTypeList, pos: t.pos, l: func(env *policyEnv) []string {
+			if env.server.Tags == nil {
+				return nil
+			}
+			return *env.server.Tags
+		}}, nil
+	case "security_groups":
+		return &policyOperand{typ: policyTypeList, pos: t.pos, l: func(env *policyEnv) []string { return env.securityGroups }}, nil
+	case "created":
+		return &policyOperand{typ: policyTypeTime, pos: t.pos, t: func(env *policyEnv) time.Time { return env.server.Created }}, nil
+	case "age":
+		return &policyOperand{typ: policyTypeDuration, pos: t.pos, dur: func(env *policyEnv) time.Duration { return env.now.Sub(env.server.Created) }}, nil
+	default:
+		return nil, fmt.Errorf("%d: unknown attribute %q", t.pos, t.text)
+	}
+}
+
+// convertLiteral converts a string literal to given type, so that times and durations can be written as strings.
+func convertLiteral(o *policyOperand, typ policyType) error {
+	if o.typ == typ || o.literal == nil {
+		return nil
+	}
+	switch typ {
+	case policyTypeTime:
+		v, err := time.Parse(time.RFC3339, *o.literal)
+		if err != nil {
+			return fmt.Errorf("%d: invalid time: %v", o.pos, err)
+		}
+		o.typ, o.t = typ, func(*policyEnv) time.Time { return v }
+	case policyTypeDuration:
+		v, err := time.ParseDuration(*o.literal)
+		if err != nil {
+			return fmt.Errorf("%d: invalid duration: %v", o.pos, err)
+		}
+		o.typ, o.dur = typ, func(*policyEnv) time.Duration { return v }
+	}
+	return nil
+}
+
+func compareOperands(t policyToken, op string, left, right *policyOperand) (*policyOperand, error) {
+	mismatch := fmt.Errorf("%d: %q can't compare %v with %v", t.pos, op, left.typ, right.typ)
+	result := func(b policyBool) (*policyOperand, error) {
+		return &policyOperand{typ: policyTypeBool, pos: left.pos, b: b}, nil
+	}
+
+	switch op {
+	case "in", "not in":
+		if left.typ != policyTypeString || right.typ != policyTypeList {
+			return nil, mismatch
+		}
+		l, r, negate := left.s, right.l, op == "not in"
+		return result(func(env *policyEnv) bool { return contains(r(env), l(env)) != negate })
+	case "matches":
+		if left.typ != policyTypeString || right.literal == nil {
+			return nil, fmt.Errorf("%d: %q requires a string and a regular expression literal", t.pos, op)
+		}
+		re, err := regexp.Compile(*right.literal)
+		if err != nil {
+			return nil, fmt.Errorf("%d: invalid regular expression: %v", right.pos, err)
+		}
+		l := left.s
+		return result(func(env *policyEnv) bool { return re.MatchString(l(env)) })
+	}
+
+	if err := convertLiteral(right, left.typ); err != nil {
+		return nil, err
+	}
+	if err := convertLiteral(left, right.typ); err != nil {
+		return nil, err
+	}
+	if left.typ != right.typ {
+		return nil, mismatch
+	}
+
+	var cmp func(env *policyEnv) int
+	switch left.typ {
+	case policyTypeString:
+		if op != "==" && op != "!=" {
+			return nil, mismatch
+		}
+		l, r := left.s, right.s
+		cmp = func(env *policyEnv) int { return strings.Compare(l(env), r(env)) }
+	case policyTypeTime:
+		l, r := left.t, right.t
+		cmp = func(env *policyEnv) int {
+			lv, rv := l(env), r(env)
+			switch {
+			case lv.Before(rv):
+				return -1
+			case lv.After(rv):
+				return 1
+			default:
+				return 0
+			}
+		}
+	case policyTypeDuration:
+		l, r := left.dur, right.dur
+		cmp = func(env *policyEnv) int {
+			lv, rv := l(env), r(env)
+			switch {
+			case lv < rv:
+				return -1
+			case lv > rv:
+				return 1
+			default:
+				return 0
+			}
+		}
+	case policyTypeBool:
+		if op != "==" && op != "!=" {
+			return nil, mismatch
+		}
+		l, r := left.b, right.b
+		cmp = func(env *policyEnv) int {
+			if l(env) == r(env) {
+				return 0
+			}
+			return 1
+		}
+	default:
+		return nil, mismatch
+	}
+
+	switch op {
+	case "==":
+		return result(func(env *policyEnv) bool { return cmp(env) == 0 })
+	case "!=":
+		return result(func(env *policyEnv) bool { return cmp(env) != 0 })
+	case "<":
+		return result(func(env *policyEnv) bool { return cmp(env) < 0 })
+	case "<=":
+		return result(func(env *policyEnv) bool { return cmp(env) <= 0 })
+	case ">":
+		return result(func(env *policyEnv) bool { return cmp(env) > 0 })
+	default:
+		return result(func(env *policyEnv) bool { return cmp(env) >= 0 })
+	}
+}
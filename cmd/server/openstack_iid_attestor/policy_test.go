@@ -0,0 +1,194 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+	fake_common "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/common"
+	fake_openstack "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/openstack"
+	fake_server "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/server"
+)
+
+func newPolicyTestServer() *openstack.Server {
+	tags := []string{"web", "prod"}
+	s := &openstack.Server{}
+	s.ID = "123"
+	s.TenantID = "abc"
+	s.Name = "web-1"
+	s.AvailabilityZone = "nova"
+	s.Image = map[string]interface{}{"id": "image-1"}
+	s.Flavor = map[string]interface{}{"original_name": "m1.small"}
+	s.Metadata = map[string]string{"role": "web", "spire-token": "secret", "app.kubernetes.io/name": "nginx"}
+	s.Tags = &tags
+	s.SecurityGroups = []map[string]interface{}{{"name": "default"}, {"name": "http"}}
+	s.Created = time.Now().Add(-time.Hour)
+	return s
+}
+
+func TestAttestationPolicyCheck(t *testing.T) {
+	for i, tc := range []struct {
+		expression string
+		want       bool
+	}{
+		// 0: project, metadata and availability zone
+		{expression: "project in ['abc'] and metadata.role == 'web' and az != 'dmz'", want: true},
+		// 1: project is not in the list
+		{expression: "project in ['def', 'ghi']", want: false},
+		// 2: not in
+		{expression: "project not in ['def']", want: true},
+		// 3: metadata key which is not an identifier
+		{expression: `metadata['app.kubernetes.io/name'] == "nginx"`, want: true},
+		// 4: missing metadata key is empty
+		{expression: "metadata.group == ''", want: true},
+		// 5: the bootstrap token is not visible
+		{expression: "metadata['spire-token'] == 'secret'", want: false},
+		// 6: name matches
+		{expression: "name matches '^web-[0-9]+$'", want: true},
+		// 7: flavor and image
+		{expression: "flavor == 'm1.small' and image == 'image-1'", want: true},
+		// 8: tags and security groups
+		{expression: "'prod' in tags and 'http' in security_groups", want: true},
+		// 9: or and not
+		{expression: "not (az == 'nova') or cloud == ''", want: true},
+		// 10: and binds tighter than or
+		{expression: "az == 'dmz' and name == 'web-1' or project == 'abc'", want: true},
+		// 11: creation time
+		{expression: "created > '2021-01-01T00:00:00Z'", want: true},
+		// 12: age
+		{expression: "age < '10m'", want: false},
+	} {
+		policy := &AttestationPolicy{Rules: []*PolicyRule{{Name: "test", Expression: tc.expression}}}
+		if err := policy.validate(); err != nil {
+			t.Errorf("#%v: unexpected error from validate(): %v", i, err)
+			continue
+		}
+		config := &IIDAttestorPluginConfig{BootstrapToken: &BootstrapToken{Key: "spire-token"}}
+		err := policy.check(newPolicyTestServer(), "", config)
+		if got := err == nil; got != tc.want {
+			t.Errorf("#%v: got %v (%v), want %v", i, got, err, tc.want)
+		}
+	}
+}
+
+func TestAttestationPolicyValidate(t *testing.T) {
+	for i, tc := range []struct {
+		policy  *AttestationPolicy
+		wantErr string
+	}{
+		// 0: no rule
+		{
+			policy:  &AttestationPolicy{},
+			wantErr: "attestation_policy requires at least one rule",
+		},
+		// 1: duplicate rule
+		{
+			policy:  &AttestationPolicy{Rules: []*PolicyRule{{Name: "a", Expression: "az == 'nova'"}, {Name: "a", Expression: "az == 'nova'"}}},
+			wantErr: `duplicate attestation_policy rule "a"`,
+		},
+		// 2: syntax error
+		{
+			policy:  &AttestationPolicy{Rules: []*PolicyRule{{Name: "a", Expression: "az == 'nova' and"}}},
+			wantErr: `invalid attestation_policy rule "a": 17: unexpected end of expression`,
+		},
+		// 3: unknown attribute
+		{
+			policy:  &AttestationPolicy{Rules: []*PolicyRule{{Name: "a", Expression: "zone == 'nova'"}}},
+			wantErr: `invalid attestation_policy rule "a": 1: unknown attribute "zone"`,
+		},
+		// 4: not bool
+		{
+			policy:  &AttestationPolicy{Rules: []*PolicyRule{{Name: "a", Expression: "az"}}},
+			wantErr: `invalid attestation_policy rule "a": 1: expression must be bool, got string`,
+		},
+		// 5: type mismatch
+		{
+			policy:  &AttestationPolicy{Rules: []*PolicyRule{{Name: "a", Expression: "tags == 'web'"}}},
+			wantErr: `invalid attestation_policy rule "a": 6: "==" can't compare list with string`,
+		},
+		// 6: invalid duration
+		{
+			policy:  &AttestationPolicy{Rules: []*PolicyRule{{Name: "a", Expression: "age < 'a day'"}}},
+			wantErr: `invalid attestation_policy rule "a": 7: invalid duration: time: invalid duration "a day"`,
+		},
+		// 7: invalid regular expression
+		{
+			policy:  &AttestationPolicy{Rules: []*PolicyRule{{Name: "a", Expression: "name matches '('"}}},
+			wantErr: "invalid attestation_policy rule \"a\": 14: invalid regular expression: error parsing regexp: missing closing ): `(`",
+		},
+		// 8: unterminated string
+		{
+			policy:  &AttestationPolicy{Rules: []*PolicyRule{{Name: "a", Expression: "az == 'nova"}}},
+			wantErr: `invalid attestation_policy rule "a": 7: unterminated string`,
+		},
+	} {
+		err := tc.policy.validate()
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
+
+func TestAttestAttestationPolicy(t *testing.T) {
+	p := newTestPlugin()
+	p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, _ hclog.Logger) (openstack.InstanceClient, error) {
+		return fake_openstack.NewInstance(testProjectID, map[string]string{"role": "db"}, nil), nil
+	}
+	p.attestedBeforeHandler = notAttestedBeforeHandler
+
+	conf := `
+	cloud_name = "test"
+	projectid_allow_list = ["abc"]
+	attestation_policy {
+		rule "project" {
+			expression = "project == 'abc'"
+		}
+		rule "web" {
+			expression = "metadata.role == 'web'"
+		}
+	}
+	`
+	if _, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, conf)); err != nil {
+		t.Fatalf("unexpected error from Configure(): %v", err)
+	}
+
+	wantErr := `instance doesn't satisfy attestation_policy rule "web"`
+	if err := p.Attest(fake_server.NewAttestStream(testPayload)); err == nil || err.Error() != wantErr {
+		t.Errorf("got error %v, want %v", err, wantErr)
+	}
+}
+
+func TestConfigureAttestationPolicyComputeOptions(t *testing.T) {
+	p := newTestPlugin()
+	var got openstack.ComputeOptions
+	p.getInstanceHandler = func(_ context.Context, cloud *Cloud, _ openstack.AuthOptions, _ hclog.Logger) (openstack.InstanceClient, error) {
+		got = cloud.computeOptions
+		return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+	}
+
+	conf := `
+	cloud_name = "test"
+	projectid_allow_list = ["abc"]
+	attestation_policy {
+		rule "web" {
+			expression = "flavor == 'm1.small' and 'web' in tags"
+		}
+	}
+	`
+	if _, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, conf)); err != nil {
+		t.Fatalf("unexpected error from Configure(): %v", err)
+	}
+	if !got.ServerTags || !got.EmbeddedFlavor {
+		t.Errorf("got %+v, want the server tags and the embedded flavor", got)
+	}
+}
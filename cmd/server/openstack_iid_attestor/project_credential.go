@@ -0,0 +1,92 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gophercloud/gophercloud"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+// ProjectCredential is the credential to look up the instances of a project with, such as an application
+// credential scoped to the project. It is for the clouds which don't grant the read access to the instances
+// of every allowed project to a single credential.
+type ProjectCredential struct {
+	ProjectID string `hcl:",key"`
+
+	CloudName      string `hcl:"cloud_name"`
+	CloudsYAMLPath string `hcl:"clouds_yaml_path"`
+	Auth           *Auth  `hcl:"auth"`
+
+	authOptions openstack.AuthOptions
+}
+
+// instanceKey identifies the client of a cloud. The project is empty for the client with the credential
+// of the cloud, which looks up the instances of every allowed project.
+type instanceKey struct {
+	cloud   string
+	project string
+}
+
+// configureProjectCredentials validates the project credentials of the cloud, and allows the projects
+// which have the credentials.
+func (c *Cloud) configureProjectCredentials() error {
+	if c.CloudName != "" || c.Auth != nil {
+		return errors.New("cloud_name and auth can't be combined with project_credential")
+	}
+	if len(c.ProjectIDAllowList) > 0 {
+		return errors.New("projectid_allow_list can't be combined with project_credential, the projects with the credentials are allowed")
+	}
+
+	seen := make(map[string]bool, len(c.ProjectCredentials))
+	for _, pc := range c.ProjectCredentials {
+		if pc.ProjectID == "" {
+			return errors.New("project_credential requires the project ID")
+		}
+		if seen[pc.ProjectID] {
+			return fmt.Errorf("duplicate project_credential %q", pc.ProjectID)
+		}
+		seen[pc.ProjectID] = true
+
+		cloudsYAMLPath := pc.CloudsYAMLPath
+		if cloudsYAMLPath == "" {
+			cloudsYAMLPath = c.CloudsYAMLPath
+		}
+		authOpts, err := authOptions(pc.CloudName, cloudsYAMLPath, pc.Auth)
+		if err != nil {
+			return fmt.Errorf("project_credential %q: %v", pc.ProjectID, err)
+		}
+		pc.authOptions = authOpts
+		c.ProjectIDAllowList = append(c.ProjectIDAllowList, pc.ProjectID)
+	}
+	return nil
+}
+
+// instanceKey returns the key of the client to look up the instance with. If the cloud has the project
+// credentials, the client of the project the agent states is used, which must be allowed.
+func (c *Cloud) instanceKey(projectID string) (instanceKey, error) {
+	if len(c.ProjectCredentials) == 0 {
+		return instanceKey{cloud: c.ID}, nil
+	}
+	if projectID == "" {
+		return instanceKey{}, errors.New("attestation payload has no project")
+	}
+	if !isProjectAllowed(c.ProjectIDAllowList, projectID) {
+		return instanceKey{}, errors.New("invalid attestation request")
+	}
+	return instanceKey{cloud: c.ID, project: projectID}, nil
+}
+
+// isNotFound returns true if the compute API responded 404.
+func isNotFound(err error) bool {
+	var e gophercloud.ErrDefault404
+	return errors.As(err, &e)
+}
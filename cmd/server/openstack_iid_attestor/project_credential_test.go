@@ -0,0 +1,202 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+	fake_common "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/common"
+	fake_openstack "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/openstack"
+	fake_server "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/server"
+)
+
+// notFoundInstance is the client whose credential can't see any instance.
+type notFoundInstance struct {
+	openstack.InstanceClient
+}
+
+func (notFoundInstance) Get(_ context.Context, _ string) (*openstack.Server, error) {
+	return nil, gophercloud.ErrDefault404{}
+}
+
+func TestConfigureProjectCredentials(t *testing.T) {
+	p := newTestPlugin()
+	got := make(map[string]openstack.AuthOptions)
+	p.getInstanceHandler = func(_ context.Context, _ *Cloud, auth openstack.AuthOptions, logger hclog.Logger) (openstack.InstanceClient, error) {
+		got[auth.CloudName] = auth
+		return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+	}
+
+	conf := `
+	clouds_yaml_path = "/etc/spire/server/clouds.yaml"
+	project_credential "alpha" {
+		cloud_name = "alpha"
+	}
+	project_credential "bravo" {
+		cloud_name = "bravo"
+		clouds_yaml_path = "/etc/spire/server/bravo.yaml"
+	}
+	`
+	if _, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, conf)); err != nil {
+		t.Fatalf("unexpected error from Configure(): %v", err)
+	}
+
+	if got["alpha"].CloudsYAMLPath != "/etc/spire/server/clouds.yaml" || got["bravo"].CloudsYAMLPath != "/etc/spire/server/bravo.yaml" {
+		t.Errorf("unexpected auth options: %+v", got)
+	}
+
+	config, instances, err := p.getConfig()
+	if err != nil {
+		t.Fatalf("unexpected error from getConfig(): %v", err)
+	}
+	allowList := append([]string(nil), config.clouds[""].ProjectIDAllowList...)
+	sort.Strings(allowList)
+	if want := []string{"alpha", "bravo"}; !reflect.DeepEqual(allowList, want) {
+		t.Errorf("got allow list %v, want %v", allowList, want)
+	}
+	if len(instances) != 2 || instances[instanceKey{project: "alpha"}] == nil || instances[instanceKey{project: "bravo"}] == nil {
+		t.Errorf("unexpected clients: %v", instances)
+	}
+}
+
+func TestConfigureProjectCredentialsError(t *testing.T) {
+	for i, tc := range []struct {
+		conf    string
+		wantErr string
+	}{
+		// 0: with cloud_name
+		{
+			conf: `
+			cloud_name = "test"
+			project_credential "alpha" {
+				cloud_name = "alpha"
+			}
+			`,
+			wantErr: "cloud_name and auth can't be combined with project_credential",
+		},
+		// 1: with projectid_allow_list
+		{
+			conf: `
+			projectid_allow_list = ["alpha"]
+			project_credential "alpha" {
+				cloud_name = "alpha"
+			}
+			`,
+			wantErr: "projectid_allow_list can't be combined with project_credential, the projects with the credentials are allowed",
+		},
+		// 2: duplicate project
+		{
+			conf: `
+			project_credential "alpha" {
+				cloud_name = "alpha"
+			}
+			project_credential "alpha" {
+				cloud_name = "bravo"
+			}
+			`,
+			wantErr: `duplicate project_credential "alpha"`,
+		},
+		// 3: invalid auth
+		{
+			conf: `
+			project_credential "alpha" {
+				cloud_name = "alpha"
+				auth = {
+					auth_url = "https://keystone.example.com:5000/v3"
+					username = "alpha"
+					secret_env = "TEST_OPENSTACK_SECRET"
+				}
+			}
+			`,
+			wantErr: `project_credential "alpha": cloud_name and auth are mutually exclusive`,
+		},
+		// 4: client error
+		{
+			conf: `
+			cloud "east" {
+				project_credential "alpha" {
+					cloud_name = "charlie"
+				}
+			}
+			`,
+			wantErr: `failed to prepare OpenStack Client for cloud "east" for project "alpha": authentication failed`,
+		},
+	} {
+		p := newTestPlugin()
+		p.getInstanceHandler = func(_ context.Context, _ *Cloud, auth openstack.AuthOptions, logger hclog.Logger) (openstack.InstanceClient, error) {
+			if auth.CloudName == "charlie" {
+				return nil, errors.New("authentication failed")
+			}
+			return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+		}
+
+		_, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, tc.conf))
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
+
+func TestAttestProjectCredentials(t *testing.T) {
+	for i, tc := range []struct {
+		payload string
+		wantErr string
+	}{
+		// 0: found in the project
+		{
+			payload: testPayload,
+		},
+		// 1: not found in the project
+		{
+			payload: newTestPayload(testUUID, &common.Evidence{Name: "bravo", AvailabilityZone: "nova", ProjectID: "bravo"}, time.Now()),
+			wantErr: "invalid attestation request",
+		},
+		// 2: project without credential
+		{
+			payload: newTestPayload(testUUID, &common.Evidence{Name: "bravo", AvailabilityZone: "nova", ProjectID: "charlie"}, time.Now()),
+			wantErr: "invalid attestation request",
+		},
+		// 3: legacy payload, which doesn't state the project
+		{
+			payload: testUUID,
+			wantErr: "attestation payload has no project",
+		},
+	} {
+		p := newTestPlugin()
+		p.config.AllowLegacyPayload = true
+		p.config.clouds = map[string]*Cloud{
+			"": {
+				ProjectIDAllowList: []string{testProjectID, "bravo"},
+				ProjectCredentials: []*ProjectCredential{{ProjectID: testProjectID}, {ProjectID: "bravo"}},
+			},
+		}
+		p.instances = map[instanceKey]openstack.InstanceClient{
+			{project: testProjectID}: fake_openstack.NewInstance(testProjectID, nil, nil),
+			{project: "bravo"}:       notFoundInstance{},
+		}
+		p.attestedBeforeHandler = notAttestedBeforeHandler
+
+		err := p.Attest(fake_server.NewAttestStream(tc.payload))
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("#%v: unexpected error from Attest(): %v", i, err)
+		}
+		if tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+			t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+const (
+	challengeMetadata         = "metadata_challenge"
+	challengeKeyPair          = "keypair_challenge"
+	challengeBootstrapToken   = "bootstrap_token"
+	challengeIdentityDocument = "identity_document"
+)
+
+// ProjectOverride overrides the global settings for the instances of a project.
+// The settings which are not given fall back to the global ones.
+type ProjectOverride struct {
+	ProjectID string `hcl:",key"`
+	// CustomMetaData replaces the global custom_metadata.
+	CustomMetaData *CustomMetadata `hcl:"custom_metadata"`
+	// InstanceState replaces the global instance_state.
+	InstanceState *InstanceState `hcl:"instance_state"`
+	// AttestationPolicy replaces the global attestation_policy.
+	AttestationPolicy *AttestationPolicy `hcl:"attestation_policy"`
+	// MaxInstanceAge replaces the global max_instance_age.
+	MaxInstanceAge string `hcl:"max_instance_age"`
+	// AgentPathTemplate replaces the global agent_path_template.
+	AgentPathTemplate string `hcl:"agent_path_template"`
+	// MetadataChallenge, KeyPairChallenge and BootstrapToken are required in addition to the global ones.
+	MetadataChallenge *MetadataChallenge `hcl:"metadata_challenge"`
+	KeyPairChallenge  *KeyPairChallenge  `hcl:"keypair_challenge"`
+	BootstrapToken    *BootstrapToken    `hcl:"bootstrap_token"`
+	// DisabledChallenges are the global challenges the project doesn't require, out of
+	// "metadata_challenge", "keypair_challenge", "bootstrap_token" and "identity_document".
+	DisabledChallenges []string `hcl:"disabled_challenges"`
+
+	maxInstanceAge    time.Duration
+	agentPathTemplate *template.Template
+}
+
+// validateProjectOverrides checks the project blocks and sets the default values.
+func validateProjectOverrides(config *IIDAttestorPluginConfig) error {
+	ids := make(map[string]bool)
+	for _, o := range config.Projects {
+		if o.ProjectID == "" {
+			return errors.New("project block requires a project ID")
+		}
+		if ids[o.ProjectID] {
+			return fmt.Errorf("duplicate project %q", o.ProjectID)
+		}
+		ids[o.ProjectID] = true
+
+		if err := o.validate(len(config.Clouds) > 0); err != nil {
+			return fmt.Errorf("project %q: %v", o.ProjectID, err)
+		}
+	}
+	return nil
+}
+
+func (o *ProjectOverride) validate(multiCloud bool) error {
+	if o.MetadataChallenge != nil && o.MetadataChallenge.Key == "" {
+		o.MetadataChallenge.Key = defaultMetadataChallengeKey
+	}
+	if o.BootstrapToken != nil && o.BootstrapToken.Key == "" {
+		o.BootstrapToken.Key = defaultBootstrapTokenKey
+	}
+	if o.InstanceState != nil {
+		if err := o.InstanceState.validate(); err != nil {
+			return err
+		}
+	}
+	if o.AttestationPolicy != nil {
+		if err := o.AttestationPolicy.validate(); err != nil {
+			return err
+		}
+	}
+	if o.MaxInstanceAge != "" {
+		d, err := time.ParseDuration(o.MaxInstanceAge)
+		if err != nil {
+			return fmt.Errorf("invalid max_instance_age: %v", err)
+		}
+		if d < 0 {
+			return errors.New("max_instance_age must not be negative")
+		}
+		o.maxInstanceAge = d
+	}
+	if o.AgentPathTemplate != "" {
+		tmpl, err := parseAgentPathTemplate(o.AgentPathTemplate, multiCloud)
+		if err != nil {
+			return err
+		}
+		o.agentPathTemplate = tmpl
+	}
+	for _, c := range o.DisabledChallenges {
+		switch c {
+		case challengeMetadata, challengeKeyPair, challengeBootstrapToken, challengeIdentityDocument:
+		default:
+			return fmt.Errorf("unknown challenge in disabled_challenges: %q", c)
+		}
+	}
+	return nil
+}
+
+// apply returns the configuration of the project, which is a copy of the global one with the overrides.
+func (o *ProjectOverride) apply(config *IIDAttestorPluginConfig) (*IIDAttestorPluginConfig, error) {
+	c := *config
+	c.Projects = nil
+	c.projects = nil
+
+	if o.CustomMetaData != nil {
+		c.CustomMetaData = o.CustomMetaData
+	}
+	if o.InstanceState != nil {
+		c.InstanceState = o.InstanceState
+	}
+	if o.AttestationPolicy != nil {
+		c.AttestationPolicy = o.AttestationPolicy
+	}
+	if o.MaxInstanceAge != "" {
+		c.MaxInstanceAge = o.MaxInstanceAge
+		c.maxInstanceAge = o.maxInstanceAge
+	}
+	if o.AgentPathTemplate != "" {
+		c.AgentPathTemplate = o.AgentPathTemplate
+		c.agentPathTemplate = o.agentPathTemplate
+	}
+
+	for _, d := range o.DisabledChallenges {
+		switch d {
+		case challengeMetadata:
+			c.MetadataChallenge = nil
+		case challengeKeyPair:
+			c.KeyPairChallenge = nil
+		case challengeBootstrapToken:
+			c.BootstrapToken = nil
+		case challengeIdentityDocument:
+			c.IdentityDocument = nil
+		}
+	}
+	if o.MetadataChallenge != nil {
+		c.MetadataChallenge = o.MetadataChallenge
+	}
+	if o.KeyPairChallenge != nil {
+		c.KeyPairChallenge = o.KeyPairChallenge
+	}
+	if o.BootstrapToken != nil {
+		c.BootstrapToken = o.BootstrapToken
+	}
+
+	if c.AllowReattestation && c.MetadataChallenge == nil && c.KeyPairChallenge == nil {
+		return nil, fmt.Errorf("project %q: allow_reattestation requires metadata_challenge or keypair_challenge", o.ProjectID)
+	}
+	return &c, nil
+}
+
+// forProject returns the configuration of given project, which is the global one if the project has no block.
+func (c *IIDAttestorPluginConfig) forProject(projectID string) *IIDAttestorPluginConfig {
+	if pc, ok := c.projects[projectID]; ok {
+		return pc
+	}
+	return c
+}
+
+// needsServerLocked returns true if any instance_state denies the locked instances.
+func (c *IIDAttestorPluginConfig) needsServerLocked() bool {
+	if c.InstanceState != nil && c.InstanceState.DenyLocked {
+		return true
+	}
+	for _, o := range c.Projects {
+		if o.InstanceState != nil && o.InstanceState.DenyLocked {
+			return true
+		}
+	}
+	return false
+}
+
+// needsKeyPairs returns true if any project requires the keypair challenge.
+func (c *IIDAttestorPluginConfig) needsKeyPairs() bool {
+	if c.KeyPairChallenge != nil {
+		return true
+	}
+	for _, o := range c.Projects {
+		if o.KeyPairChallenge != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// needsServerTags returns true if any attestation policy refers to the server tags.
+func (c *IIDAttestorPluginConfig) needsServerTags() bool {
+	if c.AttestationPolicy != nil && c.AttestationPolicy.needsTags {
+		return true
+	}
+	for _, o := range c.Projects {
+		if o.AttestationPolicy != nil && o.AttestationPolicy.needsTags {
+			return true
+		}
+	}
+	return false
+}
+
+// needsEmbeddedFlavor returns true if any attestation policy refers to the flavor.
+func (c *IIDAttestorPluginConfig) needsEmbeddedFlavor() bool {
+	if c.AttestationPolicy != nil && c.AttestationPolicy.needsFlavor {
+		return true
+	}
+	for _, o := range c.Projects {
+		if o.AttestationPolicy != nil && o.AttestationPolicy.needsFlavor {
+			return true
+		}
+	}
+	return false
+}
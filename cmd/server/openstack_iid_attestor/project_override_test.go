@@ -0,0 +1,192 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/common"
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+	fake_common "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/common"
+	fake_openstack "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/openstack"
+	fake_server "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/server"
+)
+
+func TestConfigureProjectOverrides(t *testing.T) {
+	p := newTestPlugin()
+	p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, _ hclog.Logger) (openstack.InstanceClient, error) {
+		return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+	}
+
+	conf := `
+	cloud_name = "test"
+	projectid_allow_list = ["abc", "def"]
+	max_instance_age = "1h"
+	metadata_challenge = {}
+	allow_reattestation = true
+	reattestation_state_path = "/tmp/openstack_iid_attestations.json"
+	project "abc" {
+		max_instance_age = "10m"
+		keypair_challenge = {}
+		bootstrap_token = {}
+		disabled_challenges = ["metadata_challenge"]
+	}
+	`
+	if _, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, conf)); err != nil {
+		t.Fatalf("unexpected error from Configure(): %v", err)
+	}
+	config, _, err := p.getConfig()
+	if err != nil {
+		t.Fatalf("unexpected error from getConfig(): %v", err)
+	}
+
+	pc := config.forProject("abc")
+	if pc.maxInstanceAge != 10*time.Minute {
+		t.Errorf("got max_instance_age %v, want %v", pc.maxInstanceAge, 10*time.Minute)
+	}
+	if pc.MetadataChallenge != nil || pc.KeyPairChallenge == nil {
+		t.Errorf("got metadata_challenge %v and keypair_challenge %v, want only keypair_challenge", pc.MetadataChallenge, pc.KeyPairChallenge)
+	}
+	if pc.BootstrapToken == nil || pc.BootstrapToken.Key != defaultBootstrapTokenKey {
+		t.Errorf("got bootstrap_token %v, want the default key", pc.BootstrapToken)
+	}
+	if pc.trustDomain != config.trustDomain || pc.attestations != config.attestations {
+		t.Error("project configuration doesn't share the global settings")
+	}
+
+	if dc := config.forProject("def"); dc != config {
+		t.Error("project without a block doesn't use the global configuration")
+	}
+}
+
+func TestConfigureProjectOverridesError(t *testing.T) {
+	for i, tc := range []struct {
+		conf    string
+		wantErr string
+	}{
+		// 0: duplicate project
+		{
+			conf: `
+			project "abc" {}
+			project "abc" {}
+			`,
+			wantErr: `duplicate project "abc"`,
+		},
+		// 1: invalid max_instance_age
+		{
+			conf: `
+			project "abc" {
+				max_instance_age = "a day"
+			}
+			`,
+			wantErr: `project "abc": invalid max_instance_age: time: invalid duration "a day"`,
+		},
+		// 2: unknown challenge
+		{
+			conf: `
+			project "abc" {
+				disabled_challenges = ["password"]
+			}
+			`,
+			wantErr: `project "abc": unknown challenge in disabled_challenges: "password"`,
+		},
+		// 3: invalid agent_path_template
+		{
+			conf: `
+			project "abc" {
+				agent_path_template = "{{ .PluginName }}/{{ .ProjectID }}"
+			}
+			`,
+			wantErr: `project "abc": agent_path_template must render the whole instance ID, such as with {{ .InstanceID }}`,
+		},
+		// 4: re-attestation without a challenge
+		{
+			conf: `
+			metadata_challenge = {}
+			allow_reattestation = true
+			reattestation_state_path = "/tmp/openstack_iid_attestations.json"
+			project "abc" {
+				disabled_challenges = ["metadata_challenge"]
+			}
+			`,
+			wantErr: `project "abc": allow_reattestation requires metadata_challenge or keypair_challenge`,
+		},
+	} {
+		p := newTestPlugin()
+		p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, _ hclog.Logger) (openstack.InstanceClient, error) {
+			return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+		}
+
+		conf := `
+		cloud_name = "test"
+		projectid_allow_list = ["abc"]
+		` + tc.conf
+		_, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, conf))
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
+
+func TestAttestProjectOverride(t *testing.T) {
+	for i, tc := range []struct {
+		projectID string
+		wantSVs   []string
+	}{
+		// 0: project with a block
+		{
+			projectID: testProjectID,
+			wantSVs:   []string{"meta:env:prod"},
+		},
+		// 1: project without a block
+		{
+			projectID: "def",
+			wantSVs:   []string{"meta:role:web"},
+		},
+	} {
+		p := newTestPlugin()
+		p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, _ hclog.Logger) (openstack.InstanceClient, error) {
+			return fake_openstack.NewInstance(tc.projectID, map[string]string{"role": "web", "env": "prod"}, nil), nil
+		}
+		p.attestedBeforeHandler = notAttestedBeforeHandler
+
+		conf := `
+		cloud_name = "test"
+		projectid_allow_list = ["abc", "def"]
+		custom_metadata = {
+			keys = ["role"]
+		}
+		project "abc" {
+			custom_metadata = {
+				keys = ["env"]
+			}
+		}
+		`
+		if _, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, conf)); err != nil {
+			t.Fatalf("#%v: unexpected error from Configure(): %v", i, err)
+		}
+
+		fs := fake_server.NewAttestStream(newTestPayload(testUUID, &common.Evidence{
+			Name:             "bravo",
+			AvailabilityZone: "nova",
+			ProjectID:        tc.projectID,
+		}, time.Now()))
+		if err := p.Attest(fs); err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+			continue
+		}
+		if got := fs.AgentAttributes().SelectorValues; !reflect.DeepEqual(got, tc.wantSVs) {
+			t.Errorf("#%v: got %v, want %v", i, got, tc.wantSVs)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/projects"
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+const (
+	defaultProjectRulesRefresh = 10 * time.Minute
+)
+
+// ProjectRules allows the projects by their names, domains and parents in Keystone, in addition to
+// projectid_allow_list. The plugin lists the projects in Keystone, and resolves the rules into project IDs
+// when it is configured and then every refresh_interval in the background.
+type ProjectRules struct {
+	// Allow are the projects which are allowed.
+	Allow *ProjectMatcher `hcl:"allow"`
+	// Deny are the projects which are denied, even if they are allowed by Allow or projectid_allow_list.
+	Deny *ProjectMatcher `hcl:"deny"`
+	// RefreshInterval is the interval to list the projects again. Defaults to "10m".
+	RefreshInterval string `hcl:"refresh_interval"`
+
+	refresh time.Duration
+
+	mtx       sync.RWMutex
+	allowed   map[string]bool
+	denied    map[string]bool
+	fetchedAt time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// ProjectMatcher matches the projects.
+type ProjectMatcher struct {
+	// IDs are the project IDs.
+	IDs []string `hcl:"ids"`
+	// Names are the project names prefixed with the domain ID, such as "default/web". Project names are
+	// unique only in their domain, so the domain is required.
+	Names []string `hcl:"names"`
+	// DomainIDs are the IDs of the domains whose projects match.
+	DomainIDs []string `hcl:"domain_ids"`
+	// ParentIDs are the IDs of the projects whose descendants, and themselves, match.
+	ParentIDs []string `hcl:"parent_ids"`
+}
+
+// validate checks the configuration and sets the default values.
+func (r *ProjectRules) validate() error {
+	if r.Allow == nil && r.Deny == nil {
+		return errors.New("project_rules requires allow or deny")
+	}
+	for _, m := range []*ProjectMatcher{r.Allow, r.Deny} {
+		if err := m.validate(); err != nil {
+			return err
+		}
+	}
+	r.refresh = defaultProjectRulesRefresh
+	if r.RefreshInterval != "" {
+		d, err := time.ParseDuration(r.RefreshInterval)
+		if err != nil {
+			return fmt.Errorf("invalid project_rules.refresh_interval: %v", err)
+		}
+		if d <= 0 {
+			return errors.New("project_rules.refresh_interval must be positive")
+		}
+		r.refresh = d
+	}
+	return nil
+}
+
+func (m *ProjectMatcher) validate() error {
+	if m == nil {
+		return nil
+	}
+	for _, n := range m.Names {
+		// Domain IDs have no "/", while project names may.
+		if i := strings.Index(n, "/"); i <= 0 || i == len(n)-1 {
+			return fmt.Errorf("project_rules name must be DOMAIN_ID/NAME: %q", n)
+		}
+	}
+	return nil
+}
+
+// allows returns true if the project is allowed by the rules or the allow list, and is not denied.
+func (r *ProjectRules) allows(allowList []string, projectID string) bool {
+	if r.Deny != nil && contains(r.Deny.IDs, projectID) {
+		return false
+	}
+
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if r.denied[projectID] {
+		return false
+	}
+	return r.allowed[projectID] || isProjectAllowed(allowList, projectID)
+}
+
+// start refreshes the projects every refresh_interval until Close is called. If listing fails, the projects
+// resolved before are used.
+func (r *ProjectRules) start(identity openstack.IdentityClient, timeout time.Duration, logger hclog.Logger) {
+	r.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(r.refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			if err := r.refreshProjects(ctx, identity, logger); err != nil {
+				logger.Warn("Failed to refresh the projects of project_rules, using the projects resolved before", "error", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// Close stops refreshing the projects.
+func (r *ProjectRules) Close() {
+	r.stopOnce.Do(func() {
+		if r.stop != nil {
+			close(r.stop)
+		}
+	})
+}
+
+// refreshProjects lists the projects, resolves the rules into project IDs, and logs the changes.
+// Keystone is called without the lock, and the resolved projects are swapped in at once.
+func (r *ProjectRules) refreshProjects(ctx context.Context, identity openstack.IdentityClient, logger hclog.Logger) error {
+	ps, err := identity.ListProjects(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list projects: %w", err)
+	}
+
+	parents := make(map[string]string, len(ps))
+	for _, p := range ps {
+		parents[p.ID] = p.ParentID
+	}
+	allowed := make(map[string]bool)
+	denied := make(map[string]bool)
+	for _, p := range ps {
+		if r.Deny.matches(p, parents) {
+			denied[p.ID] = true
+		} else if r.Allow.matches(p, parents) {
+			allowed[p.ID] = true
+		}
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	added, removed := diffProjects(r.allowed, allowed), diffProjects(allowed, r.allowed)
+	switch {
+	case r.fetchedAt.IsZero():
+		logger.Info("Resolved the projects of project_rules", "allowed", added, "denied", diffProjects(nil, denied))
+	case len(added) > 0 || len(removed) > 0:
+		logger.Info("The projects of project_rules changed", "allowed", added, "no_longer_allowed", removed)
+	}
+
+	r.allowed = allowed
+	r.denied = denied
+	r.fetchedAt = time.Now()
+	return nil
+}
+
+// matches returns true if the project matches. parents maps the project IDs to their parent IDs.
+func (m *ProjectMatcher) matches(p projects.Project, parents map[string]string) bool {
+	if m == nil {
+		return false
+	}
+	if contains(m.IDs, p.ID) || contains(m.DomainIDs, p.DomainID) {
+		return true
+	}
+	for _, n := range m.Names {
+		if i := strings.Index(n, "/"); i >= 0 && n[:i] == p.DomainID && n[i+1:] == p.Name {
+			return true
+		}
+	}
+	if len(m.ParentIDs) > 0 {
+		// Walk up to the root, the length of the walk is limited in case the hierarchy has a cycle.
+		id := p.ID
+		for i := 0; id != "" && i <= len(parents); i++ {
+			if contains(m.ParentIDs, id) {
+				return true
+			}
+			id = parents[id]
+		}
+	}
+	return false
+}
+
+// diffProjects returns the sorted IDs which are in b but not in a.
+func diffProjects(a, b map[string]bool) []string {
+	var ids []string
+	for id := range b {
+		if !a[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,390 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/projects"
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+	"github.com/zlabjp/spire-openstack-plugin/pkg/testutil"
+	fake_common "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/common"
+	fake_openstack "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/openstack"
+	fake_server "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/server"
+)
+
+// testProjects is the hierarchy: default > team > (web, db), and other > web.
+var testProjects = []projects.Project{
+	{ID: "team", Name: "team", DomainID: "default", ParentID: "default"},
+	{ID: "web", Name: "web", DomainID: "default", ParentID: "team"},
+	{ID: "db", Name: "db", DomainID: "default", ParentID: "team"},
+	{ID: "other-web", Name: "web", DomainID: "other", ParentID: "other"},
+}
+
+func TestProjectMatcher(t *testing.T) {
+	parents := map[string]string{"team": "default", "web": "team", "db": "team", "other-web": "other", "loop-a": "loop-b", "loop-b": "loop-a"}
+	for i, tc := range []struct {
+		matcher *ProjectMatcher
+		project projects.Project
+		want    bool
+	}{
+		// 0: nil matches nothing
+		{matcher: nil, project: testProjects[0], want: false},
+		// 1: ID
+		{matcher: &ProjectMatcher{IDs: []string{"db"}}, project: testProjects[2], want: true},
+		// 2: name in another domain
+		{matcher: &ProjectMatcher{Names: []string{"other/web"}}, project: testProjects[3], want: true},
+		// 3: name in the domain
+		{matcher: &ProjectMatcher{Names: []string{"default/web"}}, project: testProjects[1], want: true},
+		// 4: name in another domain
+		{matcher: &ProjectMatcher{Names: []string{"default/web"}}, project: testProjects[3], want: false},
+		// 5: domain
+		{matcher: &ProjectMatcher{DomainIDs: []string{"other"}}, project: testProjects[3], want: true},
+		// 6: descendant of the parent
+		{matcher: &ProjectMatcher{ParentIDs: []string{"team"}}, project: testProjects[2], want: true},
+		// 7: parent itself
+		{matcher: &ProjectMatcher{ParentIDs: []string{"team"}}, project: testProjects[0], want: true},
+		// 8: not a descendant
+		{matcher: &ProjectMatcher{ParentIDs: []string{"team"}}, project: testProjects[3], want: false},
+		// 9: cycle in the hierarchy
+		{matcher: &ProjectMatcher{ParentIDs: []string{"team"}}, project: projects.Project{ID: "loop-a", ParentID: "loop-b"}, want: false},
+	} {
+		if got := tc.matcher.matches(tc.project, parents); got != tc.want {
+			t.Errorf("#%v: got %v, want %v", i, got, tc.want)
+		}
+	}
+}
+
+func TestProjectRulesAllows(t *testing.T) {
+	for i, tc := range []struct {
+		rules     *ProjectRules
+		allowList []string
+		projectID string
+		want      bool
+	}{
+		// 0: allowed by the parent
+		{
+			rules:     &ProjectRules{Allow: &ProjectMatcher{ParentIDs: []string{"team"}}},
+			projectID: "web",
+			want:      true,
+		},
+		// 1: not allowed
+		{
+			rules:     &ProjectRules{Allow: &ProjectMatcher{ParentIDs: []string{"team"}}},
+			projectID: "other-web",
+			want:      false,
+		},
+		// 2: allowed by the allow list
+		{
+			rules:     &ProjectRules{Allow: &ProjectMatcher{ParentIDs: []string{"team"}}},
+			allowList: []string{"other-web"},
+			projectID: "other-web",
+			want:      true,
+		},
+		// 3: deny takes precedence over allow
+		{
+			rules:     &ProjectRules{Allow: &ProjectMatcher{ParentIDs: []string{"team"}}, Deny: &ProjectMatcher{Names: []string{"default/db"}}},
+			projectID: "db",
+			want:      false,
+		},
+		// 4: deny takes precedence over the allow list
+		{
+			rules:     &ProjectRules{Deny: &ProjectMatcher{DomainIDs: []string{"other"}}},
+			allowList: []string{"other-web"},
+			projectID: "other-web",
+			want:      false,
+		},
+		// 5: denied by ID, even if the project is not listed
+		{
+			rules:     &ProjectRules{Deny: &ProjectMatcher{IDs: []string{"hidden"}}},
+			allowList: []string{"hidden"},
+			projectID: "hidden",
+			want:      false,
+		},
+	} {
+		if err := tc.rules.validate(); err != nil {
+			t.Fatalf("#%v: unexpected error from validate(): %v", i, err)
+		}
+		identity := fake_openstack.NewIdentity(testProjects...)
+		if err := tc.rules.refreshProjects(context.Background(), identity, testutil.TestLogger()); err != nil {
+			t.Fatalf("#%v: unexpected error from refreshProjects(): %v", i, err)
+		}
+
+		if got := tc.rules.allows(tc.allowList, tc.projectID); got != tc.want {
+			t.Errorf("#%v: got %v, want %v", i, got, tc.want)
+		}
+	}
+}
+
+func TestProjectRulesRefresh(t *testing.T) {
+	rules := &ProjectRules{Allow: &ProjectMatcher{ParentIDs: []string{"team"}}, RefreshInterval: "10ms"}
+	if err := rules.validate(); err != nil {
+		t.Fatalf("unexpected error from validate(): %v", err)
+	}
+	identity := &syncIdentity{Identity: fake_openstack.NewIdentity(testProjects...)}
+	logger := testutil.TestLogger()
+
+	if err := rules.refreshProjects(context.Background(), identity, logger); err != nil {
+		t.Fatalf("unexpected error from refreshProjects(): %v", err)
+	}
+	rules.start(identity, time.Second, logger)
+	defer rules.Close()
+
+	// A new sub-project is found by the background refresh.
+	identity.setProjects(append(testProjects, projects.Project{ID: "cache", Name: "cache", DomainID: "default", ParentID: "team"}), nil)
+	if !waitAllowed(rules, "cache", true) {
+		t.Error("new project is not allowed after the refresh")
+	}
+
+	// The projects resolved before are used while Keystone fails.
+	identity.setProjects(nil, errors.New("keystone is down"))
+	time.Sleep(50 * time.Millisecond)
+	if !rules.allows(nil, "web") {
+		t.Error("project is not allowed after the refresh failed")
+	}
+
+	// A removed project is no longer allowed.
+	identity.setProjects(testProjects, nil)
+	if !waitAllowed(rules, "cache", false) {
+		t.Error("removed project is still allowed after the refresh")
+	}
+}
+
+// waitAllowed waits until the project is allowed, or not allowed, by the background refresh.
+func waitAllowed(rules *ProjectRules, projectID string, want bool) bool {
+	for i := 0; i < 100; i++ {
+		if rules.allows(nil, projectID) == want {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// syncIdentity lets the tests change the projects while they are listed in the background.
+type syncIdentity struct {
+	*fake_openstack.Identity
+	mtx sync.Mutex
+}
+
+func (i *syncIdentity) setProjects(ps []projects.Project, err error) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	i.Projects = ps
+	i.ListProjectsError = err
+}
+
+func (i *syncIdentity) ListProjects(ctx context.Context) ([]projects.Project, error) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	return i.Identity.ListProjects(ctx)
+}
+
+func TestConfigureProjectRulesStop(t *testing.T) {
+	p := newTestPlugin()
+	p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, _ hclog.Logger) (openstack.InstanceClient, error) {
+		return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+	}
+	p.getIdentityHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, _ hclog.Logger) (openstack.IdentityClient, error) {
+		return fake_openstack.NewIdentity(), nil
+	}
+	conf := `
+	cloud_name = "test"
+	project_rules = {
+		allow = {
+			ids = ["abc"]
+		}
+	}
+	`
+	if _, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, conf)); err != nil {
+		t.Fatalf("unexpected error from Configure(): %v", err)
+	}
+	rules := p.config.clouds[""].ProjectRules
+
+	// Reconfiguring stops the refresh of the previous configuration.
+	if _, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, conf)); err != nil {
+		t.Fatalf("unexpected error from Configure(): %v", err)
+	}
+	select {
+	case <-rules.stop:
+	default:
+		t.Error("refresh of the previous configuration is not stopped")
+	}
+	p.config.clouds[""].ProjectRules.Close()
+}
+
+func TestConfigureProjectRulesError(t *testing.T) {
+	for i, tc := range []struct {
+		conf    string
+		wantErr string
+	}{
+		// 0: neither allow nor deny
+		{
+			conf: `
+			cloud_name = "test"
+			projectid_allow_list = ["abc"]
+			project_rules = {}
+			`,
+			wantErr: "project_rules requires allow or deny",
+		},
+		// 1: deny only without the allow list
+		{
+			conf: `
+			cloud_name = "test"
+			project_rules = {
+				deny = {
+					names = ["default/db"]
+				}
+			}
+			`,
+			wantErr: "project_rules.allow is required without projectid_allow_list",
+		},
+		// 2: with project_credential
+		{
+			conf: `
+			project_credential "abc" {
+				cloud_name = "abc"
+			}
+			project_rules = {
+				allow = {
+					names = ["default/web"]
+				}
+			}
+			`,
+			wantErr: "project_rules can't be combined with project_credential",
+		},
+		// 3: top level with the cloud blocks
+		{
+			conf: `
+			project_rules = {
+				allow = {
+					names = ["default/web"]
+				}
+			}
+			cloud "east" {
+				cloud_name = "east"
+				projectid_allow_list = ["abc"]
+			}
+			`,
+			wantErr: "project_rules must be given in the cloud blocks",
+		},
+		// 4: invalid refresh_interval
+		{
+			conf: `
+			cloud_name = "test"
+			project_rules = {
+				allow = {
+					names = ["default/web"]
+				}
+				refresh_interval = "often"
+			}
+			`,
+			wantErr: `invalid project_rules.refresh_interval: time: invalid duration "often"`,
+		},
+		// 5: name without the domain
+		{
+			conf: `
+			cloud_name = "test"
+			project_rules = {
+				allow = {
+					names = ["web"]
+				}
+			}
+			`,
+			wantErr: `project_rules name must be DOMAIN_ID/NAME: "web"`,
+		},
+		// 6: Keystone fails
+		{
+			conf: `
+			cloud "east" {
+				cloud_name = "east"
+				project_rules = {
+					allow = {
+						names = ["default/web"]
+					}
+				}
+			}
+			`,
+			wantErr: `failed to resolve project_rules for cloud "east": failed to list projects: keystone is down`,
+		},
+	} {
+		p := newTestPlugin()
+		p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, _ hclog.Logger) (openstack.InstanceClient, error) {
+			return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+		}
+		p.getIdentityHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, _ hclog.Logger) (openstack.IdentityClient, error) {
+			identity := fake_openstack.NewIdentity()
+			identity.ListProjectsError = errors.New("keystone is down")
+			return identity, nil
+		}
+
+		_, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, tc.conf))
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
+
+func TestAttestProjectRules(t *testing.T) {
+	for i, tc := range []struct {
+		rules   string
+		wantErr string
+	}{
+		// 0: allowed by name
+		{
+			rules: `
+			allow = {
+				names = ["default/alpha"]
+			}
+			`,
+		},
+		// 1: denied by domain
+		{
+			rules: `
+			allow = {
+				names = ["default/alpha"]
+			}
+			deny = {
+				domain_ids = ["default"]
+			}
+			`,
+			wantErr: "invalid attestation request",
+		},
+	} {
+		p := newTestPlugin()
+		p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, _ hclog.Logger) (openstack.InstanceClient, error) {
+			return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+		}
+		p.getIdentityHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, _ hclog.Logger) (openstack.IdentityClient, error) {
+			return fake_openstack.NewIdentity(projects.Project{ID: testProjectID, Name: "alpha", DomainID: "default"}), nil
+		}
+		p.attestedBeforeHandler = notAttestedBeforeHandler
+
+		conf := `
+		cloud_name = "test"
+		project_rules = {` + tc.rules + `}
+		`
+		if _, err := p.Configure(context.Background(), fake_common.NewConfigureRequest(globalConfig, conf)); err != nil {
+			t.Fatalf("#%v: unexpected error from Configure(): %v", i, err)
+		}
+
+		err := p.Attest(fake_server.NewAttestStream(testPayload))
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("#%v: unexpected error: %v", i, err)
+		case tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr):
+			t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+// attestationRecord is what the plugin saw when it attested the instance last time.
+type attestationRecord struct {
+	ImageID    string    `json:"image_id"`
+	Updated    time.Time `json:"updated"`
+	AttestedAt time.Time `json:"attested_at"`
+}
+
+// attestationStore keeps the attestation records in a JSON file, keyed by the instance UUID.
+type attestationStore struct {
+	path string
+	mtx  sync.Mutex
+}
+
+func newAttestationStore(path string) *attestationStore {
+	return &attestationStore{
+		path: path,
+	}
+}
+
+// get returns the record of given instance, or nil if the instance has no record.
+func (s *attestationStore) get(uuid string) (*attestationRecord, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return records[uuid], nil
+}
+
+// put saves the record of given instance.
+func (s *attestationStore) put(uuid string, record *attestationRecord) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	records, err := s.load()
+	if err != nil {
+		return err
+	}
+	records[uuid] = record
+
+	b, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("failed to marshal attestation records: %v", err)
+	}
+	// Write to a temporary file and rename it, so that a crash doesn't leave a broken file.
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save attestation records: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save attestation records: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save attestation records: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to save attestation records: %v", err)
+	}
+	return nil
+}
+
+func (s *attestationStore) load() (map[string]*attestationRecord, error) {
+	records := make(map[string]*attestationRecord)
+	b, err := ioutil.ReadFile(s.path)
+	switch {
+	case os.IsNotExist(err):
+		return records, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read attestation records: %v", err)
+	}
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal attestation records: %v", err)
+	}
+	return records, nil
+}
+
+// checkReattestation returns an error if the instance may have been rebuilt since the last attestation.
+func (p *IIDAttestorPlugin) checkReattestation(s *openstack.Server, cloudID string, store *attestationStore) error {
+	record, err := store.get(attestationKey(cloudID, s.ID))
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("IID has already been used to attest an agent, and has no attestation record: %v", s.ID)
+	}
+
+	if imageID := s.ImageID(); imageID != record.ImageID {
+		return fmt.Errorf("instance image changed since the last attestation: got %q, want %q", imageID, record.ImageID)
+	}
+	if !s.Updated.Equal(record.Updated) {
+		return fmt.Errorf("instance was updated at %v after the last attestation", s.Updated.Format(time.RFC3339))
+	}
+
+	p.logger.Info("Re-attesting instance", "uuid", s.ID, "last_attested_at", record.AttestedAt)
+
+	return nil
+}
+
+// recordAttestation saves what the plugin sees now, to check re-attestation of the instance later.
+// The instance is retrieved again, since the challenges may have updated it.
+func (p *IIDAttestorPlugin) recordAttestation(ctx context.Context, instance openstack.InstanceClient, cloudID, uuid string, store *attestationStore) error {
+	s, err := instance.Get(ctx, uuid)
+	if err != nil {
+		return fmt.Errorf("failed to get instance information: %w", err)
+	}
+	return store.put(attestationKey(cloudID, uuid), &attestationRecord{
+		ImageID:    s.ImageID(),
+		Updated:    s.Updated,
+		AttestedAt: time.Now(),
+	})
+}
+
+// attestationKey returns the key of the attestation record of the instance. The records of the instances
+// without a cloud are keyed by their UUIDs, as before the clouds were introduced.
+func attestationKey(cloudID, uuid string) string {
+	if cloudID == "" {
+		return uuid
+	}
+	return cloudID + "/" + uuid
+}
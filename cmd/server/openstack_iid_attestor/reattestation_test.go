@@ -0,0 +1,156 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+	fake_common "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/common"
+	fake_openstack "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/openstack"
+	fake_server "github.com/zlabjp/spire-openstack-plugin/pkg/testutil/fake/server"
+)
+
+// reattestationConfig allows re-attestation with the metadata challenge, keeping the records in a temporary directory.
+func reattestationConfig(t *testing.T) func(*IIDAttestorPluginConfig) {
+	return func(c *IIDAttestorPluginConfig) {
+		c.MetadataChallenge = &MetadataChallenge{Key: defaultMetadataChallengeKey}
+		c.AllowReattestation = true
+		c.attestations = newAttestationStore(filepath.Join(t.TempDir(), "attestations.json"))
+	}
+}
+
+// attest runs the attestation with the metadata challenge, and returns the SPIFFE ID.
+func attest(p *IIDAttestorPlugin, fi *fake_openstack.Instance) (string, error) {
+	fs := fake_server.NewAttestStream(testPayload)
+	fs.ChallengeHandler = metadataChallengeHandler(fi)
+	if err := p.Attest(fs); err != nil {
+		return "", err
+	}
+	return fs.AgentAttributes().SpiffeId, nil
+}
+
+func TestAttestReattestation(t *testing.T) {
+	for i, tc := range []struct {
+		modify  func(*fake_openstack.Instance)
+		noFirst bool
+		wantErr string
+	}{
+		// 0: unchanged instance
+		{},
+		// 1: rebuilt with another image
+		{
+			modify:  func(fi *fake_openstack.Instance) { fi.ImageID = "bravo" },
+			wantErr: `instance image changed since the last attestation: got "bravo", want "alpha"`,
+		},
+		// 2: updated by someone else
+		{
+			modify:  func(fi *fake_openstack.Instance) { fi.Updated = fi.Updated.Add(time.Minute) },
+			wantErr: "instance was updated at",
+		},
+		// 3: attested before the record was kept
+		{
+			noFirst: true,
+			wantErr: "IID has already been used to attest an agent, and has no attestation record: " + testUUID,
+		},
+	} {
+		fi := fake_openstack.NewInstance(testProjectID, nil, nil)
+		fi.ImageID = "alpha"
+		p := newAttestTestPlugin(fi, reattestationConfig(t))
+
+		var first string
+		if !tc.noFirst {
+			id, err := attest(p, fi)
+			if err != nil {
+				t.Fatalf("#%v: Attestation error: %v", i, err)
+			}
+			first = id
+		}
+		if tc.modify != nil {
+			tc.modify(fi)
+		}
+
+		p.attestedBeforeHandler = onceAttestedBeforeHandler
+		second, err := attest(p, fi)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("#%v: Re-attestation error: %v", i, err)
+		case tc.wantErr == "" && second != first:
+			t.Errorf("#%v: got SPIFFE ID %v on re-attestation, want %v", i, second, first)
+		case tc.wantErr != "" && err == nil:
+			t.Errorf("#%v: expected an error, got nil", i)
+		case tc.wantErr != "" && !strings.HasPrefix(err.Error(), tc.wantErr):
+			t.Errorf("#%v: got %v, want %v", i, err, tc.wantErr)
+		}
+		if tc.wantErr != "" {
+			continue
+		}
+
+		// The instance can be re-attested repeatedly.
+		if _, err := attest(p, fi); err != nil {
+			t.Errorf("#%v: Re-attestation error: %v", i, err)
+		}
+	}
+}
+
+func TestConfigureReattestation(t *testing.T) {
+	for i, tc := range []struct {
+		conf    string
+		wantErr string
+	}{
+		// 0: normal case
+		{
+			conf: `
+	projectid_allow_list = ["alpha"]
+	allow_reattestation = true
+	reattestation_state_path = "/tmp/attestations.json"
+	keypair_challenge = {}
+	`,
+		},
+		// 1: no challenge
+		{
+			conf: `
+	projectid_allow_list = ["alpha"]
+	allow_reattestation = true
+	reattestation_state_path = "/tmp/attestations.json"
+	`,
+			wantErr: "allow_reattestation requires metadata_challenge or keypair_challenge",
+		},
+		// 2: no state path
+		{
+			conf: `
+	projectid_allow_list = ["alpha"]
+	allow_reattestation = true
+	metadata_challenge = {}
+	`,
+			wantErr: "reattestation_state_path is required to allow re-attestation",
+		},
+	} {
+		p := newTestPlugin()
+		p.getInstanceHandler = func(_ context.Context, _ *Cloud, _ openstack.AuthOptions, logger hclog.Logger) (openstack.InstanceClient, error) {
+			return fake_openstack.NewInstance(testProjectID, nil, nil), nil
+		}
+
+		req := fake_common.NewConfigureRequest(globalConfig, tc.conf)
+		_, err := p.Configure(context.Background(), req)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("#%v: unexpected error from Configure(): %v", i, err)
+		case tc.wantErr != "" && err == nil:
+			t.Errorf("#%v: expected an error, got nil", i)
+		case tc.wantErr != "" && err.Error() != tc.wantErr:
+			t.Errorf("#%v: got %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLS configures TLS of the connections to Keystone, Nova and the other OpenStack API endpoints.
+type TLS struct {
+	// CAFile is the path to the PEM encoded CA bundle to verify the endpoints with, instead of the system roots.
+	CAFile string `hcl:"ca_file"`
+	// CertFile and KeyFile are the paths to the PEM encoded client certificate and its private key.
+	CertFile string `hcl:"cert_file"`
+	KeyFile  string `hcl:"key_file"`
+	// ServerName overrides the server name to verify the certificates of the endpoints with.
+	ServerName string `hcl:"server_name"`
+	// MinVersion is the minimum TLS version, "1.0", "1.1", "1.2" or "1.3".
+	MinVersion string `hcl:"min_version"`
+}
+
+// options returns the TLS options of the OpenStack client from the configuration.
+func (c *TLS) options() (openstack.TLSOptions, error) {
+	if c == nil {
+		return openstack.TLSOptions{}, nil
+	}
+
+	opts := openstack.TLSOptions{
+		CAFile:     c.CAFile,
+		CertFile:   c.CertFile,
+		KeyFile:    c.KeyFile,
+		ServerName: c.ServerName,
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return opts, errors.New("tls.cert_file and tls.key_file must be given together")
+	}
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return opts, fmt.Errorf("invalid tls.min_version %q, must be 1.0, 1.1, 1.2 or 1.3", c.MinVersion)
+		}
+		opts.MinVersion = v
+	}
+	return opts, nil
+}
@@ -0,0 +1,69 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+func TestTLSOptions(t *testing.T) {
+	for i, tc := range []struct {
+		config  *TLS
+		want    openstack.TLSOptions
+		wantErr string
+	}{
+		// 0: not configured
+		{},
+		// 1: all options
+		{
+			config: &TLS{
+				CAFile:     "/etc/spire/server/openstack-ca.pem",
+				CertFile:   "/etc/spire/server/openstack-client.pem",
+				KeyFile:    "/etc/spire/server/openstack-client-key.pem",
+				ServerName: "openstack.example.com",
+				MinVersion: "1.2",
+			},
+			want: openstack.TLSOptions{
+				CAFile:     "/etc/spire/server/openstack-ca.pem",
+				CertFile:   "/etc/spire/server/openstack-client.pem",
+				KeyFile:    "/etc/spire/server/openstack-client-key.pem",
+				ServerName: "openstack.example.com",
+				MinVersion: tls.VersionTLS12,
+			},
+		},
+		// 2: certificate without key
+		{
+			config:  &TLS{CertFile: "/etc/spire/server/openstack-client.pem"},
+			wantErr: "tls.cert_file and tls.key_file must be given together",
+		},
+		// 3: invalid version
+		{
+			config:  &TLS{MinVersion: "1.4"},
+			wantErr: `invalid tls.min_version "1.4", must be 1.0, 1.1, 1.2 or 1.3`,
+		},
+	} {
+		got, err := tc.config.options()
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("#%v: got %+v, want %+v", i, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+// keySet holds the key which signs identity documents, and the public keys which are published
+// so that documents signed with previous or upcoming keys can also be verified.
+type keySet struct {
+	signer jose.Signer
+	jwks   jose.JSONWebKeySet
+}
+
+// loadKeySet loads PEM encoded private keys from given paths.
+// The first key signs identity documents, and all of them are published in the key set.
+func loadKeySet(paths []string) (*keySet, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("at least one key is required")
+	}
+
+	ks := &keySet{}
+	for i, path := range paths {
+		key, err := loadPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+
+		pub := jose.JSONWebKey{Key: key.Public(), Use: "sig"}
+		alg, err := signatureAlgorithm(key)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported key %s: %v", path, err)
+		}
+		pub.Algorithm = string(alg)
+		kid, err := openstack.KeyID(pub)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute key id of %s: %v", path, err)
+		}
+		pub.KeyID = kid
+		ks.jwks.Keys = append(ks.jwks.Keys, pub)
+
+		if i == 0 {
+			signer, err := jose.NewSigner(jose.SigningKey{
+				Algorithm: alg,
+				Key:       jose.JSONWebKey{Key: key, KeyID: kid},
+			}, (&jose.SignerOptions{}).WithType("JWT"))
+			if err != nil {
+				return nil, fmt.Errorf("failed to create signer with %s: %v", path, err)
+			}
+			ks.signer = signer
+		}
+	}
+
+	return ks, nil
+}
+
+// loadPrivateKey loads a PEM encoded PKCS#8, PKCS#1 or SEC 1 private key.
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %v", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("key %s is not PEM encoded", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key %s: %v", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key %s can't be used for signing", path)
+	}
+	return signer, nil
+}
+
+// signatureAlgorithm returns the JWS algorithm which suits given key.
+func signatureAlgorithm(key crypto.Signer) (jose.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+		return "", fmt.Errorf("curve %s is not supported", k.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return jose.EdDSA, nil
+	}
+	return "", fmt.Errorf("key type %T is not supported", key)
+}
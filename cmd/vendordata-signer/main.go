@@ -0,0 +1,294 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+// vendordata-signer is a Nova DynamicJSON vendordata service which issues signed instance identity
+// documents for the openstack_iid node attestor.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+const (
+	defaultListenAddress = ":8080"
+	defaultTTL           = 10 * time.Minute
+
+	vendorDataPath = "/vendordata"
+	jwksPath       = "/jwks.json"
+
+	authTokenHeader = "X-Auth-Token"
+	maxRequestSize  = 1 << 20
+)
+
+// Signer issues identity documents in reply to the vendordata requests from Nova.
+type Signer struct {
+	logger hclog.Logger
+
+	issuer   string
+	audience string
+	ttl      time.Duration
+	keyPaths []string
+
+	// If tokenClient is not nil, requests must carry a valid Keystone token, which Nova sends
+	// when [vendordata_dynamic_auth] is configured. The token must be issued to requiredUser
+	// and have requiredRole.
+	tokenClient  openstack.TokenClient
+	requiredUser string
+	requiredRole string
+
+	keys *keySet
+	mtx  *sync.RWMutex
+
+	now func() time.Time
+}
+
+func newSigner(logger hclog.Logger, keyPaths []string) *Signer {
+	return &Signer{
+		logger:   logger,
+		ttl:      defaultTTL,
+		keyPaths: keyPaths,
+		mtx:      &sync.RWMutex{},
+		now:      time.Now,
+	}
+}
+
+// loadKeys (re)loads the keys from disk.
+func (s *Signer) loadKeys() error {
+	keys, err := loadKeySet(s.keyPaths)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	s.keys = keys
+	s.mtx.Unlock()
+
+	s.logger.Info("Loaded keys", "signing_key", keys.jwks.Keys[0].KeyID, "keys", len(keys.jwks.Keys))
+	return nil
+}
+
+func (s *Signer) getKeys() *keySet {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.keys
+}
+
+func (s *Signer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(vendorDataPath, s.handleVendorData)
+	mux.HandleFunc(jwksPath, s.handleJWKS)
+	return mux
+}
+
+// handleVendorData serves the identity document of the instance described by the request.
+func (s *Signer) handleVendorData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.authorize(r); err != nil {
+		s.logger.Warn("Rejected unauthorized request", "remote", r.RemoteAddr, "error", err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	req := &openstack.VendorDataRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(req); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.InstanceID == "" || req.ProjectID == "" {
+		http.Error(w, "instance-id and project-id are required", http.StatusBadRequest)
+		return
+	}
+
+	doc := openstack.NewIdentityDocument(req, s.issuer, s.audience, s.now(), s.ttl)
+	token, err := openstack.SignIdentityDocument(doc, s.getKeys().signer)
+	if err != nil {
+		s.logger.Error("Failed to sign identity document", "instance_id", req.InstanceID, "error", err)
+		http.Error(w, "failed to sign identity document", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("Issued identity document", "instance_id", req.InstanceID, "project_id", req.ProjectID)
+
+	writeJSON(w, &openstack.IdentityDocumentVendorData{
+		IdentityDocument: token,
+	})
+}
+
+// handleJWKS serves the public keys which identity documents are verified with.
+func (s *Signer) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.getKeys().jwks)
+}
+
+// authorize validates the Keystone token of the request, if required.
+func (s *Signer) authorize(r *http.Request) error {
+	if s.tokenClient == nil {
+		return nil
+	}
+
+	token := r.Header.Get(authTokenHeader)
+	if token == "" {
+		return errors.New("no token")
+	}
+	info, err := s.tokenClient.Validate(r.Context(), token)
+	if err != nil {
+		return fmt.Errorf("invalid token: %v", err)
+	}
+	if !info.ExpiresAt.After(s.now()) {
+		return errors.New("token has expired")
+	}
+	if info.UserID != s.requiredUser && info.UserName != s.requiredUser {
+		return fmt.Errorf("token is issued to user %q (%s), not %q", info.UserName, info.UserID, s.requiredUser)
+	}
+	for _, role := range info.Roles {
+		if role == s.requiredRole {
+			return nil
+		}
+	}
+	return fmt.Errorf("token doesn't have role %q", s.requiredRole)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// stringList is a flag which can be given multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+type config struct {
+	listenAddress  string
+	issuer         string
+	audience       string
+	ttl            time.Duration
+	keyPaths       stringList
+	cloudName      string
+	requiredUser   string
+	requiredRole   string
+	insecureNoAuth bool
+	tlsCert        string
+	tlsKey         string
+}
+
+func main() {
+	c := &config{}
+	flag.StringVar(&c.listenAddress, "listen-address", defaultListenAddress, "address to listen on")
+	flag.StringVar(&c.issuer, "issuer", "", "issuer (iss) of identity documents")
+	flag.StringVar(&c.audience, "audience", "", "audience (aud) of identity documents, which the server plugin expects")
+	flag.DurationVar(&c.ttl, "ttl", defaultTTL, "lifetime of identity documents")
+	flag.Var(&c.keyPaths, "key", "PEM encoded private key file. The first key signs identity documents, and all keys are published. Can be given multiple times")
+	flag.StringVar(&c.cloudName, "cloud-name", "", "name of cloud entry in clouds.yaml, used to validate Keystone tokens sent by Nova")
+	flag.StringVar(&c.requiredUser, "required-user", "", "name or ID of the user which Keystone tokens sent by Nova must be issued to, such as nova")
+	flag.StringVar(&c.requiredRole, "required-role", "", "role which Keystone tokens sent by Nova must have, such as service")
+	flag.BoolVar(&c.insecureNoAuth, "insecure-no-auth", false, "serve requests without authentication. Anyone who can reach this service can get identity documents")
+	flag.StringVar(&c.tlsCert, "tls-cert", "", "TLS certificate file")
+	flag.StringVar(&c.tlsKey, "tls-key", "", "TLS private key file")
+	flag.Parse()
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name: "vendordata-signer",
+	})
+
+	if err := run(logger, c); err != nil {
+		logger.Error("Exiting", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(logger hclog.Logger, c *config) error {
+	if c.audience == "" {
+		return errors.New("-audience is required")
+	}
+	switch {
+	case c.cloudName == "" && !c.insecureNoAuth:
+		return errors.New("-cloud-name is required to authenticate requests, or give -insecure-no-auth to serve without authentication")
+	case c.cloudName != "" && c.insecureNoAuth:
+		return errors.New("-cloud-name and -insecure-no-auth are exclusive")
+	case c.cloudName != "" && (c.requiredUser == "" || c.requiredRole == ""):
+		return errors.New("-required-user and -required-role are required with -cloud-name")
+	}
+
+	s := newSigner(logger, c.keyPaths)
+	s.issuer = c.issuer
+	s.audience = c.audience
+	s.ttl = c.ttl
+	s.requiredUser = c.requiredUser
+	s.requiredRole = c.requiredRole
+
+	if err := s.loadKeys(); err != nil {
+		return err
+	}
+
+	if c.cloudName != "" {
+		provider, err := openstack.NewProvider(openstack.AuthOptions{CloudName: c.cloudName}, openstack.DefaultProviderOptions())
+		if err != nil {
+			return fmt.Errorf("failed to prepare OpenStack Client: %v", err)
+		}
+		tc, err := openstack.NewToken(provider, logger)
+		if err != nil {
+			return fmt.Errorf("failed to prepare OpenStack Client: %v", err)
+		}
+		s.tokenClient = tc
+	} else {
+		logger.Warn("-insecure-no-auth is given, requests are not authenticated. Make sure only Nova can reach this service")
+	}
+
+	// Reload the keys on SIGHUP, to rotate them without downtime.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := s.loadKeys(); err != nil {
+				logger.Error("Failed to reload keys", "error", err)
+			}
+		}
+	}()
+
+	server := &http.Server{
+		Addr:              c.listenAddress,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	logger.Info("Serving vendordata", "address", c.listenAddress)
+	if c.tlsCert != "" || c.tlsKey != "" {
+		return server.ListenAndServeTLS(c.tlsCert, c.tlsKey)
+	}
+	return server.ListenAndServe()
+}
@@ -0,0 +1,312 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+	"github.com/zlabjp/spire-openstack-plugin/pkg/testutil"
+)
+
+const (
+	testAudience = "spire-server"
+)
+
+var (
+	vendorDataRequest = &openstack.VendorDataRequest{
+		ProjectID:  "alpha",
+		InstanceID: "bravo",
+		ImageID:    "charlie",
+		Hostname:   "delta",
+	}
+)
+
+type fakeTokenClient struct {
+	tokens map[string]*openstack.TokenInfo
+}
+
+func (f *fakeTokenClient) Validate(_ context.Context, token string) (*openstack.TokenInfo, error) {
+	info, ok := f.tokens[token]
+	if !ok {
+		return nil, errors.New("token not found")
+	}
+	return info, nil
+}
+
+func writeECKey(t *testing.T, dir, name string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	return writePEM(t, dir, name, "EC PRIVATE KEY", der)
+}
+
+func writeRSAKey(t *testing.T, dir, name string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	return writePEM(t, dir, name, "PRIVATE KEY", der)
+}
+
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return path
+}
+
+func newTestSigner(t *testing.T, keyPaths ...string) (*Signer, *httptest.Server) {
+	s := newSigner(testutil.TestLogger(), keyPaths)
+	s.audience = testAudience
+	if err := s.loadKeys(); err != nil {
+		t.Fatalf("unexpected error from loadKeys(): %v", err)
+	}
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// postVendorData sends the vendordata request as Nova does.
+func postVendorData(t *testing.T, url, token string, req *openstack.VendorDataRequest) *http.Response {
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("failed to marshal request: %v", err)
+	}
+	r, err := http.NewRequest(http.MethodPost, url+vendorDataPath, bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set(authTokenHeader, token)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("failed to post vendordata request: %v", err)
+	}
+	return resp
+}
+
+func readIdentityDocument(t *testing.T, resp *http.Response) string {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+	vd := &openstack.IdentityDocumentVendorData{}
+	if err := json.NewDecoder(resp.Body).Decode(vd); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return vd.IdentityDocument
+}
+
+func TestVendorData(t *testing.T) {
+	dir := t.TempDir()
+	_, ts := newTestSigner(t, writeECKey(t, dir, "ec.pem"))
+
+	token := readIdentityDocument(t, postVendorData(t, ts.URL, "", vendorDataRequest))
+
+	keys, err := openstack.FetchJWKS(http.DefaultClient, ts.URL+jwksPath)
+	if err != nil {
+		t.Fatalf("unexpected error from FetchJWKS(): %v", err)
+	}
+	doc, err := openstack.VerifyIdentityDocument(token, keys, testAudience, time.Minute, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error from VerifyIdentityDocument(): %v", err)
+	}
+	if doc.InstanceID != "bravo" || doc.ProjectID != "alpha" || doc.ImageID != "charlie" || doc.Hostname != "delta" {
+		t.Errorf("unexpected identity document: %+v", doc)
+	}
+	if doc.Expiry.Time().Sub(doc.IssuedAt.Time()) != defaultTTL {
+		t.Errorf("unexpected lifetime of identity document: %+v", doc)
+	}
+}
+
+func TestVendorDataKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	newKey := writeRSAKey(t, dir, "new.pem")
+	oldKey := writeECKey(t, dir, "old.pem")
+	s, ts := newTestSigner(t, newKey, oldKey)
+
+	keys, err := openstack.FetchJWKS(http.DefaultClient, ts.URL+jwksPath)
+	if err != nil {
+		t.Fatalf("unexpected error from FetchJWKS(): %v", err)
+	}
+	if len(keys.Keys) != 2 {
+		t.Fatalf("got %v keys, want 2", len(keys.Keys))
+	}
+
+	token := readIdentityDocument(t, postVendorData(t, ts.URL, "", vendorDataRequest))
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		t.Fatalf("failed to parse identity document: %v", err)
+	}
+	if kid := tok.Headers[0].KeyID; kid != keys.Keys[0].KeyID {
+		t.Errorf("identity document is signed with %v, want %v", kid, keys.Keys[0].KeyID)
+	}
+	if _, err := openstack.VerifyIdentityDocument(token, keys, testAudience, 0, time.Now()); err != nil {
+		t.Errorf("unexpected error from VerifyIdentityDocument(): %v", err)
+	}
+
+	// Retire the old key.
+	s.keyPaths = []string{newKey}
+	if err := s.loadKeys(); err != nil {
+		t.Fatalf("unexpected error from loadKeys(): %v", err)
+	}
+	keys, err = openstack.FetchJWKS(http.DefaultClient, ts.URL+jwksPath)
+	if err != nil {
+		t.Fatalf("unexpected error from FetchJWKS(): %v", err)
+	}
+	if len(keys.Keys) != 1 {
+		t.Errorf("got %v keys, want 1", len(keys.Keys))
+	}
+}
+
+func TestVendorDataAuthorization(t *testing.T) {
+	dir := t.TempDir()
+	s, ts := newTestSigner(t, writeECKey(t, dir, "ec.pem"))
+	expiresAt := time.Now().Add(time.Hour)
+	s.tokenClient = &fakeTokenClient{
+		tokens: map[string]*openstack.TokenInfo{
+			"nova-token":    {UserID: "n0va", UserName: "nova", Roles: []string{"service"}, ExpiresAt: expiresAt},
+			"nova-id-token": {UserID: "n0va", UserName: "compute", Roles: []string{"admin", "service"}, ExpiresAt: expiresAt},
+			"member-token":  {UserID: "n0va", UserName: "nova", Roles: []string{"member"}, ExpiresAt: expiresAt},
+			"cinder-token":  {UserID: "c1nder", UserName: "cinder", Roles: []string{"service"}, ExpiresAt: expiresAt},
+			"expired-token": {UserID: "n0va", UserName: "nova", Roles: []string{"service"}, ExpiresAt: time.Now().Add(-time.Minute)},
+		},
+	}
+	s.requiredUser = "nova"
+	s.requiredRole = "service"
+
+	for i, tc := range []struct {
+		token string
+		want  int
+	}{
+		// 0: valid token with the required role
+		{token: "nova-token", want: http.StatusOK},
+		// 1: no token
+		{token: "", want: http.StatusUnauthorized},
+		// 2: invalid token
+		{token: "invalid-token", want: http.StatusUnauthorized},
+		// 3: token without the required role
+		{token: "member-token", want: http.StatusUnauthorized},
+		// 4: token of another service user with the required role
+		{token: "cinder-token", want: http.StatusUnauthorized},
+		// 5: expired token
+		{token: "expired-token", want: http.StatusUnauthorized},
+	} {
+		resp := postVendorData(t, ts.URL, tc.token, vendorDataRequest)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("#%v: got status %v, want %v", i, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestRunConfigError(t *testing.T) {
+	for i, tc := range []struct {
+		config  *config
+		wantErr string
+	}{
+		// 0: no audience
+		{
+			config:  &config{cloudName: "test", requiredUser: "nova", requiredRole: "service"},
+			wantErr: "-audience is required",
+		},
+		// 1: no authentication
+		{
+			config:  &config{audience: testAudience},
+			wantErr: "-cloud-name is required to authenticate requests, or give -insecure-no-auth to serve without authentication",
+		},
+		// 2: authentication and -insecure-no-auth
+		{
+			config:  &config{audience: testAudience, cloudName: "test", insecureNoAuth: true},
+			wantErr: "-cloud-name and -insecure-no-auth are exclusive",
+		},
+		// 3: no role
+		{
+			config:  &config{audience: testAudience, cloudName: "test", requiredUser: "nova"},
+			wantErr: "-required-user and -required-role are required with -cloud-name",
+		},
+		// 4: no user
+		{
+			config:  &config{audience: testAudience, cloudName: "test", requiredRole: "service"},
+			wantErr: "-required-user and -required-role are required with -cloud-name",
+		},
+	} {
+		err := run(testutil.TestLogger(), tc.config)
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
+
+func TestVendorDataBadRequest(t *testing.T) {
+	dir := t.TempDir()
+	_, ts := newTestSigner(t, writeECKey(t, dir, "ec.pem"))
+
+	resp := postVendorData(t, ts.URL, "", &openstack.VendorDataRequest{ProjectID: "alpha"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %v, want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	resp, err := http.Get(ts.URL + vendorDataPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("got status %v, want %v", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestLoadKeySetError(t *testing.T) {
+	dir := t.TempDir()
+	broken := filepath.Join(dir, "broken.pem")
+	if err := ioutil.WriteFile(broken, []byte("broken"), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+
+	for i, paths := range [][]string{
+		nil,
+		{broken},
+		{filepath.Join(dir, "missing.pem")},
+	} {
+		if _, err := loadKeySet(paths); err == nil {
+			t.Errorf("#%v: expected an error, got nil", i)
+		}
+	}
+}
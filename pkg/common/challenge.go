@@ -0,0 +1,56 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package common
+
+import (
+	"fmt"
+)
+
+const (
+	// ChallengeTypeMetadataNonce asks the agent to read back the nonce which the server wrote
+	// into the instance metadata. Only the instance itself can reach its metadata service.
+	ChallengeTypeMetadataNonce = "metadata_nonce"
+	// ChallengeTypeIdentityDocument asks the agent to return the signed identity document
+	// served through the Nova DynamicJSON vendordata.
+	ChallengeTypeIdentityDocument = "identity_document"
+	// ChallengeTypeKeyPair asks the agent to sign a nonce with the private key of the Nova keypair
+	// the instance was booted with.
+	ChallengeTypeKeyPair = "keypair"
+	// ChallengeTypeBootstrapToken asks the agent to return the one-time token which the provisioning
+	// pipeline put into the instance metadata at boot.
+	ChallengeTypeBootstrapToken = "bootstrap_token"
+)
+
+// Challenge is sent from the server plugin to the agent plugin during attestation.
+type Challenge struct {
+	Type string `json:"type"`
+	// MetadataKey is the instance metadata key which holds the value the agent must return.
+	MetadataKey string `json:"metadata_key,omitempty"`
+	// VendorDataName is the name of the vendordata entry which holds the identity document.
+	VendorDataName string `json:"vendordata_name,omitempty"`
+	// Nonce is the random value the agent must sign.
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// ChallengeResponse is sent from the agent plugin in reply to a Challenge.
+type ChallengeResponse struct {
+	Type string `json:"type"`
+	// Nonce is the value the agent read from the instance metadata, such as the challenge nonce or
+	// the bootstrap token.
+	Nonce string `json:"nonce,omitempty"`
+	// IdentityDocument is the signed identity document the agent read from the vendordata.
+	IdentityDocument string `json:"identity_document,omitempty"`
+	// Signature is the SSH wire format signature over KeyPairChallengeData.
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// KeyPairChallengeData returns the data the agent signs to answer the keypair challenge.
+// The data is bound to the instance, and can't be confused with other uses of the key.
+func KeyPairChallengeData(instanceID, nonce string) []byte {
+	return []byte(fmt.Sprintf("spire-openstack-iid-keypair-challenge:%s:%s", instanceID, nonce))
+}
@@ -8,8 +8,11 @@
 package common
 
 import (
+	"errors"
+	"fmt"
 	"net/url"
 	"path"
+	"strings"
 )
 
 const (
@@ -17,7 +20,13 @@ const (
 )
 
 func GenerateSpiffeID(trustDomain, projectID, instanceID string) string {
-	spiffePath := path.Join("spire", "agent", PluginName, projectID, instanceID)
+	return GenerateCloudSpiffeID(trustDomain, "", projectID, instanceID)
+}
+
+// GenerateCloudSpiffeID returns the SPIFFE ID of the agent on the instance in given cloud, so that instances
+// of different clouds never get the same ID. The ID has no cloud segment if cloudID is empty.
+func GenerateCloudSpiffeID(trustDomain, cloudID, projectID, instanceID string) string {
+	spiffePath := path.Join("spire", "agent", PluginName, cloudID, projectID, instanceID)
 	id := &url.URL{
 		Scheme: "spiffe",
 		Host:   trustDomain,
@@ -25,3 +34,42 @@ func GenerateSpiffeID(trustDomain, projectID, instanceID string) string {
 	}
 	return id.String()
 }
+
+// GenerateAgentSpiffeID returns the SPIFFE ID of the agent with given path under "/spire/agent".
+// The path must be a legal SPIFFE ID path, whose segments are non-empty, not "." or "..", and consist of
+// letters, digits, ".", "_" and "-". The leading "/" is optional.
+func GenerateAgentSpiffeID(trustDomain, agentPath string) (string, error) {
+	agentPath = strings.TrimPrefix(agentPath, "/")
+	if agentPath == "" {
+		return "", errors.New("agent path is empty")
+	}
+	for _, segment := range strings.Split(agentPath, "/") {
+		if err := validatePathSegment(segment); err != nil {
+			return "", fmt.Errorf("invalid agent path %q: %v", agentPath, err)
+		}
+	}
+
+	id := &url.URL{
+		Scheme: "spiffe",
+		Host:   trustDomain,
+		Path:   path.Join("spire", "agent", agentPath),
+	}
+	return id.String(), nil
+}
+
+func validatePathSegment(segment string) error {
+	switch segment {
+	case "":
+		return errors.New("path has an empty segment")
+	case ".", "..":
+		return fmt.Errorf("path has a %q segment", segment)
+	}
+	for _, c := range segment {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return fmt.Errorf("path has an invalid character %q", c)
+		}
+	}
+	return nil
+}
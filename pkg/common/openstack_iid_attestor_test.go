@@ -23,3 +23,78 @@ func TestGenerateSpiffeID(t *testing.T) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+func TestGenerateCloudSpiffeID(t *testing.T) {
+	for i, tc := range []struct {
+		cloudID string
+		want    string
+	}{
+		// 0: with cloud
+		{
+			cloudID: "east",
+			want:    "spiffe://example.com/spire/agent/openstack_iid/east/alpha/bravo",
+		},
+		// 1: without cloud
+		{
+			want: "spiffe://example.com/spire/agent/openstack_iid/alpha/bravo",
+		},
+	} {
+		if got := GenerateCloudSpiffeID("example.com", tc.cloudID, "alpha", "bravo"); got != tc.want {
+			t.Errorf("#%v: got %v, want %v", i, got, tc.want)
+		}
+	}
+}
+
+func TestGenerateAgentSpiffeID(t *testing.T) {
+	for i, tc := range []struct {
+		agentPath string
+		want      string
+		wantErr   string
+	}{
+		// 0: valid path
+		{
+			agentPath: "openstack_iid/east/alpha/bravo",
+			want:      "spiffe://example.com/spire/agent/openstack_iid/east/alpha/bravo",
+		},
+		// 1: leading slash
+		{
+			agentPath: "/openstack_iid/RegionOne/web-01.example",
+			want:      "spiffe://example.com/spire/agent/openstack_iid/RegionOne/web-01.example",
+		},
+		// 2: empty
+		{
+			agentPath: "/",
+			wantErr:   "agent path is empty",
+		},
+		// 3: empty segment
+		{
+			agentPath: "openstack_iid//bravo",
+			wantErr:   `invalid agent path "openstack_iid//bravo": path has an empty segment`,
+		},
+		// 4: dot segment
+		{
+			agentPath: "openstack_iid/../bravo",
+			wantErr:   `invalid agent path "openstack_iid/../bravo": path has a ".." segment`,
+		},
+		// 5: invalid character
+		{
+			agentPath: "openstack_iid/web 01",
+			wantErr:   `invalid agent path "openstack_iid/web 01": path has an invalid character ' '`,
+		},
+	} {
+		got, err := GenerateAgentSpiffeID("example.com", tc.agentPath)
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("#%v: got %v, want %v", i, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// PayloadVersion is the version of the attestation payload format the agent plugin sends.
+	PayloadVersion = 1
+)
+
+// AttestationPayload is sent from the agent plugin to start the attestation.
+type AttestationPayload struct {
+	// Version is the version of the payload format. It is 0 for the legacy payload, which is the raw UUID.
+	Version int    `json:"version"`
+	UUID    string `json:"uuid"`
+	// Cloud is the identifier of the cloud the agent states it is on, which the agent reads from the instance metadata.
+	// It is empty if the instance metadata has no cloud identifier.
+	Cloud string `json:"cloud,omitempty"`
+	// Evidence is the instance information the server plugin compares with Nova.
+	Evidence *Evidence `json:"evidence,omitempty"`
+	// Nonce is a random value generated by the agent, which identifies the attestation in logs.
+	Nonce string `json:"nonce,omitempty"`
+	// Timestamp is the time the agent created the payload.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Evidence is the instance information the agent plugin reads from the metadata service.
+type Evidence struct {
+	Name             string `json:"name"`
+	AvailabilityZone string `json:"availability_zone"`
+	ProjectID        string `json:"project_id"`
+	Hostname         string `json:"hostname"`
+}
+
+// ParseAttestationPayload parses the attestation payload. Payloads which are not JSON objects are
+// parsed as the legacy payload, which is the raw UUID.
+func ParseAttestationPayload(b []byte) (*AttestationPayload, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, errors.New("attestation payload is empty")
+	}
+	if b[0] != '{' {
+		return &AttestationPayload{
+			UUID: string(b),
+		}, nil
+	}
+
+	payload := &AttestationPayload{}
+	if err := json.Unmarshal(b, payload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal attestation payload: %v", err)
+	}
+	if payload.Version < 1 || payload.Version > PayloadVersion {
+		return nil, fmt.Errorf("unsupported attestation payload version: %d", payload.Version)
+	}
+	if payload.UUID == "" {
+		return nil, errors.New("attestation payload has no uuid")
+	}
+	return payload, nil
+}
+
+// IsLegacy returns true if the payload is the legacy raw UUID.
+func (p *AttestationPayload) IsLegacy() bool {
+	return p.Version == 0
+}
@@ -0,0 +1,78 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseAttestationPayload(t *testing.T) {
+	ts := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	for i, tc := range []struct {
+		payload string
+		want    *AttestationPayload
+		wantErr string
+	}{
+		// 0: version 1
+		{
+			payload: `{"version": 1, "uuid": "alpha", "evidence": {"name": "bravo"}, "nonce": "charlie", "timestamp": "2021-10-01T00:00:00Z"}`,
+			want: &AttestationPayload{
+				Version:   1,
+				UUID:      "alpha",
+				Evidence:  &Evidence{Name: "bravo"},
+				Nonce:     "charlie",
+				Timestamp: ts,
+			},
+		},
+		// 1: legacy
+		{
+			payload: "alpha",
+			want:    &AttestationPayload{UUID: "alpha"},
+		},
+		// 2: unknown version
+		{
+			payload: `{"version": 2, "uuid": "alpha"}`,
+			wantErr: "unsupported attestation payload version: 2",
+		},
+		// 3: no version
+		{
+			payload: `{"uuid": "alpha"}`,
+			wantErr: "unsupported attestation payload version: 0",
+		},
+		// 4: no uuid
+		{
+			payload: `{"version": 1}`,
+			wantErr: "attestation payload has no uuid",
+		},
+		// 5: empty
+		{
+			payload: "",
+			wantErr: "attestation payload is empty",
+		},
+	} {
+		got, err := ParseAttestationPayload([]byte(tc.payload))
+		if tc.wantErr != "" {
+			if err == nil {
+				t.Errorf("#%v: expected an error, got nil", i)
+			} else if err.Error() != tc.wantErr {
+				t.Errorf("#%v: got %v, want %v", i, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("#%v: got %+v, want %+v", i, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gophercloud/utils/openstack/clientconfig"
+	"gopkg.in/yaml.v2"
+)
+
+// AuthOptions are the options to authenticate to Keystone. Either CloudName, which refers to
+// an entry of clouds.yaml, or AuthURL with the credentials is used.
+type AuthOptions struct {
+	// CloudsYAMLPath is the path to clouds.yaml. If empty, clouds.yaml is looked up in the standard locations.
+	// secure.yaml in the same directory, if any, is merged into it.
+	CloudsYAMLPath string
+	// CloudName is the name of the cloud entry in clouds.yaml.
+	CloudName string
+
+	AuthURL    string
+	RegionName string
+
+	Username       string
+	UserID         string
+	UserDomainName string
+	UserDomainID   string
+
+	ProjectID         string
+	ProjectName       string
+	ProjectDomainName string
+	ProjectDomainID   string
+
+	ApplicationCredentialID   string
+	ApplicationCredentialName string
+
+	// Secret is the password, or the application credential secret if the application credential is given.
+	Secret string
+}
+
+// Region returns the region to use, which is given explicitly or found in the clouds.yaml entry.
+func (o AuthOptions) Region() (string, error) {
+	if o.RegionName != "" || o.CloudName == "" {
+		return o.RegionName, nil
+	}
+	cloud, err := clientconfig.GetCloudFromYAML(o.clientOpts())
+	if err != nil {
+		return "", err
+	}
+	return cloud.RegionName, nil
+}
+
+func (o AuthOptions) clientOpts() *clientconfig.ClientOpts {
+	opts := &clientconfig.ClientOpts{
+		Cloud:      o.CloudName,
+		RegionName: o.RegionName,
+	}
+	if o.CloudsYAMLPath != "" {
+		opts.YAMLOpts = cloudsYAMLFile(o.CloudsYAMLPath)
+	}
+	if o.AuthURL != "" {
+		info := &clientconfig.AuthInfo{
+			AuthURL:                   o.AuthURL,
+			Username:                  o.Username,
+			UserID:                    o.UserID,
+			UserDomainName:            o.UserDomainName,
+			UserDomainID:              o.UserDomainID,
+			ProjectID:                 o.ProjectID,
+			ProjectName:               o.ProjectName,
+			ProjectDomainName:         o.ProjectDomainName,
+			ProjectDomainID:           o.ProjectDomainID,
+			ApplicationCredentialID:   o.ApplicationCredentialID,
+			ApplicationCredentialName: o.ApplicationCredentialName,
+		}
+		if o.ApplicationCredentialID != "" || o.ApplicationCredentialName != "" {
+			opts.AuthType = clientconfig.AuthV3ApplicationCredential
+			info.ApplicationCredentialSecret = o.Secret
+		} else {
+			opts.AuthType = clientconfig.AuthV3Password
+			info.Password = o.Secret
+		}
+		opts.AuthInfo = info
+	}
+	return opts
+}
+
+// cloudsYAMLFile loads clouds.yaml from the path, and secure.yaml next to it, instead of the standard locations.
+type cloudsYAMLFile string
+
+func (f cloudsYAMLFile) LoadCloudsYAML() (map[string]clientconfig.Cloud, error) {
+	return loadCloudsFile(string(f))
+}
+
+// LoadSecureCloudsYAML loads secure.yaml in the directory of clouds.yaml, which holds the secrets of the
+// entries, such as the passwords. It returns no entries if there is no secure.yaml.
+func (f cloudsYAMLFile) LoadSecureCloudsYAML() (map[string]clientconfig.Cloud, error) {
+	clouds, err := loadCloudsFile(filepath.Join(filepath.Dir(string(f)), "secure.yaml"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return clouds, err
+}
+
+// LoadPublicCloudsYAML returns no entries, since clouds-public.yaml is read only from the standard locations.
+func (f cloudsYAMLFile) LoadPublicCloudsYAML() (map[string]clientconfig.Cloud, error) {
+	return nil, nil
+}
+
+func loadCloudsFile(path string) (map[string]clientconfig.Cloud, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var clouds clientconfig.Clouds
+	if err := yaml.Unmarshal(b, &clouds); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s: %v", path, err)
+	}
+	return clouds.Clouds, nil
+}
@@ -0,0 +1,136 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/gophercloud/utils/openstack/clientconfig"
+)
+
+const testCloudsYAML = `
+clouds:
+  alpha:
+    region_name: RegionOne
+    auth:
+      auth_url: https://keystone.example.com:5000/v3
+      username: bravo
+      password: charlie
+      project_name: delta
+      user_domain_name: Default
+      project_domain_name: Default
+`
+
+func TestAuthOptionsCloudsYAMLPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clouds.yaml")
+	if err := ioutil.WriteFile(path, []byte(testCloudsYAML), 0600); err != nil {
+		t.Fatalf("failed to write clouds.yaml: %v", err)
+	}
+
+	opts := AuthOptions{CloudsYAMLPath: path, CloudName: "alpha"}
+	ao, err := clientconfig.AuthOptions(opts.clientOpts())
+	if err != nil {
+		t.Fatalf("unexpected error from AuthOptions(): %v", err)
+	}
+	if ao.IdentityEndpoint != "https://keystone.example.com:5000/v3" || ao.Username != "bravo" || ao.Password != "charlie" {
+		t.Errorf("unexpected auth options: %+v", ao)
+	}
+
+	region, err := opts.Region()
+	if err != nil {
+		t.Fatalf("unexpected error from Region(): %v", err)
+	}
+	if region != "RegionOne" {
+		t.Errorf("got region %q, want RegionOne", region)
+	}
+
+	if _, err := (AuthOptions{CloudsYAMLPath: path, CloudName: "echo"}).Region(); err == nil {
+		t.Error("expected error for unknown cloud, got nil")
+	}
+}
+
+func TestAuthOptionsSecureYAML(t *testing.T) {
+	dir := t.TempDir()
+	cloudsYAML := `
+clouds:
+  alpha:
+    auth:
+      auth_url: https://keystone.example.com:5000/v3
+      username: bravo
+      project_name: delta
+`
+	secureYAML := `
+clouds:
+  alpha:
+    auth:
+      password: charlie
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "clouds.yaml"), []byte(cloudsYAML), 0600); err != nil {
+		t.Fatalf("failed to write clouds.yaml: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "secure.yaml"), []byte(secureYAML), 0600); err != nil {
+		t.Fatalf("failed to write secure.yaml: %v", err)
+	}
+
+	opts := AuthOptions{CloudsYAMLPath: filepath.Join(dir, "clouds.yaml"), CloudName: "alpha"}
+	ao, err := clientconfig.AuthOptions(opts.clientOpts())
+	if err != nil {
+		t.Fatalf("unexpected error from AuthOptions(): %v", err)
+	}
+	if ao.Username != "bravo" || ao.Password != "charlie" {
+		t.Errorf("unexpected auth options: %+v", ao)
+	}
+}
+
+func TestAuthOptionsInline(t *testing.T) {
+	for i, tc := range []struct {
+		opts AuthOptions
+	}{
+		// 0: password
+		{
+			opts: AuthOptions{
+				AuthURL:        "https://keystone.example.com:5000/v3",
+				RegionName:     "RegionTwo",
+				Username:       "bravo",
+				UserDomainName: "Default",
+				ProjectID:      "delta",
+				Secret:         "charlie",
+			},
+		},
+		// 1: application credential
+		{
+			opts: AuthOptions{
+				AuthURL:                 "https://keystone.example.com:5000/v3",
+				ApplicationCredentialID: "echo",
+				Secret:                  "charlie",
+			},
+		},
+	} {
+		ao, err := clientconfig.AuthOptions(tc.opts.clientOpts())
+		if err != nil {
+			t.Errorf("#%v: unexpected error from AuthOptions(): %v", i, err)
+			continue
+		}
+		if ao.IdentityEndpoint != tc.opts.AuthURL {
+			t.Errorf("#%v: got auth url %q, want %q", i, ao.IdentityEndpoint, tc.opts.AuthURL)
+		}
+		if tc.opts.ApplicationCredentialID != "" {
+			if ao.ApplicationCredentialID != "echo" || ao.ApplicationCredentialSecret != "charlie" || ao.Password != "" {
+				t.Errorf("#%v: unexpected auth options: %+v", i, ao)
+			}
+		} else if ao.Username != "bravo" || ao.Password != "charlie" || ao.ApplicationCredentialSecret != "" {
+			t.Errorf("#%v: unexpected auth options: %+v", i, ao)
+		}
+
+		if region, _ := tc.opts.Region(); region != tc.opts.RegionName {
+			t.Errorf("#%v: got region %q, want %q", i, region, tc.opts.RegionName)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	cloudInitInstanceDataPath = "/run/cloud-init/instance-data.json"
+)
+
+// CloudInit is the metadata source which reads the instance data cached by cloud-init at boot.
+type CloudInit struct {
+	// Path is the path to instance-data.json.
+	Path string
+}
+
+// cloudInitInstanceData is the part of instance-data.json the plugin uses.
+type cloudInitInstanceData struct {
+	V1 struct {
+		InstanceID       string `json:"instance_id"`
+		AvailabilityZone string `json:"availability_zone"`
+		LocalHostname    string `json:"local_hostname"`
+	} `json:"v1"`
+	DS struct {
+		// MetaData is meta_data.json read by the OpenStack and ConfigDrive datasources.
+		MetaData *Metadata `json:"meta_data"`
+	} `json:"ds"`
+}
+
+func (c *CloudInit) Name() string {
+	return MetadataSourceCloudInit
+}
+
+func (c *CloudInit) Metadata() (*Metadata, error) {
+	f, err := os.Open(c.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cloud-init instance data: %v", err)
+	}
+	defer f.Close()
+
+	data := &cloudInitInstanceData{}
+	if err := json.NewDecoder(f).Decode(data); err != nil {
+		return nil, fmt.Errorf("failed to parse cloud-init instance data: %v", err)
+	}
+
+	metadata := data.DS.MetaData
+	if metadata == nil {
+		metadata = &Metadata{}
+	}
+	metadata = mergeMetadata(metadata, &Metadata{
+		UUID:             data.V1.InstanceID,
+		AvailabilityZone: data.V1.AvailabilityZone,
+		Hostname:         data.V1.LocalHostname,
+	})
+	if metadata.UUID == "" {
+		return nil, errors.New("invalid cloud-init instance data, uuid seems empty")
+	}
+	return metadata, nil
+}
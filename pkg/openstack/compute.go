@@ -0,0 +1,191 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+const (
+	// serverTagsMicroversion is the compute API microversion which reports the tags of servers.
+	serverTagsMicroversion = "2.26"
+	// embeddedFlavorMicroversion is the compute API microversion which embeds the flavor details in servers.
+	embeddedFlavorMicroversion = "2.47"
+)
+
+// ComputeOptions selects the compute API endpoint and the microversion of the server requests.
+type ComputeOptions struct {
+	// Region is the region of the endpoint. If empty, the region is not taken into account.
+	Region string
+	// Interface is the interface of the endpoint, "public", "internal" or "admin". Defaults to "public".
+	Interface string
+	// Microversion is the microversion of the server requests. Defaults to the lowest one which
+	// supports the required features, and none if no feature requires one.
+	Microversion string
+
+	// ServerLocked requires the lock state of the server.
+	ServerLocked bool
+	// ServerTags requires the tags of the server.
+	ServerTags bool
+	// EmbeddedFlavor requires the flavor details embedded in the server.
+	EmbeddedFlavor bool
+	// KeyPairs requires getting the keypairs of other users, which Nova allows only to admins by default.
+	KeyPairs bool
+}
+
+// endpointOpts returns the options to look up the endpoint in the service catalog with.
+func (o ComputeOptions) endpointOpts() (gophercloud.EndpointOpts, error) {
+	return endpointOpts(o.Region, o.Interface)
+}
+
+// endpointOpts returns the options to look up the endpoint of given region and interface with.
+func endpointOpts(region, iface string) (gophercloud.EndpointOpts, error) {
+	eo := gophercloud.EndpointOpts{Region: region}
+	switch gophercloud.Availability(iface) {
+	case "":
+	case gophercloud.AvailabilityPublic, gophercloud.AvailabilityInternal, gophercloud.AvailabilityAdmin:
+		eo.Availability = gophercloud.Availability(iface)
+	default:
+		return eo, fmt.Errorf("invalid endpoint interface %q, must be public, internal or admin", iface)
+	}
+	return eo, nil
+}
+
+// microversion returns the microversion of the server requests, which must be high enough for the required features.
+// It returns an empty string if the microversion is neither given nor required.
+func (o ComputeOptions) microversion() (string, error) {
+	required := ""
+	if o.ServerLocked {
+		required = serverLockedMicroversion
+	}
+	if o.ServerTags {
+		required = serverTagsMicroversion
+	}
+	if o.EmbeddedFlavor {
+		required = embeddedFlavorMicroversion
+	}
+	if o.Microversion == "" {
+		return required, nil
+	}
+
+	v, err := ParseMicroversion(o.Microversion)
+	if err != nil {
+		return "", err
+	}
+	if required == "" {
+		return o.Microversion, nil
+	}
+	r, _ := ParseMicroversion(required)
+	if v.Less(r) {
+		return "", fmt.Errorf("microversion %s is lower than %s, which the configured features require", o.Microversion, required)
+	}
+	return o.Microversion, nil
+}
+
+// Microversion is a compute API microversion, such as 2.47.
+type Microversion struct {
+	Major int
+	Minor int
+}
+
+// ParseMicroversion parses the microversion in the "<major>.<minor>" form.
+func ParseMicroversion(s string) (Microversion, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return Microversion{}, fmt.Errorf("invalid microversion %q", s)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || major < 0 {
+		return Microversion{}, fmt.Errorf("invalid microversion %q", s)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil || minor < 0 {
+		return Microversion{}, fmt.Errorf("invalid microversion %q", s)
+	}
+	return Microversion{Major: major, Minor: minor}, nil
+}
+
+// Less returns true if v is lower than o.
+func (v Microversion) Less(o Microversion) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	return v.Minor < o.Minor
+}
+
+func (v Microversion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// versionPathSegment matches the API version in the path of the endpoint, such as "v2.1".
+var versionPathSegment = regexp.MustCompile(`^v[0-9]+(\.[0-9]+)?$`)
+
+// versionDocumentURL returns the URL of the version document of the compute endpoint, which is the endpoint
+// up to the API version, without the project ID the endpoint may include, such as "https://nova.example.com/v2.1/"
+// for "https://nova.example.com/v2.1/<project ID>".
+func versionDocumentURL(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid compute endpoint: %v", err)
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i, s := range segments {
+		if versionPathSegment.MatchString(s) {
+			u.Path = "/" + strings.Join(segments[:i+1], "/") + "/"
+			u.RawPath = ""
+			u.RawQuery = ""
+			return u.String(), nil
+		}
+	}
+	return "", fmt.Errorf("compute endpoint %s has no API version in the path", endpoint)
+}
+
+// checkMicroversion returns an error if the compute API doesn't support given microversion.
+// The supported range is read from the version document of the endpoint.
+func checkMicroversion(ctx context.Context, sc *gophercloud.ServiceClient, microversion string) error {
+	versionURL, err := versionDocumentURL(sc.Endpoint)
+	if err != nil {
+		return err
+	}
+	var body struct {
+		Version struct {
+			MinVersion string `json:"min_version"`
+			Version    string `json:"version"`
+		} `json:"version"`
+	}
+	if _, err := withContext(ctx, sc).Get(versionURL, &body, nil); err != nil {
+		return fmt.Errorf("failed to get the compute API version: %w", err)
+	}
+	if body.Version.Version == "" {
+		return fmt.Errorf("compute API at %s doesn't support microversions", versionURL)
+	}
+
+	v, err := ParseMicroversion(microversion)
+	if err != nil {
+		return err
+	}
+	min, err := ParseMicroversion(body.Version.MinVersion)
+	if err != nil {
+		return fmt.Errorf("unexpected compute API min_version: %v", err)
+	}
+	max, err := ParseMicroversion(body.Version.Version)
+	if err != nil {
+		return fmt.Errorf("unexpected compute API version: %v", err)
+	}
+	if v.Less(min) || max.Less(v) {
+		return fmt.Errorf("compute API doesn't support microversion %s, supported versions are %s to %s", microversion, min, max)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gophercloud/gophercloud"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/testutil"
+)
+
+func TestComputeOptions(t *testing.T) {
+	for i, tc := range []struct {
+		opts             ComputeOptions
+		wantAvailability gophercloud.Availability
+		wantMicroversion string
+		wantErr          string
+	}{
+		// 0: defaults, no microversion
+		{},
+		// 1: internal interface
+		{
+			opts:             ComputeOptions{Interface: "internal"},
+			wantAvailability: gophercloud.AvailabilityInternal,
+		},
+		// 2: server tags
+		{
+			opts:             ComputeOptions{ServerTags: true},
+			wantMicroversion: serverTagsMicroversion,
+		},
+		// 3: embedded flavor and server tags
+		{
+			opts:             ComputeOptions{ServerTags: true, EmbeddedFlavor: true},
+			wantMicroversion: embeddedFlavorMicroversion,
+		},
+		// 4: explicit microversion
+		{
+			opts:             ComputeOptions{Microversion: "2.60", EmbeddedFlavor: true},
+			wantMicroversion: "2.60",
+		},
+		// 5: explicit microversion lower than required
+		{
+			opts:    ComputeOptions{Microversion: "2.30", EmbeddedFlavor: true},
+			wantErr: "microversion 2.30 is lower than 2.47, which the configured features require",
+		},
+		// 6: invalid microversion
+		{
+			opts:    ComputeOptions{Microversion: "2"},
+			wantErr: `invalid microversion "2"`,
+		},
+		// 7: invalid interface
+		{
+			opts:    ComputeOptions{Interface: "private"},
+			wantErr: `invalid endpoint interface "private", must be public, internal or admin`,
+		},
+		// 8: lock state
+		{
+			opts:             ComputeOptions{ServerLocked: true},
+			wantMicroversion: serverLockedMicroversion,
+		},
+		// 9: explicit microversion without features
+		{
+			opts:             ComputeOptions{Microversion: "2.1"},
+			wantMicroversion: "2.1",
+		},
+	} {
+		eo, err := tc.opts.endpointOpts()
+		if err == nil {
+			var mv string
+			mv, err = tc.opts.microversion()
+			if err == nil {
+				if eo.Availability != tc.wantAvailability {
+					t.Errorf("#%v: got availability %q, want %q", i, eo.Availability, tc.wantAvailability)
+				}
+				if mv != tc.wantMicroversion {
+					t.Errorf("#%v: got microversion %q, want %q", i, mv, tc.wantMicroversion)
+				}
+			}
+		}
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+		}
+		if tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+			t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+		}
+	}
+}
+
+func TestVersionDocumentURL(t *testing.T) {
+	for i, tc := range []struct {
+		endpoint string
+		want     string
+		wantErr  string
+	}{
+		// 0: endpoint without the project ID
+		{endpoint: "https://nova.example.com:8774/v2.1/", want: "https://nova.example.com:8774/v2.1/"},
+		// 1: endpoint with the project ID
+		{endpoint: "https://nova.example.com:8774/v2.1/0a1b2c3d4e5f/", want: "https://nova.example.com:8774/v2.1/"},
+		// 2: endpoint under a path prefix
+		{endpoint: "https://openstack.example.com/compute/v2/0a1b2c3d4e5f", want: "https://openstack.example.com/compute/v2/"},
+		// 3: no version
+		{endpoint: "https://nova.example.com:8774/", wantErr: "compute endpoint https://nova.example.com:8774/ has no API version in the path"},
+	} {
+		got, err := versionDocumentURL(tc.endpoint)
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("#%v: got %v, want %v", i, got, tc.want)
+		}
+	}
+}
+
+func TestNewInstance(t *testing.T) {
+	for i, tc := range []struct {
+		versionDocument  string
+		keyPairStatus    int
+		opts             ComputeOptions
+		wantMicroversion string
+		wantErr          string
+	}{
+		// 0: supported
+		{
+			versionDocument:  `{"version": {"id": "v2.1", "min_version": "2.1", "version": "2.87"}}`,
+			opts:             ComputeOptions{Region: "RegionOne", Interface: "internal", EmbeddedFlavor: true},
+			wantMicroversion: embeddedFlavorMicroversion,
+		},
+		// 1: embedded flavor is not supported
+		{
+			versionDocument: `{"version": {"id": "v2.1", "min_version": "2.1", "version": "2.38"}}`,
+			opts:            ComputeOptions{Region: "RegionOne", Interface: "internal", EmbeddedFlavor: true},
+			wantErr:         "compute API doesn't support microversion 2.47, supported versions are 2.1 to 2.38",
+		},
+		// 2: microversions are not supported
+		{
+			versionDocument: `{"version": {"id": "v2.0", "min_version": "", "version": ""}}`,
+			opts:            ComputeOptions{Region: "RegionOne", Interface: "internal", ServerLocked: true},
+			wantErr:         "doesn't support microversions",
+		},
+		// 3: no microversion is required, the endpoint is not probed
+		{
+			opts: ComputeOptions{Region: "RegionOne", Interface: "internal"},
+		},
+		// 4: keypairs of other users are allowed
+		{
+			keyPairStatus: http.StatusNotFound,
+			opts:          ComputeOptions{Region: "RegionOne", Interface: "internal", KeyPairs: true},
+		},
+		// 5: keypairs of other users are forbidden
+		{
+			keyPairStatus: http.StatusForbidden,
+			opts:          ComputeOptions{Region: "RegionOne", Interface: "internal", KeyPairs: true},
+			wantErr:       "keypair challenge requires getting the keypairs of other users",
+		},
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v2.1/0a1b2c3d4e5f/os-keypairs/"+keyPairProbeName && tc.keyPairStatus != 0 {
+				if r.URL.Query().Get("user_id") != keyPairProbeName || r.Header.Get("X-OpenStack-Nova-API-Version") != keypairUserIDMicroversion {
+					http.Error(w, "unexpected request", http.StatusBadRequest)
+					return
+				}
+				http.Error(w, http.StatusText(tc.keyPairStatus), tc.keyPairStatus)
+				return
+			}
+			if r.URL.Path != "/v2.1/" || tc.versionDocument == "" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, tc.versionDocument)
+		}))
+
+		var got gophercloud.EndpointOpts
+		provider := &gophercloud.ProviderClient{
+			EndpointLocator: func(eo gophercloud.EndpointOpts) (string, error) {
+				got = eo
+				// The endpoint includes the project ID, which the version document is not under.
+				return ts.URL + "/v2.1/0a1b2c3d4e5f/", nil
+			},
+		}
+
+		instance, err := NewInstance(context.Background(), provider, tc.opts, testutil.TestLogger())
+		ts.Close()
+		if got.Region != tc.opts.Region || string(got.Availability) != tc.opts.Interface {
+			t.Errorf("#%v: got endpoint options %+v", i, got)
+		}
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("#%v: got error %v, want %v", i, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+			continue
+		}
+		if mv := instance.(*Instance).microversion; mv != tc.wantMicroversion {
+			t.Errorf("#%v: got microversion %q, want %q", i, mv, tc.wantMicroversion)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	configDriveMetadataPath   = "openstack/latest/meta_data.json"
+	configDriveVendorDataPath = "openstack/latest/vendor_data2.json"
+)
+
+var (
+	// The config drive is labelled "config-2", which appears in upper case on vfat.
+	configDriveDevices = []string{"/dev/disk/by-label/config-2", "/dev/disk/by-label/CONFIG-2"}
+)
+
+// ConfigDrive is the metadata source which reads the config drive.
+type ConfigDrive struct {
+	// Path is the directory the config drive is mounted on. If it is empty, the config drive
+	// device is mounted temporarily, which requires the privilege to mount filesystems.
+	Path string
+
+	// mount mounts the config drive temporarily, defaults to mountConfigDrive.
+	mount func() (string, func() error, error)
+	// The contents of the config drive don't change while the instance runs, so the files read from
+	// the temporarily mounted config drive are cached instead of mounting it on every read.
+	mtx   sync.Mutex
+	files map[string][]byte
+}
+
+func (c *ConfigDrive) Name() string {
+	return MetadataSourceConfigDrive
+}
+
+func (c *ConfigDrive) Metadata() (*Metadata, error) {
+	b, err := c.readFile(configDriveMetadataPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseMetadata(bytes.NewReader(b))
+}
+
+func (c *ConfigDrive) VendorData() (VendorData, error) {
+	b, err := c.readFile(configDriveVendorDataPath)
+	if err != nil {
+		return nil, err
+	}
+	var vd VendorData
+	if err := json.Unmarshal(b, &vd); err != nil {
+		return nil, err
+	}
+	return vd, nil
+}
+
+// readFile reads given file on the config drive, mounting it if needed.
+func (c *ConfigDrive) readFile(name string) ([]byte, error) {
+	if c.Path != "" {
+		b, err := ioutil.ReadFile(filepath.Join(c.Path, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config drive: %v", err)
+		}
+		return b, nil
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if b, ok := c.files[name]; ok {
+		return b, nil
+	}
+
+	mount := c.mount
+	if mount == nil {
+		mount = mountConfigDrive
+	}
+	mountPoint, unmount, err := mount()
+	if err != nil {
+		return nil, err
+	}
+	defer unmount()
+
+	b, err := ioutil.ReadFile(filepath.Join(mountPoint, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config drive: %v", err)
+	}
+	if c.files == nil {
+		c.files = make(map[string][]byte)
+	}
+	c.files[name] = b
+	return b, nil
+}
@@ -0,0 +1,46 @@
+//go:build linux
+// +build linux
+
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// mountConfigDrive mounts the config drive read-only on a temporary directory.
+func mountConfigDrive() (string, func() error, error) {
+	dir, err := ioutil.TempDir("", "config-2")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create mount point: %v", err)
+	}
+
+	mountErr := errors.New("config drive not found")
+	for _, device := range configDriveDevices {
+		if _, err := os.Stat(device); err != nil {
+			continue
+		}
+		for _, fstype := range []string{"iso9660", "vfat"} {
+			if mountErr = syscall.Mount(device, dir, fstype, syscall.MS_RDONLY, ""); mountErr == nil {
+				unmount := func() error {
+					defer os.Remove(dir)
+					return syscall.Unmount(dir, 0)
+				}
+				return dir, unmount, nil
+			}
+		}
+	}
+
+	os.Remove(dir)
+	return "", nil, fmt.Errorf("failed to mount config drive: %v", mountErr)
+}
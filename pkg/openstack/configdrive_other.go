@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"errors"
+)
+
+// mountConfigDrive isn't supported on this platform, the config drive must be mounted beforehand.
+func mountConfigDrive() (string, func() error, error) {
+	return "", nil, errors.New("mounting the config drive is not supported on this platform, specify the mount point")
+}
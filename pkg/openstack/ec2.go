@@ -0,0 +1,66 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	ec2MetadataPath = "/latest/meta-data/"
+)
+
+// EC2MetadataService is the metadata source which reads the EC2-compatible metadata API.
+// The EC2 instance-id isn't the instance UUID, so it provides the hostname and the availability zone only.
+type EC2MetadataService struct {
+	// URL is the base URL of the EC2-compatible metadata API.
+	URL string
+	// Service is used to access the metadata service. Defaults to the metadata service with default options.
+	Service *MetadataService
+}
+
+func (s *EC2MetadataService) Name() string {
+	return MetadataSourceEC2
+}
+
+func (s *EC2MetadataService) Metadata() (*Metadata, error) {
+	service := s.Service
+	if service == nil {
+		service = NewMetadataService(MetadataServiceOptions{})
+	}
+	base := s.URL
+	if base == "" {
+		base = service.opts.URL + ec2MetadataPath
+	}
+
+	hostname, err := service.fetchText(base + "hostname")
+	if err != nil {
+		return nil, err
+	}
+	az, err := service.fetchText(base + "placement/availability-zone")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Metadata{
+		Hostname:         hostname,
+		AvailabilityZone: az,
+	}, nil
+}
+
+func (s *MetadataService) fetchText(url string) (string, error) {
+	var text string
+	err := s.fetch(url, func(r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		text = strings.TrimSpace(string(b))
+		return err
+	})
+	return text, err
+}
@@ -0,0 +1,62 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"context"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/projects"
+	"github.com/hashicorp/go-hclog"
+)
+
+// IdentityClient is the client of OpenStack Identity Service. The requests are cancelled when given context is done.
+type IdentityClient interface {
+	// ListProjects retrieves all projects visible to the client
+	ListProjects(ctx context.Context) ([]projects.Project, error)
+}
+
+// IdentityOptions selects the identity API endpoint.
+type IdentityOptions struct {
+	// Region is the region of the endpoint. If empty, the region is not taken into account.
+	Region string
+	// Interface is the interface of the endpoint, "public", "internal" or "admin". Defaults to "public".
+	Interface string
+}
+
+// Identity represents a OpenStack Identity Service client
+type Identity struct {
+	Logger        hclog.Logger
+	serviceClient *gophercloud.ServiceClient
+}
+
+// NewIdentity returns a new OpenStack Identity Service client with given provider, at the endpoint selected by opts.
+func NewIdentity(client *gophercloud.ProviderClient, opts IdentityOptions, logger hclog.Logger) (IdentityClient, error) {
+	eo, err := endpointOpts(opts.Region, opts.Interface)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := openstack.NewIdentityV3(client, eo)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		Logger:        logger,
+		serviceClient: sc,
+	}, nil
+}
+
+func (i *Identity) ListProjects(ctx context.Context) ([]projects.Project, error) {
+	i.Logger.Debug("List Projects")
+	pages, err := projects.List(withContext(ctx, i.serviceClient), projects.ListOpts{}).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	return projects.ExtractProjects(pages)
+}
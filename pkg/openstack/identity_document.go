@@ -0,0 +1,198 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// ErrUnknownKeyID is returned when the identity document is signed with a key which is not in the key set.
+var ErrUnknownKeyID = errors.New("identity document is signed with unknown key")
+
+// IdentityDocument represents the claims of a signed instance identity document,
+// served to the instance as a Nova DynamicJSON vendordata.
+type IdentityDocument struct {
+	jwt.Claims
+	InstanceID string `json:"instance_id"`
+	ProjectID  string `json:"project_id"`
+	ImageID    string `json:"image_id,omitempty"`
+	Hostname   string `json:"hostname,omitempty"`
+}
+
+// VendorDataRequest represents the request which Nova posts to DynamicJSON vendordata services.
+type VendorDataRequest struct {
+	ProjectID  string            `json:"project-id"`
+	InstanceID string            `json:"instance-id"`
+	ImageID    string            `json:"image-id"`
+	Hostname   string            `json:"hostname"`
+	Metadata   map[string]string `json:"metadata"`
+	// we don't care any other fields.
+}
+
+// NewIdentityDocument returns the identity document of the instance described by the vendordata request.
+func NewIdentityDocument(req *VendorDataRequest, issuer, audience string, now time.Time, ttl time.Duration) *IdentityDocument {
+	return &IdentityDocument{
+		Claims: jwt.Claims{
+			Issuer:   issuer,
+			Subject:  req.InstanceID,
+			Audience: jwt.Audience{audience},
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(ttl)),
+		},
+		InstanceID: req.InstanceID,
+		ProjectID:  req.ProjectID,
+		ImageID:    req.ImageID,
+		Hostname:   req.Hostname,
+	}
+}
+
+// IdentityDocumentVendorData represents the vendordata entry which carries the identity document.
+type IdentityDocumentVendorData struct {
+	IdentityDocument string `json:"identity_document"`
+}
+
+// IdentityDocumentFromVendorData extracts the identity document from the vendordata entry of given name.
+func IdentityDocumentFromVendorData(vd VendorData, name string) (string, error) {
+	raw, ok := vd[name]
+	if !ok {
+		return "", fmt.Errorf("vendordata %q not found", name)
+	}
+
+	var entry IdentityDocumentVendorData
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return "", fmt.Errorf("failed to decode vendordata %q: %v", name, err)
+	}
+	if entry.IdentityDocument == "" {
+		return "", fmt.Errorf("vendordata %q has no identity document", name)
+	}
+
+	return entry.IdentityDocument, nil
+}
+
+// SignIdentityDocument serializes the identity document into a JWT signed by given signer.
+func SignIdentityDocument(doc *IdentityDocument, signer jose.Signer) (string, error) {
+	return jwt.Signed(signer).Claims(doc).CompactSerialize()
+}
+
+// VerifyIdentityDocument verifies the signature of the identity document with given keys,
+// and validates its audience and lifetime. If maxAge is not zero, the document must have been
+// issued within maxAge.
+func VerifyIdentityDocument(token string, keys *jose.JSONWebKeySet, audience string, maxAge time.Duration, now time.Time) (*IdentityDocument, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity document: %v", err)
+	}
+
+	candidates := keys.Keys
+	if len(tok.Headers) > 0 && tok.Headers[0].KeyID != "" {
+		candidates = keys.Key(tok.Headers[0].KeyID)
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("%w %q", ErrUnknownKeyID, tok.Headers[0].KeyID)
+		}
+	}
+
+	doc := &IdentityDocument{}
+	verified := false
+	for _, key := range candidates {
+		if err := tok.Claims(key.Key, doc); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("identity document has an invalid signature")
+	}
+
+	if err := doc.ValidateWithLeeway(jwt.Expected{
+		Audience: jwt.Audience{audience},
+		Time:     now,
+	}, jwt.DefaultLeeway); err != nil {
+		return nil, fmt.Errorf("invalid identity document: %v", err)
+	}
+	if doc.Expiry == nil {
+		return nil, errors.New("invalid identity document: exp claim is required")
+	}
+	if maxAge > 0 {
+		if doc.IssuedAt == nil {
+			return nil, errors.New("invalid identity document: iat claim is required")
+		}
+		if age := now.Sub(doc.IssuedAt.Time()); age > maxAge {
+			return nil, fmt.Errorf("invalid identity document: issued %v ago", age.Round(time.Second))
+		}
+	}
+	if doc.InstanceID == "" || doc.ProjectID == "" {
+		return nil, errors.New("invalid identity document: instance_id and project_id are required")
+	}
+
+	return doc, nil
+}
+
+// FetchJWKS fetches the JSON Web Key Set served at given URL.
+func FetchJWKS(client *http.Client, url string) (*jose.JSONWebKeySet, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching JWKS from %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code when reading JWKS from %s: %s", url, resp.Status)
+	}
+
+	keys := &jose.JSONWebKeySet{}
+	if err := json.NewDecoder(resp.Body).Decode(keys); err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS from %s: %v", url, err)
+	}
+	return keys, nil
+}
+
+// ParsePublicKeys parses PEM encoded public keys into a key set.
+// Each key is identified by its RFC 7638 thumbprint.
+func ParsePublicKeys(pemKeys []string) (*jose.JSONWebKeySet, error) {
+	keys := &jose.JSONWebKeySet{}
+	for i, p := range pemKeys {
+		block, _ := pem.Decode([]byte(p))
+		if block == nil {
+			return nil, fmt.Errorf("public key #%d is not PEM encoded", i)
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key #%d: %v", i, err)
+		}
+
+		key := jose.JSONWebKey{Key: pub, Use: "sig"}
+		kid, err := KeyID(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute key id of public key #%d: %v", i, err)
+		}
+		key.KeyID = kid
+		keys.Keys = append(keys.Keys, key)
+	}
+	return keys, nil
+}
+
+// KeyID returns the RFC 7638 thumbprint of the key, which is used as the key id.
+func KeyID(key jose.JSONWebKey) (string, error) {
+	pub := key.Public()
+	tp, err := pub.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(tp), nil
+}
@@ -0,0 +1,180 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	testAudience = "spire-server"
+)
+
+func newTestKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func signTestDocument(t *testing.T, key *ecdsa.PrivateKey, kid string, doc *IdentityDocument) string {
+	opts := &jose.SignerOptions{}
+	if kid != "" {
+		opts = opts.WithHeader(jose.HeaderKey("kid"), kid)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, opts)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	token, err := SignIdentityDocument(doc, signer)
+	if err != nil {
+		t.Fatalf("failed to sign identity document: %v", err)
+	}
+	return token
+}
+
+func newTestDocument(now time.Time) *IdentityDocument {
+	return &IdentityDocument{
+		Claims: jwt.Claims{
+			Audience: jwt.Audience{testAudience},
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+		InstanceID: "alpha",
+		ProjectID:  "bravo",
+	}
+}
+
+func TestVerifyIdentityDocument(t *testing.T) {
+	// numeric dates in JWT don't have sub-second precision
+	now := time.Now().Truncate(time.Second)
+	key, pubPEM := newTestKey(t)
+	otherKey, otherPubPEM := newTestKey(t)
+
+	keys, err := ParsePublicKeys([]string{otherPubPEM, pubPEM})
+	if err != nil {
+		t.Fatalf("unexpected error from ParsePublicKeys(): %v", err)
+	}
+	kid := keys.Keys[1].KeyID
+
+	expired := newTestDocument(now.Add(-2 * time.Hour))
+	noInstance := newTestDocument(now)
+	noInstance.InstanceID = ""
+
+	for i, tc := range []struct {
+		token   string
+		maxAge  time.Duration
+		wantErr string
+	}{
+		// 0: signed with kid
+		{
+			token: signTestDocument(t, key, kid, newTestDocument(now)),
+		},
+		// 1: signed without kid
+		{
+			token: signTestDocument(t, key, "", newTestDocument(now)),
+		},
+		// 2: unknown kid
+		{
+			token:   signTestDocument(t, key, "unknown", newTestDocument(now)),
+			wantErr: `identity document is signed with unknown key "unknown"`,
+		},
+		// 3: signed by another key with wrong kid
+		{
+			token:   signTestDocument(t, otherKey, kid, newTestDocument(now)),
+			wantErr: "identity document has an invalid signature",
+		},
+		// 4: expired
+		{
+			token:   signTestDocument(t, key, kid, expired),
+			wantErr: "invalid identity document: square/go-jose/jwt: validation failed, token is expired (exp)",
+		},
+		// 5: too old
+		{
+			token:   signTestDocument(t, key, kid, newTestDocument(now.Add(-30*time.Minute))),
+			maxAge:  10 * time.Minute,
+			wantErr: "invalid identity document: issued 30m0s ago",
+		},
+		// 6: missing claims
+		{
+			token:   signTestDocument(t, key, kid, noInstance),
+			wantErr: "invalid identity document: instance_id and project_id are required",
+		},
+		// 7: broken token
+		{
+			token:   "broken",
+			wantErr: "failed to parse identity document",
+		},
+	} {
+		doc, err := VerifyIdentityDocument(tc.token, keys, testAudience, tc.maxAge, now)
+		if tc.wantErr != "" {
+			if err == nil {
+				t.Errorf("#%v: expected an error, got nil", i)
+			} else if !strings.HasPrefix(err.Error(), tc.wantErr) {
+				t.Errorf("#%v: got %v, want %v", i, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+			continue
+		}
+		if doc.InstanceID != "alpha" || doc.ProjectID != "bravo" {
+			t.Errorf("#%v: unexpected identity document: %+v", i, doc)
+		}
+	}
+}
+
+func TestVerifyIdentityDocumentWrongAudience(t *testing.T) {
+	now := time.Now()
+	key, pubPEM := newTestKey(t)
+	keys, err := ParsePublicKeys([]string{pubPEM})
+	if err != nil {
+		t.Fatalf("unexpected error from ParsePublicKeys(): %v", err)
+	}
+
+	token := signTestDocument(t, key, "", newTestDocument(now))
+	if _, err := VerifyIdentityDocument(token, keys, "another-audience", 0, now); err == nil {
+		t.Error("expected an error, got nil")
+	}
+}
+
+func TestIdentityDocumentFromVendorData(t *testing.T) {
+	vd := VendorData{
+		"spire": json.RawMessage(`{"identity_document": "token"}`),
+		"other": json.RawMessage(`{"foo": "bar"}`),
+	}
+
+	if got, err := IdentityDocumentFromVendorData(vd, "spire"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if got != "token" {
+		t.Errorf("got %v, want %v", got, "token")
+	}
+	if _, err := IdentityDocumentFromVendorData(vd, "other"); err == nil {
+		t.Error("expected an error, got nil")
+	}
+	if _, err := IdentityDocumentFromVendorData(vd, "missing"); err == nil {
+		t.Error("expected an error, got nil")
+	}
+}
@@ -0,0 +1,48 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gophercloud/gophercloud"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/testutil"
+)
+
+func TestIdentityListProjects(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/identity/v3/projects" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"projects": [{"id": "alpha", "name": "delta", "domain_id": "default", "parent_id": "default"}, {"id": "bravo", "name": "echo", "domain_id": "default", "parent_id": "alpha"}], "links": {}}`)
+	}))
+	defer ts.Close()
+
+	i := &Identity{
+		Logger: testutil.TestLogger(),
+		serviceClient: &gophercloud.ServiceClient{
+			ProviderClient: &gophercloud.ProviderClient{},
+			Endpoint:       ts.URL + "/identity/v3/",
+			Type:           "identity",
+		},
+	}
+	ps, err := i.ListProjects(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error from ListProjects(): %v", err)
+	}
+	if len(ps) != 2 || ps[0].ID != "alpha" || ps[1].Name != "echo" || ps[1].ParentID != "alpha" {
+		t.Errorf("unexpected projects: %+v", ps)
+	}
+}
@@ -8,36 +8,140 @@
 package openstack
 
 import (
+	"context"
+	"errors"
+	"fmt"
+
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/instanceactions"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/keypairs"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
 	"github.com/hashicorp/go-hclog"
 )
 
+// InstanceClient is the client of OpenStack Compute Service. The requests are cancelled when given context is done.
 type InstanceClient interface {
 	// Get retrieves a instance information from Provider
-	Get(uuid string) (*servers.Server, error)
+	Get(ctx context.Context, uuid string) (*Server, error)
+	// SetMetadata creates or replaces a metadata item of the instance
+	SetMetadata(ctx context.Context, uuid, key, value string) error
+	// DeleteMetadata deletes a metadata item from the instance
+	DeleteMetadata(ctx context.Context, uuid, key string) error
+	// GetKeyPair retrieves a keypair owned by given user. Getting the keypairs of other users requires
+	// the admin role under the default Nova policy.
+	GetKeyPair(ctx context.Context, name, userID string) (*keypairs.KeyPair, error)
+	// ListActions retrieves the action history of the instance
+	ListActions(ctx context.Context, uuid string) ([]instanceactions.InstanceAction, error)
+	// Region returns the region of the compute endpoint
+	Region() string
 }
 
+const (
+	// keypairUserIDMicroversion is the compute API microversion which allows getting keypairs of other users.
+	keypairUserIDMicroversion = "2.10"
+	// keyPairProbeName is the keypair and the user looked up to check the access to the keypairs of other users.
+	keyPairProbeName = "spire-openstack-plugin-probe"
+)
+
 // Instance represents a OpenStack Compute Service client
 type Instance struct {
 	Logger        hclog.Logger
 	serviceClient *gophercloud.ServiceClient
+	// microversion is the compute API microversion of the server requests.
+	microversion string
+	region       string
 }
 
-// NewInstance returns a new OpenStack Compute Service client with given provider
-func NewInstance(client *gophercloud.ProviderClient, logger hclog.Logger) (InstanceClient, error) {
-	sc, err := openstack.NewComputeV2(client, gophercloud.EndpointOpts{})
+// NewInstance returns a new OpenStack Compute Service client with given provider, at the endpoint selected by opts.
+// If the options give or require a microversion, it returns an error if the compute API doesn't support it.
+// If the options require the keypairs, it returns an error if the client is not allowed to get them.
+func NewInstance(ctx context.Context, client *gophercloud.ProviderClient, opts ComputeOptions, logger hclog.Logger) (InstanceClient, error) {
+	eo, err := opts.endpointOpts()
+	if err != nil {
+		return nil, err
+	}
+	microversion, err := opts.microversion()
 	if err != nil {
 		return nil, err
 	}
+	sc, err := openstack.NewComputeV2(client, eo)
+	if err != nil {
+		return nil, err
+	}
+	if microversion != "" {
+		if err := checkMicroversion(ctx, sc, microversion); err != nil {
+			return nil, err
+		}
+	}
+	if opts.KeyPairs {
+		if err := checkKeyPairAccess(ctx, sc); err != nil {
+			return nil, err
+		}
+	}
 	return &Instance{
 		Logger:        logger,
 		serviceClient: sc,
+		microversion:  microversion,
+		region:        opts.Region,
 	}, nil
 }
 
-func (i *Instance) Get(uuid string) (*servers.Server, error) {
+func (i *Instance) Get(ctx context.Context, uuid string) (*Server, error) {
 	i.Logger.Debug("Get Instance Information", "uuid", uuid)
-	return servers.Get(i.serviceClient, uuid).Extract()
+	sc := withContext(ctx, i.serviceClient)
+	sc.Microversion = i.microversion
+	s := &Server{}
+	if err := servers.Get(sc, uuid).ExtractInto(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (i *Instance) SetMetadata(ctx context.Context, uuid, key, value string) error {
+	i.Logger.Debug("Set Instance Metadata", "uuid", uuid, "key", key)
+	return servers.CreateMetadatum(withContext(ctx, i.serviceClient), uuid, servers.MetadatumOpts{key: value}).Err
+}
+
+func (i *Instance) DeleteMetadata(ctx context.Context, uuid, key string) error {
+	i.Logger.Debug("Delete Instance Metadata", "uuid", uuid, "key", key)
+	return servers.DeleteMetadatum(withContext(ctx, i.serviceClient), uuid, key).ExtractErr()
+}
+
+func (i *Instance) GetKeyPair(ctx context.Context, name, userID string) (*keypairs.KeyPair, error) {
+	i.Logger.Debug("Get KeyPair Information", "name", name, "user_id", userID)
+	sc := withContext(ctx, i.serviceClient)
+	sc.Microversion = keypairUserIDMicroversion
+	return keypairs.Get(sc, name, keypairs.GetOpts{UserID: userID}).Extract()
+}
+
+// checkKeyPairAccess returns an error if the client is not allowed to get the keypairs of other users.
+// Nova checks the policy before it looks up the keypair, so getting a keypair which doesn't exist fails
+// with 404 if it is allowed, and with 403 if not.
+func checkKeyPairAccess(ctx context.Context, sc *gophercloud.ServiceClient) error {
+	sc = withContext(ctx, sc)
+	sc.Microversion = keypairUserIDMicroversion
+	err := keypairs.Get(sc, keyPairProbeName, keypairs.GetOpts{UserID: keyPairProbeName}).Err
+	var notFound gophercloud.ErrDefault404
+	if err == nil || errors.As(err, &notFound) {
+		return nil
+	}
+	var forbidden gophercloud.ErrDefault403
+	if errors.As(err, &forbidden) {
+		return errors.New("keypair challenge requires getting the keypairs of other users, which Nova allows only to admins by default")
+	}
+	return fmt.Errorf("failed to check the access to keypairs: %w", err)
+}
+
+func (i *Instance) ListActions(ctx context.Context, uuid string) ([]instanceactions.InstanceAction, error) {
+	i.Logger.Debug("List Instance Actions", "uuid", uuid)
+	pages, err := instanceactions.List(withContext(ctx, i.serviceClient), uuid, nil).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	return instanceactions.ExtractInstanceActions(pages)
+}
+
+func (i *Instance) Region() string {
+	return i.region
 }
@@ -0,0 +1,99 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/extendedstatus"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/testutil"
+)
+
+const getServerResponse = `
+{
+  "server": {
+    "id": "alpha",
+    "tenant_id": "bravo",
+    "status": "ACTIVE",
+    "image": {"id": "charlie"},
+    "created": "2021-09-01T00:00:00Z",
+    "updated": "2021-09-01T00:00:00Z",
+    "locked": true,
+    "OS-EXT-STS:vm_state": "active",
+    "OS-EXT-STS:task_state": null,
+    "OS-EXT-STS:power_state": 1
+  }
+}
+`
+
+func newTestInstance(t *testing.T, handler http.HandlerFunc) *Instance {
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	return &Instance{
+		Logger: testutil.TestLogger(),
+		serviceClient: &gophercloud.ServiceClient{
+			ProviderClient: &gophercloud.ProviderClient{},
+			Endpoint:       ts.URL + "/",
+			Type:           "compute",
+		},
+		microversion: serverLockedMicroversion,
+	}
+}
+
+func TestInstanceGet(t *testing.T) {
+	i := newTestInstance(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/servers/alpha" {
+			http.NotFound(w, r)
+			return
+		}
+		if v := r.Header.Get("X-OpenStack-Nova-API-Version"); v != serverLockedMicroversion {
+			http.Error(w, fmt.Sprintf("unexpected microversion %q", v), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, getServerResponse)
+	})
+
+	s, err := i.Get(context.Background(), "alpha")
+	if err != nil {
+		t.Fatalf("unexpected error from Get(): %v", err)
+	}
+	if s.ID != "alpha" || s.TenantID != "bravo" || s.Status != "ACTIVE" || s.Image["id"] != "charlie" {
+		t.Errorf("unexpected server: %+v", s.Server)
+	}
+	if s.VmState != "active" || s.TaskState != "" || s.PowerState != extendedstatus.RUNNING {
+		t.Errorf("unexpected extended status: %+v", s.ServerExtendedStatusExt)
+	}
+	if s.Locked == nil || !*s.Locked {
+		t.Errorf("got locked %v, want true", s.Locked)
+	}
+}
+
+func TestInstanceGetContext(t *testing.T) {
+	done := make(chan struct{})
+	i := newTestInstance(t, func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	})
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := i.Get(ctx, "alpha")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -13,11 +13,24 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 )
 
 const (
 	defaultMetadataVersion = "latest"
-	metadataURLTemplate    = "http://169.254.169.254/openstack/%s/meta_data.json"
+	defaultMetadataURL     = "http://169.254.169.254"
+	defaultMetadataTimeout = 10 * time.Second
+	metadataPathTemplate   = "/openstack/%s/meta_data.json"
+	vendorDataPathTemplate = "/openstack/%s/vendor_data2.json"
+
+	// metadataIPv6Address is the IPv6 link-local address of the metadata service.
+	metadataIPv6Address = "fe80::a9fe:a9fe"
+	maxRetryInterval    = 30 * time.Second
+)
+
+var (
+	// errMetadataNotFound is returned when the metadata service doesn't serve the version.
+	errMetadataNotFound = errors.New("metadata not found")
 )
 
 // Metadata represents the information fetched from OpenStack metadata service
@@ -26,24 +39,137 @@ type Metadata struct {
 	Name             string `json:"name"`
 	AvailabilityZone string `json:"availability_zone"`
 	ProjectID        string `json:"project_id"`
+	Hostname         string `json:"hostname"`
+	// Meta is the user provided metadata of the instance
+	Meta map[string]string `json:"meta"`
 	// we don't care any other fields.
 }
 
+// VendorData represents the dynamic vendordata (vendor_data2.json) fetched from OpenStack metadata service.
+// Each entry is keyed by the name of the vendordata service which provided it.
+type VendorData map[string]json.RawMessage
+
+// MetadataServiceOptions are the options to access the metadata service.
+type MetadataServiceOptions struct {
+	// URL is the base URL of the metadata service. Defaults to "http://169.254.169.254".
+	URL string
+	// Versions are the metadata API versions, which are tried in order until the metadata service
+	// serves one of them. Defaults to ["latest"].
+	Versions []string
+	// Timeout is the timeout of each request. Defaults to 10 seconds.
+	Timeout time.Duration
+	// Retries is the number of retries when the metadata service is unreachable.
+	Retries int
+	// RetryInterval is the interval before the first retry, which doubles on every retry.
+	RetryInterval time.Duration
+}
+
+// MetadataIPv6URL returns the URL of the metadata service at the IPv6 link-local address,
+// reached through given network interface.
+func MetadataIPv6URL(iface string) string {
+	return fmt.Sprintf("http://[%s%%25%s]", metadataIPv6Address, iface)
+}
+
+// MetadataService is the metadata source which reads the OpenStack metadata service.
+type MetadataService struct {
+	opts   MetadataServiceOptions
+	client *http.Client
+	sleep  func(time.Duration)
+}
+
+// NewMetadataService returns the metadata source which reads the OpenStack metadata service.
+func NewMetadataService(opts MetadataServiceOptions) *MetadataService {
+	if opts.URL == "" {
+		opts.URL = defaultMetadataURL
+	}
+	if len(opts.Versions) == 0 {
+		opts.Versions = []string{defaultMetadataVersion}
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultMetadataTimeout
+	}
+	return &MetadataService{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+		sleep:  time.Sleep,
+	}
+}
+
+func (s *MetadataService) Name() string {
+	return MetadataSourceMetadataService
+}
+
+func (s *MetadataService) Metadata() (*Metadata, error) {
+	var metadata *Metadata
+	err := s.get(metadataPathTemplate, func(r io.Reader) (err error) {
+		metadata, err = parseMetadata(r)
+		return err
+	})
+	return metadata, err
+}
+
+func (s *MetadataService) VendorData() (VendorData, error) {
+	var vd VendorData
+	err := s.get(vendorDataPathTemplate, func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(&vd)
+	})
+	return vd, err
+}
+
+// get fetches the document of the first version the metadata service serves.
+func (s *MetadataService) get(pathTemplate string, parse func(io.Reader) error) error {
+	var err error
+	for _, version := range s.opts.Versions {
+		err = s.fetch(s.opts.URL+fmt.Sprintf(pathTemplate, version), parse)
+		if !errors.Is(err, errMetadataNotFound) {
+			return err
+		}
+	}
+	return err
+}
+
+// fetch fetches the document at given URL, retrying with backoff while the metadata service is
+// unavailable, e.g. the network isn't up yet at boot.
+func (s *MetadataService) fetch(url string, parse func(io.Reader) error) error {
+	interval := s.opts.RetryInterval
+	for attempt := 0; ; attempt++ {
+		err := fetch(s.client, url, parse)
+		if err == nil || errors.Is(err, errMetadataNotFound) || attempt >= s.opts.Retries {
+			return err
+		}
+
+		s.sleep(interval)
+		if interval *= 2; interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
+}
+
 // GetMetadataFromMetadataService gets metadata from OpenStack Metadata service.
 func GetMetadataFromMetadataService() (*Metadata, error) {
-	metadataURL := getMetadataURL(defaultMetadataVersion)
-	resp, err := http.Get(metadataURL)
+	return NewMetadataService(MetadataServiceOptions{}).Metadata()
+}
+
+// GetVendorDataFromMetadataService gets dynamic vendordata from OpenStack Metadata service.
+func GetVendorDataFromMetadataService() (VendorData, error) {
+	return NewMetadataService(MetadataServiceOptions{}).VendorData()
+}
+
+func fetch(client *http.Client, url string, parse func(io.Reader) error) error {
+	resp, err := client.Get(url)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching metadata from %s: %v", metadataURL, err)
+		return fmt.Errorf("error fetching metadata from %s: %v", url, err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("unexpected status code when reading metadata from %s: %s", metadataURL, resp.Status)
-		return nil, err
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%w at %s", errMetadataNotFound, url)
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("unexpected status code when reading metadata from %s: %s", url, resp.Status)
 	}
 
-	return parseMetadata(resp.Body)
+	return parse(resp.Body)
 }
 
 func parseMetadata(r io.Reader) (*Metadata, error) {
@@ -59,7 +185,3 @@ func parseMetadata(r io.Reader) (*Metadata, error) {
 
 	return &metadata, nil
 }
-
-func getMetadataURL(metadataVersion string) string {
-	return fmt.Sprintf(metadataURLTemplate, metadataVersion)
-}
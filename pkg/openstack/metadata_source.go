@@ -0,0 +1,142 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// MetadataSourceMetadataService reads the OpenStack metadata service.
+	MetadataSourceMetadataService = "metadata_service"
+	// MetadataSourceConfigDrive reads the config drive.
+	MetadataSourceConfigDrive = "config_drive"
+	// MetadataSourceCloudInit reads the instance data cached by cloud-init.
+	MetadataSourceCloudInit = "cloud_init"
+	// MetadataSourceEC2 reads the EC2-compatible metadata API. It doesn't provide the instance UUID,
+	// so it must be followed by other sources.
+	MetadataSourceEC2 = "ec2"
+)
+
+// MetadataSource provides the instance metadata.
+type MetadataSource interface {
+	// Name returns the name of the source.
+	Name() string
+	// Metadata returns the instance metadata. Fields the source doesn't know are empty.
+	Metadata() (*Metadata, error)
+}
+
+// VendorDataSource provides the dynamic vendordata.
+type VendorDataSource interface {
+	// VendorData returns the dynamic vendordata (vendor_data2.json).
+	VendorData() (VendorData, error)
+}
+
+// MetadataSourceOptions are the options to create metadata sources.
+type MetadataSourceOptions struct {
+	// ConfigDrivePath is the directory the config drive is mounted on.
+	// If it is empty, the config drive is mounted temporarily.
+	ConfigDrivePath string
+	// MetadataService are the options to access the metadata service, which are shared by the
+	// metadata_service and ec2 sources.
+	MetadataService MetadataServiceOptions
+}
+
+// NewMetadataSource returns the metadata source of given name.
+func NewMetadataSource(name string, opts MetadataSourceOptions) (MetadataSource, error) {
+	switch name {
+	case MetadataSourceMetadataService:
+		return NewMetadataService(opts.MetadataService), nil
+	case MetadataSourceConfigDrive:
+		return &ConfigDrive{Path: opts.ConfigDrivePath}, nil
+	case MetadataSourceCloudInit:
+		return &CloudInit{Path: cloudInitInstanceDataPath}, nil
+	case MetadataSourceEC2:
+		return &EC2MetadataService{Service: NewMetadataService(opts.MetadataService)}, nil
+	default:
+		return nil, fmt.Errorf("unknown metadata source: %q", name)
+	}
+}
+
+// MetadataSources is an ordered list of metadata sources, which are tried in turn.
+type MetadataSources []MetadataSource
+
+// Metadata returns the instance metadata from the sources. Sources are tried in order until the instance
+// UUID is found. Fields found by the earlier sources take precedence, and the later sources only fill in
+// empty fields.
+func (s MetadataSources) Metadata() (*Metadata, error) {
+	var merged *Metadata
+	var errs []string
+	for _, source := range s {
+		meta, err := source.Metadata()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", source.Name(), err))
+			continue
+		}
+		merged = mergeMetadata(merged, meta)
+		if merged.UUID != "" {
+			return merged, nil
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("no metadata source provided the instance uuid: %s", strings.Join(errs, "; "))
+	}
+	return nil, errors.New("no metadata source provided the instance uuid")
+}
+
+// VendorData returns the dynamic vendordata from the first source which provides it.
+func (s MetadataSources) VendorData() (VendorData, error) {
+	var errs []string
+	for _, source := range s {
+		vs, ok := source.(VendorDataSource)
+		if !ok {
+			continue
+		}
+		vd, err := vs.VendorData()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", source.Name(), err))
+			continue
+		}
+		return vd, nil
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("failed to get vendordata: %s", strings.Join(errs, "; "))
+	}
+	return nil, errors.New("no metadata source provides vendordata")
+}
+
+// mergeMetadata fills empty fields of dst with src.
+func mergeMetadata(dst, src *Metadata) *Metadata {
+	if dst == nil {
+		m := *src
+		return &m
+	}
+	if dst.UUID == "" {
+		dst.UUID = src.UUID
+	}
+	if dst.Name == "" {
+		dst.Name = src.Name
+	}
+	if dst.AvailabilityZone == "" {
+		dst.AvailabilityZone = src.AvailabilityZone
+	}
+	if dst.ProjectID == "" {
+		dst.ProjectID = src.ProjectID
+	}
+	if dst.Hostname == "" {
+		dst.Hostname = src.Hostname
+	}
+	if dst.Meta == nil {
+		dst.Meta = src.Meta
+	}
+	return dst
+}
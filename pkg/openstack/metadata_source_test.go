@@ -0,0 +1,231 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testMetaData = `{
+  "uuid": "alpha",
+  "name": "bravo",
+  "availability_zone": "charlie",
+  "project_id": "delta",
+  "hostname": "bravo.novalocal",
+  "meta": {"role": "web"}
+}`
+
+type fakeMetadataSource struct {
+	meta *Metadata
+	err  error
+}
+
+func (f *fakeMetadataSource) Name() string {
+	return "fake"
+}
+
+func (f *fakeMetadataSource) Metadata() (*Metadata, error) {
+	return f.meta, f.err
+}
+
+func TestMetadataSources(t *testing.T) {
+	full := &Metadata{UUID: "alpha", Name: "bravo", AvailabilityZone: "charlie", ProjectID: "delta"}
+
+	for i, tc := range []struct {
+		sources MetadataSources
+		want    *Metadata
+		wantErr string
+	}{
+		// 0: the first source is used
+		{
+			sources: MetadataSources{&fakeMetadataSource{meta: full}, &fakeMetadataSource{err: errors.New("unused")}},
+			want:    full,
+		},
+		// 1: fallback to the next source
+		{
+			sources: MetadataSources{&fakeMetadataSource{err: errors.New("unreachable")}, &fakeMetadataSource{meta: full}},
+			want:    full,
+		},
+		// 2: the later source fills in the fields
+		{
+			sources: MetadataSources{
+				&fakeMetadataSource{meta: &Metadata{AvailabilityZone: "echo", Hostname: "foxtrot"}},
+				&fakeMetadataSource{meta: full},
+			},
+			want: &Metadata{UUID: "alpha", Name: "bravo", AvailabilityZone: "echo", ProjectID: "delta", Hostname: "foxtrot"},
+		},
+		// 3: no uuid
+		{
+			sources: MetadataSources{
+				&fakeMetadataSource{meta: &Metadata{Hostname: "foxtrot"}},
+				&fakeMetadataSource{err: errors.New("unreachable")},
+			},
+			wantErr: "no metadata source provided the instance uuid: fake: unreachable",
+		},
+	} {
+		got, err := tc.sources.Metadata()
+		if tc.wantErr != "" {
+			if err == nil {
+				t.Errorf("#%v: expected an error, got nil", i)
+			} else if err.Error() != tc.wantErr {
+				t.Errorf("#%v: got %v, want %v", i, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("#%v: got %+v, want %+v", i, got, tc.want)
+		}
+	}
+}
+
+func TestConfigDrive(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "openstack", "latest"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, configDriveMetadataPath), []byte(testMetaData), 0644); err != nil {
+		t.Fatalf("failed to write metadata: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, configDriveVendorDataPath), []byte(`{"spire": {"identity_document": "token"}}`), 0644); err != nil {
+		t.Fatalf("failed to write vendordata: %v", err)
+	}
+
+	c := &ConfigDrive{Path: dir}
+	meta, err := c.Metadata()
+	if err != nil {
+		t.Fatalf("unexpected error from Metadata(): %v", err)
+	}
+	if meta.UUID != "alpha" || meta.ProjectID != "delta" || meta.Meta["role"] != "web" {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+
+	vd, err := MetadataSources{&EC2MetadataService{}, c}.VendorData()
+	if err != nil {
+		t.Fatalf("unexpected error from VendorData(): %v", err)
+	}
+	if doc, err := IdentityDocumentFromVendorData(vd, "spire"); err != nil || doc != "token" {
+		t.Errorf("got identity document %v (%v), want token", doc, err)
+	}
+}
+
+func TestConfigDriveMountOnce(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "openstack", "latest"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, configDriveMetadataPath), []byte(testMetaData), 0644); err != nil {
+		t.Fatalf("failed to write metadata: %v", err)
+	}
+
+	mounts, unmounts := 0, 0
+	c := &ConfigDrive{
+		mount: func() (string, func() error, error) {
+			mounts++
+			return dir, func() error {
+				unmounts++
+				return nil
+			}, nil
+		},
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.Metadata(); err != nil {
+			t.Fatalf("unexpected error from Metadata(): %v", err)
+		}
+	}
+	if mounts != 1 || unmounts != 1 {
+		t.Errorf("got %v mounts and %v unmounts, want 1", mounts, unmounts)
+	}
+
+	// Missing files are not cached.
+	for i := 0; i < 2; i++ {
+		if _, err := c.VendorData(); err == nil {
+			t.Error("expected an error, got nil")
+		}
+	}
+	if mounts != 3 {
+		t.Errorf("got %v mounts, want 3", mounts)
+	}
+}
+
+func TestCloudInit(t *testing.T) {
+	for i, tc := range []struct {
+		data string
+		want *Metadata
+	}{
+		// 0: OpenStack datasource
+		{
+			data: fmt.Sprintf(`{"v1": {"instance_id": "alpha", "local_hostname": "bravo"}, "ds": {"meta_data": %s}}`, testMetaData),
+			want: &Metadata{
+				UUID:             "alpha",
+				Name:             "bravo",
+				AvailabilityZone: "charlie",
+				ProjectID:        "delta",
+				Hostname:         "bravo.novalocal",
+				Meta:             map[string]string{"role": "web"},
+			},
+		},
+		// 1: standardized instance data only
+		{
+			data: `{"v1": {"instance_id": "alpha", "availability_zone": "charlie", "local_hostname": "bravo"}}`,
+			want: &Metadata{
+				UUID:             "alpha",
+				AvailabilityZone: "charlie",
+				Hostname:         "bravo",
+			},
+		},
+	} {
+		path := filepath.Join(t.TempDir(), "instance-data.json")
+		if err := ioutil.WriteFile(path, []byte(tc.data), 0644); err != nil {
+			t.Fatalf("#%v: failed to write instance data: %v", i, err)
+		}
+
+		got, err := (&CloudInit{Path: path}).Metadata()
+		if err != nil {
+			t.Errorf("#%v: unexpected error from Metadata(): %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("#%v: got %+v, want %+v", i, got, tc.want)
+		}
+	}
+}
+
+func TestEC2MetadataService(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/meta-data/hostname":
+			fmt.Fprint(w, "bravo.novalocal")
+		case "/latest/meta-data/placement/availability-zone":
+			fmt.Fprint(w, "charlie")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	got, err := (&EC2MetadataService{URL: ts.URL + "/latest/meta-data/"}).Metadata()
+	if err != nil {
+		t.Fatalf("unexpected error from Metadata(): %v", err)
+	}
+	want := &Metadata{Hostname: "bravo.novalocal", AvailabilityZone: "charlie"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
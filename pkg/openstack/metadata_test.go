@@ -0,0 +1,136 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetadataServiceVersionFallback(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path != "/openstack/2018-08-27/meta_data.json" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, testMetaData)
+	}))
+	defer ts.Close()
+
+	s := NewMetadataService(MetadataServiceOptions{
+		URL:      ts.URL,
+		Versions: []string{"latest", "2018-08-27", "2017-02-22"},
+	})
+	meta, err := s.Metadata()
+	if err != nil {
+		t.Fatalf("unexpected error from Metadata(): %v", err)
+	}
+	if meta.UUID != "alpha" {
+		t.Errorf("got uuid %q, want alpha", meta.UUID)
+	}
+	want := []string{"/openstack/latest/meta_data.json", "/openstack/2018-08-27/meta_data.json"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("got requests %v, want %v", paths, want)
+	}
+}
+
+func TestMetadataServiceRetry(t *testing.T) {
+	for i, tc := range []struct {
+		failures  int
+		retries   int
+		expectErr bool
+		sleeps    []time.Duration
+	}{
+		// 0: no failure
+		{
+			retries: 3,
+		},
+		// 1: succeed after retries with backoff
+		{
+			failures: 2,
+			retries:  3,
+			sleeps:   []time.Duration{time.Second, 2 * time.Second},
+		},
+		// 2: give up after retries
+		{
+			failures:  5,
+			retries:   2,
+			expectErr: true,
+			sleeps:    []time.Duration{time.Second, 2 * time.Second},
+		},
+		// 3: no retry
+		{
+			failures:  1,
+			expectErr: true,
+		},
+	} {
+		requests := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests <= tc.failures {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, testMetaData)
+		}))
+
+		var sleeps []time.Duration
+		s := NewMetadataService(MetadataServiceOptions{
+			URL:           ts.URL,
+			Retries:       tc.retries,
+			RetryInterval: time.Second,
+		})
+		s.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+		_, err := s.Metadata()
+		ts.Close()
+		if tc.expectErr != (err != nil) {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(sleeps, tc.sleeps) {
+			t.Errorf("#%v: got sleeps %v, want %v", i, sleeps, tc.sleeps)
+		}
+	}
+}
+
+func TestMetadataServiceNotFound(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	s := NewMetadataService(MetadataServiceOptions{URL: ts.URL, Retries: 3})
+	s.sleep = func(time.Duration) { t.Error("unexpected retry") }
+	if _, err := s.Metadata(); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestMetadataServiceTimeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	s := NewMetadataService(MetadataServiceOptions{URL: ts.URL, Timeout: 10 * time.Millisecond})
+	if _, err := s.Metadata(); err == nil {
+		t.Error("expected timeout error, got nil")
+	}
+}
+
+func TestMetadataIPv6URL(t *testing.T) {
+	if got, want := MetadataIPv6URL("eth0"), "http://[fe80::a9fe:a9fe%25eth0]"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
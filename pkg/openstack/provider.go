@@ -8,26 +8,74 @@
 package openstack
 
 import (
+	"context"
+	"net/http"
+
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
 	"github.com/gophercloud/utils/openstack/clientconfig"
 )
 
-// NewProvider returns a new authenticated ProviderClient
-func NewProvider(cloudName string) (*gophercloud.ProviderClient, error) {
-	opts := &clientconfig.ClientOpts{
-		Cloud: cloudName,
-	}
-	authOpts, err := clientconfig.AuthOptions(opts)
+// NewProvider returns a new authenticated ProviderClient. The requests, including the authentication,
+// are retried and guarded by the circuit breakers, and sent over TLS as configured by opts.
+// Every service client created from the ProviderClient shares them.
+func NewProvider(auth AuthOptions, opts ProviderOptions) (*gophercloud.ProviderClient, error) {
+	authOpts, err := clientconfig.AuthOptions(auth.clientOpts())
 	if err != nil {
 		return nil, err
 	}
 	authOpts.AllowReauth = true
 
-	provider, err := openstack.AuthenticatedClient(*authOpts)
+	provider, err := openstack.NewClient(authOpts.IdentityEndpoint)
 	if err != nil {
 		return nil, err
 	}
+	base, err := newBaseTransport(opts.TLS)
+	if err != nil {
+		return nil, err
+	}
+	provider.HTTPClient = http.Client{
+		Transport: newTransport(base, opts),
+	}
+	if err := openstack.Authenticate(provider, *authOpts); err != nil {
+		return nil, err
+	}
 
 	return provider, nil
 }
+
+// withContext returns a copy of the service client whose requests are bound to given context.
+// The copy has its own token, which it takes from the original provider when it is created, and again
+// whenever a request is rejected with 401. The re-authentication itself is done by the original provider,
+// which runs it once for the concurrent requests, so that every copy waiting on it picks up the new token.
+func withContext(ctx context.Context, sc *gophercloud.ServiceClient) *gophercloud.ServiceClient {
+	provider := sc.ProviderClient
+	pc := &gophercloud.ProviderClient{
+		IdentityBase:      provider.IdentityBase,
+		IdentityEndpoint:  provider.IdentityEndpoint,
+		EndpointLocator:   provider.EndpointLocator,
+		HTTPClient:        provider.HTTPClient,
+		UserAgent:         provider.UserAgent,
+		Throwaway:         provider.IsThrowaway(),
+		Context:           ctx,
+		RetryBackoffFunc:  provider.RetryBackoffFunc,
+		MaxBackoffRetries: provider.MaxBackoffRetries,
+		RetryFunc:         provider.RetryFunc,
+	}
+	pc.UseTokenLock()
+	pc.CopyTokenFrom(provider)
+	if provider.ReauthFunc != nil {
+		pc.ReauthFunc = func() error {
+			// The provider skips the re-authentication if its token is already newer than the one rejected.
+			if err := provider.Reauthenticate(pc.Token()); err != nil {
+				return err
+			}
+			pc.CopyTokenFrom(provider)
+			return nil
+		}
+	}
+
+	c := *sc
+	c.ProviderClient = pc
+	return &c
+}
@@ -0,0 +1,74 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+func TestWithContextReauth(t *testing.T) {
+	const requests = 10
+
+	var mtx sync.Mutex
+	rejected := 0
+	allRejected := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Auth-Token") != "new-token" {
+			mtx.Lock()
+			rejected++
+			if rejected == requests {
+				close(allRejected)
+			}
+			mtx.Unlock()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	provider := &gophercloud.ProviderClient{}
+	provider.UseTokenLock()
+	provider.SetToken("expired-token")
+	reauths := 0
+	provider.ReauthFunc = func() error {
+		reauths++
+		// Re-authenticate while all the requests wait on it.
+		select {
+		case <-allRejected:
+		case <-time.After(5 * time.Second):
+		}
+		provider.SetToken("new-token")
+		return nil
+	}
+	sc := &gophercloud.ServiceClient{ProviderClient: provider, Endpoint: ts.URL + "/"}
+
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			_, err := withContext(context.Background(), sc).Get(ts.URL+"/servers/alpha", nil, nil)
+			errs <- err
+		}()
+	}
+	for i := 0; i < requests; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if reauths != 1 {
+		t.Errorf("got %v re-authentications, want 1", reauths)
+	}
+}
@@ -0,0 +1,55 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/availabilityzones"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/extendedserverattributes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/extendedstatus"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+)
+
+const (
+	// serverLockedMicroversion is the compute API microversion which reports the lock state of servers.
+	serverLockedMicroversion = "2.9"
+)
+
+// Server represents the instance information including the extended attributes.
+// All fields must be embedded structs, so that gophercloud decodes each of them from the response.
+type Server struct {
+	servers.Server
+	extendedstatus.ServerExtendedStatusExt
+	availabilityzones.ServerAvailabilityZoneExt
+	extendedserverattributes.ServerAttributesExt
+	ServerLockedExt
+}
+
+// ServerLockedExt represents the lock state of the server.
+type ServerLockedExt struct {
+	// Locked is nil if the compute API doesn't report the lock state.
+	Locked *bool `json:"locked"`
+}
+
+// IsRescued returns true if the instance is booted from the rescue image.
+func (s *Server) IsRescued() bool {
+	return s.Status == "RESCUE" || s.VmState == "rescued"
+}
+
+// ImageID returns the ID of the image the instance was booted from.
+// It is empty for volume-backed instances.
+func (s *Server) ImageID() string {
+	id, _ := s.Image["id"].(string)
+	return id
+}
+
+// FlavorName returns the name of the flavor embedded in the server, which the compute API reports
+// from microversion 2.47. It is empty at the lower microversions.
+func (s *Server) FlavorName() string {
+	name, _ := s.Flavor["original_name"].(string)
+	return name
+}
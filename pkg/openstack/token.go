@@ -0,0 +1,78 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"context"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
+	"github.com/hashicorp/go-hclog"
+)
+
+type TokenClient interface {
+	// Validate validates the token and returns the information about it
+	Validate(ctx context.Context, token string) (*TokenInfo, error)
+}
+
+// TokenInfo is the information about a validated token
+type TokenInfo struct {
+	// UserID and UserName identify the user the token was issued to
+	UserID   string
+	UserName string
+	// Roles are the names of the roles assigned to the token
+	Roles     []string
+	ExpiresAt time.Time
+}
+
+// Token represents a OpenStack Identity Service client which validates tokens
+type Token struct {
+	Logger        hclog.Logger
+	serviceClient *gophercloud.ServiceClient
+}
+
+// NewToken returns a new OpenStack Identity Service client with given provider
+func NewToken(client *gophercloud.ProviderClient, logger hclog.Logger) (TokenClient, error) {
+	sc, err := openstack.NewIdentityV3(client, gophercloud.EndpointOpts{})
+	if err != nil {
+		return nil, err
+	}
+	return &Token{
+		Logger:        logger,
+		serviceClient: sc,
+	}, nil
+}
+
+func (t *Token) Validate(ctx context.Context, token string) (*TokenInfo, error) {
+	t.Logger.Debug("Validate Token")
+	r := tokens.Get(withContext(ctx, t.serviceClient), token)
+	tok, err := r.ExtractToken()
+	if err != nil {
+		return nil, err
+	}
+	user, err := r.ExtractUser()
+	if err != nil {
+		return nil, err
+	}
+	roles, err := r.ExtractRoles()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &TokenInfo{
+		UserID:    user.ID,
+		UserName:  user.Name,
+		ExpiresAt: tok.ExpiresAt,
+	}
+	for _, r := range roles {
+		info.Roles = append(info.Roles, r.Name)
+	}
+	return info, nil
+}
@@ -0,0 +1,339 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrCircuitOpen is returned without sending the request while the circuit breaker of the API endpoint is open.
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+// RetryOptions configures the retries of idempotent requests which failed with a connection error,
+// a 5xx or a 429 response.
+type RetryOptions struct {
+	// MaxRetries is the maximum number of retries. Zero disables retries.
+	MaxRetries int
+	// BaseDelay is the delay before the first retry, which doubles on every retry with jitter.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay before each retry, including the one requested by Retry-After.
+	MaxDelay time.Duration
+}
+
+// CircuitBreakerOptions configures the circuit breaker, which fails requests to an API endpoint fast
+// after consecutive failures, until ResetTimeout elapses and a probe request succeeds.
+type CircuitBreakerOptions struct {
+	// FailureThreshold is the number of consecutive failures which opens the circuit. Zero disables the circuit breaker.
+	FailureThreshold int
+	// ResetTimeout is the time the circuit stays open before a probe request is let through.
+	ResetTimeout time.Duration
+}
+
+// TLSOptions configures TLS of the connections to the OpenStack API endpoints.
+type TLSOptions struct {
+	// CAFile is the path to the PEM encoded CA certificates to verify the endpoints with,
+	// instead of the system roots.
+	CAFile string
+	// CertFile and KeyFile are the paths to the PEM encoded client certificate and its private key.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the server name to verify the certificates of the endpoints with.
+	ServerName string
+	// MinVersion is the minimum TLS version, such as tls.VersionTLS12. Defaults to the Go default.
+	MinVersion uint16
+}
+
+// ProviderOptions are the options of the ProviderClient.
+type ProviderOptions struct {
+	Retry          RetryOptions
+	CircuitBreaker CircuitBreakerOptions
+	TLS            TLSOptions
+}
+
+// tlsConfig returns the TLS configuration, or nil if no option is given.
+func (o TLSOptions) tlsConfig() (*tls.Config, error) {
+	if o == (TLSOptions{}) {
+		return nil, nil
+	}
+
+	c := &tls.Config{
+		ServerName: o.ServerName,
+		MinVersion: o.MinVersion,
+	}
+	if o.CAFile != "" {
+		b, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in CA file %s", o.CAFile)
+		}
+		c.RootCAs = pool
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// newBaseTransport returns the http.RoundTripper to send requests with, which has given TLS configuration.
+func newBaseTransport(opts TLSOptions) (http.RoundTripper, error) {
+	c, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if c != nil {
+		t.TLSClientConfig = c
+	}
+	return t, nil
+}
+
+// DefaultProviderOptions returns the options which retry 3 times and open the circuit after 5 consecutive failures.
+func DefaultProviderOptions() ProviderOptions {
+	return ProviderOptions{
+		Retry: RetryOptions{
+			MaxRetries: 3,
+			BaseDelay:  200 * time.Millisecond,
+			MaxDelay:   5 * time.Second,
+		},
+		CircuitBreaker: CircuitBreakerOptions{
+			FailureThreshold: 5,
+			ResetTimeout:     30 * time.Second,
+		},
+	}
+}
+
+// transport is the http.RoundTripper which retries transient failures and breaks the circuit
+// while an API endpoint is down. The circuit breakers are kept per host, so that Keystone and Nova
+// are tracked separately.
+type transport struct {
+	next  http.RoundTripper
+	retry RetryOptions
+	cb    CircuitBreakerOptions
+
+	mtx      sync.Mutex
+	breakers map[string]*circuitBreaker
+
+	now    func() time.Time
+	jitter func(time.Duration) time.Duration
+}
+
+// newTransport wraps given http.RoundTripper with retries and circuit breakers.
+func newTransport(next http.RoundTripper, opts ProviderOptions) *transport {
+	return &transport{
+		next:     next,
+		retry:    opts.Retry,
+		cb:       opts.CircuitBreaker,
+		breakers: make(map[string]*circuitBreaker),
+		now:      time.Now,
+		jitter:   jitter,
+	}
+}
+
+// jitter returns a random delay between the half of given delay and the delay.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cb := t.breaker(req.URL.Host)
+	for attempt := 0; ; attempt++ {
+		if !cb.allow(t.now()) {
+			return nil, fmt.Errorf("%w: %s", ErrCircuitOpen, req.URL.Host)
+		}
+
+		resp, err := t.next.RoundTrip(req)
+		if req.Context().Err() != nil {
+			// A cancelled request tells nothing about the endpoint.
+			cb.abort()
+			return resp, err
+		}
+		failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+		cb.record(!failed, t.now())
+
+		if !isRetryable(resp, err) || !isIdempotent(req) || attempt >= t.retry.MaxRetries {
+			return resp, err
+		}
+
+		delay := t.backoff(attempt, resp)
+		if resp != nil {
+			// Let the connection be reused.
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// backoff returns the delay before the retry, which is the one requested by Retry-After if any.
+func (t *transport) backoff(attempt int, resp *http.Response) time.Duration {
+	if d, ok := retryAfter(resp, t.now()); ok {
+		return t.capDelay(d)
+	}
+
+	d := t.retry.BaseDelay
+	for i := 0; i < attempt && (t.retry.MaxDelay == 0 || d < t.retry.MaxDelay); i++ {
+		d *= 2
+	}
+	return t.jitter(t.capDelay(d))
+}
+
+func (t *transport) capDelay(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	if t.retry.MaxDelay > 0 && d > t.retry.MaxDelay {
+		return t.retry.MaxDelay
+	}
+	return d
+}
+
+func (t *transport) breaker(host string) *circuitBreaker {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	cb, ok := t.breakers[host]
+	if !ok {
+		cb = &circuitBreaker{
+			threshold:    t.cb.FailureThreshold,
+			resetTimeout: t.cb.ResetTimeout,
+		}
+		t.breakers[host] = cb
+	}
+	return cb
+}
+
+// isRetryable returns true if the request failed with a connection error, a 5xx or a 429 response.
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// isIdempotent returns true if the request can be sent again safely.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return req.Body == nil || req.Body == http.NoBody
+	default:
+		return false
+	}
+}
+
+// retryAfter parses the Retry-After header, which is either seconds or an HTTP date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// circuitBreaker tracks consecutive failures of an API endpoint.
+type circuitBreaker struct {
+	threshold    int
+	resetTimeout time.Duration
+
+	mtx      sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+	probing  bool
+}
+
+// allow returns true if a request may be sent. Once ResetTimeout elapses after the circuit opened,
+// a single probe request is let through.
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	if cb.threshold <= 0 {
+		return true
+	}
+
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	if !cb.open {
+		return true
+	}
+	if cb.probing || now.Sub(cb.openedAt) < cb.resetTimeout {
+		return false
+	}
+	cb.probing = true
+	return true
+}
+
+// abort lets another probe request through, when the probe request was cancelled.
+func (cb *circuitBreaker) abort() {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	cb.probing = false
+}
+
+// record records the result of a request.
+func (cb *circuitBreaker) record(success bool, now time.Time) {
+	if cb.threshold <= 0 {
+		return
+	}
+
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	if success {
+		cb.failures = 0
+		cb.open = false
+		cb.probing = false
+		return
+	}
+
+	cb.failures++
+	if cb.probing || cb.failures >= cb.threshold {
+		cb.open = true
+		cb.openedAt = now
+		cb.probing = false
+	}
+}
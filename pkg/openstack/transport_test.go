@@ -0,0 +1,360 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestTransport(opts ProviderOptions) *transport {
+	t := newTransport(http.DefaultTransport, opts)
+	t.jitter = func(d time.Duration) time.Duration { return d }
+	return t
+}
+
+func TestTransportRetry(t *testing.T) {
+	for i, tc := range []struct {
+		method     string
+		statuses   []int
+		maxRetries int
+		wantStatus int
+		wantCalls  int
+	}{
+		// 0: success
+		{
+			method:     http.MethodGet,
+			statuses:   []int{http.StatusOK},
+			maxRetries: 3,
+			wantStatus: http.StatusOK,
+			wantCalls:  1,
+		},
+		// 1: succeed after transient failures
+		{
+			method:     http.MethodGet,
+			statuses:   []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+			maxRetries: 3,
+			wantStatus: http.StatusOK,
+			wantCalls:  3,
+		},
+		// 2: give up after retries
+		{
+			method:     http.MethodGet,
+			statuses:   []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			maxRetries: 2,
+			wantStatus: http.StatusBadGateway,
+			wantCalls:  3,
+		},
+		// 3: client errors are not retried
+		{
+			method:     http.MethodGet,
+			statuses:   []int{http.StatusNotFound, http.StatusOK},
+			maxRetries: 3,
+			wantStatus: http.StatusNotFound,
+			wantCalls:  1,
+		},
+		// 4: non-idempotent requests are not retried
+		{
+			method:     http.MethodPost,
+			statuses:   []int{http.StatusServiceUnavailable, http.StatusOK},
+			maxRetries: 3,
+			wantStatus: http.StatusServiceUnavailable,
+			wantCalls:  1,
+		},
+	} {
+		calls := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.statuses[calls])
+			calls++
+		}))
+
+		client := &http.Client{Transport: newTestTransport(ProviderOptions{
+			Retry: RetryOptions{MaxRetries: tc.maxRetries, BaseDelay: time.Millisecond},
+		})}
+		req, _ := http.NewRequest(tc.method, ts.URL, nil)
+		resp, err := client.Do(req)
+		ts.Close()
+		if err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("#%v: got status %v, want %v", i, resp.StatusCode, tc.wantStatus)
+		}
+		if calls != tc.wantCalls {
+			t.Errorf("#%v: got %v calls, want %v", i, calls, tc.wantCalls)
+		}
+	}
+}
+
+func TestTransportBackoff(t *testing.T) {
+	now := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+	tr := newTestTransport(ProviderOptions{
+		Retry: RetryOptions{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second},
+	})
+	tr.now = func() time.Time { return now }
+
+	for i, tc := range []struct {
+		attempt    int
+		retryAfter string
+		want       time.Duration
+	}{
+		// 0: base delay
+		{attempt: 0, want: 100 * time.Millisecond},
+		// 1: exponential
+		{attempt: 2, want: 400 * time.Millisecond},
+		// 2: capped
+		{attempt: 10, want: time.Second},
+		// 3: Retry-After in seconds
+		{attempt: 0, retryAfter: "1", want: time.Second},
+		// 4: Retry-After is capped
+		{attempt: 0, retryAfter: "120", want: time.Second},
+		// 5: Retry-After in HTTP date
+		{attempt: 0, retryAfter: now.Add(500 * time.Millisecond).Format(http.TimeFormat), want: 0},
+		// 6: invalid Retry-After
+		{attempt: 1, retryAfter: "alpha", want: 200 * time.Millisecond},
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		if tc.retryAfter != "" {
+			resp.Header.Set("Retry-After", tc.retryAfter)
+		}
+		if got := tr.backoff(tc.attempt, resp); got != tc.want {
+			t.Errorf("#%v: got %v, want %v", i, got, tc.want)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i, tc := range []struct {
+		d       time.Duration
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		// 0: positive
+		{d: time.Second, wantMin: 500 * time.Millisecond, wantMax: time.Second},
+		// 1: zero
+		{d: 0},
+		// 2: negative
+		{d: -time.Second},
+	} {
+		if got := jitter(tc.d); got < tc.wantMin || got > tc.wantMax {
+			t.Errorf("#%v: got %v, want between %v and %v", i, got, tc.wantMin, tc.wantMax)
+		}
+	}
+}
+
+func TestTransportCircuitBreaker(t *testing.T) {
+	healthy := false
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if !healthy {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	now := time.Now()
+	tr := newTestTransport(ProviderOptions{
+		CircuitBreaker: CircuitBreakerOptions{FailureThreshold: 2, ResetTimeout: time.Minute},
+	})
+	tr.now = func() time.Time { return now }
+	client := &http.Client{Transport: tr}
+
+	get := func() error {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	// The circuit opens after the consecutive failures.
+	for i := 0; i < 2; i++ {
+		if err := get(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v, want %v", err, ErrCircuitOpen)
+	}
+	if calls != 2 {
+		t.Errorf("got %v calls, want 2", calls)
+	}
+
+	// A failed probe opens the circuit again.
+	now = now.Add(time.Minute)
+	if err := get(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v, want %v", err, ErrCircuitOpen)
+	}
+
+	// A successful probe closes the circuit.
+	healthy = true
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if err := get(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if calls != 5 {
+		t.Errorf("got %v calls, want 5", calls)
+	}
+
+}
+
+func TestTransportCircuitBreakerPerHost(t *testing.T) {
+	now := time.Now()
+	tr := newTestTransport(ProviderOptions{
+		CircuitBreaker: CircuitBreakerOptions{FailureThreshold: 1, ResetTimeout: time.Minute},
+	})
+
+	tr.breaker("nova.example.com").record(false, now)
+	if tr.breaker("nova.example.com").allow(now) {
+		t.Error("circuit of nova.example.com should be open")
+	}
+	if !tr.breaker("keystone.example.com").allow(now) {
+		t.Error("circuit of keystone.example.com should be closed")
+	}
+}
+
+func writePEM(t *testing.T, path, typ string, b []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestBaseTransportTLS(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "no client certificate", http.StatusUnauthorized)
+		}
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequestClientCert, MaxVersion: tls.VersionTLS12}
+	ts.StartTLS()
+	defer ts.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ts.Certificate().Raw)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "spire-server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "spire-server"}}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+
+	for i, tc := range []struct {
+		opts       TLSOptions
+		wantErr    bool
+		wantStatus int
+	}{
+		// 0: system roots don't trust the server
+		{
+			wantErr: true,
+		},
+		// 1: CA bundle
+		{
+			opts:       TLSOptions{CAFile: caFile},
+			wantStatus: http.StatusUnauthorized,
+		},
+		// 2: client certificate and server name override
+		{
+			opts:       TLSOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "example.com"},
+			wantStatus: http.StatusOK,
+		},
+		// 3: server name which the certificate isn't for
+		{
+			opts:    TLSOptions{CAFile: caFile, ServerName: "openstack.example.org"},
+			wantErr: true,
+		},
+		// 4: TLS version floor above the server
+		{
+			opts:    TLSOptions{CAFile: caFile, MinVersion: tls.VersionTLS13},
+			wantErr: true,
+		},
+	} {
+		rt, err := newBaseTransport(tc.opts)
+		if err != nil {
+			t.Errorf("#%v: unexpected error from newBaseTransport(): %v", i, err)
+			continue
+		}
+
+		resp, err := (&http.Client{Transport: rt}).Get(ts.URL)
+		if tc.wantErr {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("#%v: expected an error, got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%v: unexpected error: %v", i, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("#%v: got status %v, want %v", i, resp.StatusCode, tc.wantStatus)
+		}
+	}
+}
+
+func TestBaseTransportTLSError(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.pem")
+	if err := ioutil.WriteFile(invalid, []byte("alpha"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	for i, opts := range []TLSOptions{
+		// 0: missing CA file
+		{CAFile: filepath.Join(dir, "missing.pem")},
+		// 1: no certificate in CA file
+		{CAFile: invalid},
+		// 2: invalid client certificate
+		{CertFile: invalid, KeyFile: invalid},
+	} {
+		if _, err := newBaseTransport(opts); err == nil {
+			t.Errorf("#%v: expected an error, got nil", i)
+		}
+	}
+}
@@ -21,14 +21,15 @@ var (
 )
 
 type AidAttestationServer struct {
-	req  *nodeattestorv1.Challenge
-	resp *nodeattestorv1.PayloadOrChallengeResponse
+	challenges [][]byte
+	resp       []*nodeattestorv1.PayloadOrChallengeResponse
 	grpc.ServerStream
 }
 
-func NewAidAttestationStream() *AidAttestationServer {
+// NewAidAttestationStream returns a fake stream which delivers given challenges to the plugin in order.
+func NewAidAttestationStream(challenges ...[]byte) *AidAttestationServer {
 	return &AidAttestationServer{
-		req: new(nodeattestorv1.Challenge),
+		challenges: challenges,
 	}
 }
 
@@ -37,18 +38,39 @@ func (f *AidAttestationServer) Context() context.Context {
 }
 
 func (f *AidAttestationServer) Recv() (*nodeattestorv1.Challenge, error) {
-	req := f.req
-	f.req = nil
-	if req == nil {
+	if len(f.resp) == 0 || len(f.challenges) == 0 {
 		return nil, io.EOF
 	}
-	return req, nil
+	challenge := f.challenges[0]
+	f.challenges = f.challenges[1:]
+	return &nodeattestorv1.Challenge{
+		Challenge: challenge,
+	}, nil
 }
 
 func (f *AidAttestationServer) Send(resp *nodeattestorv1.PayloadOrChallengeResponse) error {
-	if f.resp != nil {
+	if len(f.resp) > 0 && resp.GetPayload() != nil {
 		return io.EOF
 	}
-	f.resp = resp
+	f.resp = append(f.resp, resp)
 	return nil
 }
+
+// Payload returns the attestation payload sent by the plugin.
+func (f *AidAttestationServer) Payload() []byte {
+	if len(f.resp) == 0 {
+		return nil
+	}
+	return f.resp[0].GetPayload()
+}
+
+// ChallengeResponses returns the challenge responses sent by the plugin.
+func (f *AidAttestationServer) ChallengeResponses() [][]byte {
+	var responses [][]byte
+	for _, resp := range f.resp {
+		if r := resp.GetChallengeResponse(); r != nil {
+			responses = append(responses, r)
+		}
+	}
+	return responses
+}
@@ -0,0 +1,39 @@
+/**
+ * Copyright 2021, Z Lab Corporation. All rights reserved.
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package openstack
+
+import (
+	"context"
+
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/projects"
+
+	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
+)
+
+type Identity struct {
+	// Projects are the projects ListProjects returns
+	Projects []projects.Project
+	// ListProjectsError is the error ListProjects returns
+	ListProjectsError error
+}
+
+var _ openstack.IdentityClient = (*Identity)(nil)
+
+// NewIdentity returns fake IdentityClient which returns given projects
+func NewIdentity(ps ...projects.Project) *Identity {
+	return &Identity{
+		Projects: ps,
+	}
+}
+
+func (f *Identity) ListProjects(_ context.Context) ([]projects.Project, error) {
+	if f.ListProjectsError != nil {
+		return nil, f.ListProjectsError
+	}
+	return append([]projects.Project(nil), f.Projects...), nil
+}
@@ -8,9 +8,15 @@
 package openstack
 
 import (
+	"context"
 	"errors"
 	"time"
 
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/availabilityzones"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/extendedserverattributes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/extendedstatus"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/instanceactions"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/keypairs"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
 
 	"github.com/zlabjp/spire-openstack-plugin/pkg/openstack"
@@ -20,32 +26,147 @@ type Instance struct {
 	projectID string
 	metaData  map[string]string
 	secGroup  []map[string]interface{}
-	created   time.Time
+
+	// Created is the time the instance was created, defaults to the time NewInstance is called
+	Created time.Time
+	// Updated is the time the instance was updated last, it is set when the metadata is changed
+	Updated time.Time
+	// ImageID is the ID of the image the instance was booted from
+	ImageID string
+	// AvailabilityZone is the availability zone of the instance, defaults to "nova"
+	AvailabilityZone string
+	// Hostname is the hostname of the instance, which Nova reports only to admins
+	Hostname *string
+	// Status is the status of the instance, defaults to ACTIVE
+	Status string
+	// ExtendedStatus is the extended status of the instance, defaults to a running instance
+	ExtendedStatus extendedstatus.ServerExtendedStatusExt
+	// Locked is the lock state of the instance
+	Locked bool
+	// Actions is the action history of the instance
+	Actions []instanceactions.InstanceAction
+	// KeyName is the name of the keypair the instance was booted with
+	KeyName string
+	// KeyPairs maps keypair names to their public keys in the authorized_keys format
+	KeyPairs map[string]string
+	// FlavorName is the name of the flavor embedded in the instance
+	FlavorName string
+	// Tags are the tags of the instance
+	Tags []string
+	// RegionName is the region of the compute endpoint
+	RegionName string
+	// Delay delays the response of Get, which returns the error of the context if it is done meanwhile
+	Delay time.Duration
 }
 
+var _ openstack.InstanceClient = (*Instance)(nil)
+
 // NewInstance returns fake InstanceClient which returns data including given projectID
-func NewInstance(projectID string, metaData map[string]string, secGroup []map[string]interface{}) openstack.InstanceClient {
+func NewInstance(projectID string, metaData map[string]string, secGroup []map[string]interface{}) *Instance {
+	now := time.Now()
 	return &Instance{
-		projectID: projectID,
-		metaData:  metaData,
-		secGroup:  secGroup,
-		created:   time.Now(),
-	}
-}
-
-func (f *Instance) Get(uuid string) (*servers.Server, error) {
-	return &servers.Server{
-		ID:             uuid,
-		Name:           "bravo",
-		TenantID:       f.projectID,
-		Addresses:      map[string]interface{}{},
-		Metadata:       f.metaData,
-		SecurityGroups: f.secGroup,
-		Created:        f.created,
-		Updated:        f.created,
+		projectID:        projectID,
+		metaData:         metaData,
+		secGroup:         secGroup,
+		Created:          now,
+		Updated:          now,
+		AvailabilityZone: "nova",
+		Status:           "ACTIVE",
+		ExtendedStatus: extendedstatus.ServerExtendedStatusExt{
+			VmState:    "active",
+			PowerState: extendedstatus.RUNNING,
+		},
+	}
+}
+
+func (f *Instance) Get(ctx context.Context, uuid string) (*openstack.Server, error) {
+	if f.Delay > 0 {
+		select {
+		case <-time.After(f.Delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	locked := f.Locked
+	var tags *[]string
+	if f.Tags != nil {
+		t := append([]string(nil), f.Tags...)
+		tags = &t
+	}
+	return &openstack.Server{
+		Server: servers.Server{
+			ID:             uuid,
+			Name:           "bravo",
+			TenantID:       f.projectID,
+			Addresses:      map[string]interface{}{},
+			Metadata:       copyMetadata(f.metaData),
+			SecurityGroups: f.secGroup,
+			KeyName:        f.KeyName,
+			Created:        f.Created,
+			Updated:        f.Updated,
+			Status:         f.Status,
+			Image:          map[string]interface{}{"id": f.ImageID},
+			Flavor:         map[string]interface{}{"original_name": f.FlavorName},
+			Tags:           tags,
+		},
+		ServerExtendedStatusExt: f.ExtendedStatus,
+		ServerAvailabilityZoneExt: availabilityzones.ServerAvailabilityZoneExt{
+			AvailabilityZone: f.AvailabilityZone,
+		},
+		ServerAttributesExt: extendedserverattributes.ServerAttributesExt{
+			Hostname: f.Hostname,
+		},
+		ServerLockedExt: openstack.ServerLockedExt{Locked: &locked},
 	}, nil
 }
 
+func (f *Instance) SetMetadata(_ context.Context, _, key, value string) error {
+	if f.metaData == nil {
+		f.metaData = make(map[string]string)
+	}
+	f.metaData[key] = value
+	f.Updated = time.Now()
+	return nil
+}
+
+func (f *Instance) DeleteMetadata(_ context.Context, _, key string) error {
+	delete(f.metaData, key)
+	f.Updated = time.Now()
+	return nil
+}
+
+func (f *Instance) GetKeyPair(_ context.Context, name, userID string) (*keypairs.KeyPair, error) {
+	pub, ok := f.KeyPairs[name]
+	if !ok {
+		return nil, errors.New("keypair not found")
+	}
+	return &keypairs.KeyPair{
+		Name:      name,
+		PublicKey: pub,
+		UserID:    userID,
+	}, nil
+}
+
+func (f *Instance) ListActions(_ context.Context, _ string) ([]instanceactions.InstanceAction, error) {
+	return f.Actions, nil
+}
+
+func (f *Instance) Region() string {
+	return f.RegionName
+}
+
+func copyMetadata(meta map[string]string) map[string]string {
+	if meta == nil {
+		return nil
+	}
+	m := make(map[string]string, len(meta))
+	for k, v := range meta {
+		m[k] = v
+	}
+	return m
+}
+
 type ErrorInstance struct {
 	message string
 }
@@ -57,6 +178,26 @@ func NewErrorInstance(msg string) openstack.InstanceClient {
 	}
 }
 
-func (f *ErrorInstance) Get(_ string) (*servers.Server, error) {
+func (f *ErrorInstance) Get(_ context.Context, _ string) (*openstack.Server, error) {
+	return nil, errors.New(f.message)
+}
+
+func (f *ErrorInstance) SetMetadata(_ context.Context, _, _, _ string) error {
+	return errors.New(f.message)
+}
+
+func (f *ErrorInstance) DeleteMetadata(_ context.Context, _, _ string) error {
+	return errors.New(f.message)
+}
+
+func (f *ErrorInstance) GetKeyPair(_ context.Context, _, _ string) (*keypairs.KeyPair, error) {
 	return nil, errors.New(f.message)
 }
+
+func (f *ErrorInstance) ListActions(_ context.Context, _ string) ([]instanceactions.InstanceAction, error) {
+	return nil, errors.New(f.message)
+}
+
+func (f *ErrorInstance) Region() string {
+	return ""
+}
@@ -23,6 +23,11 @@ type AttestPluginStream struct {
 	req  *nodeattestorv1.AttestRequest
 	resp *nodeattestorv1.AttestResponse
 	grpc.ServerStream
+
+	// ChallengeHandler answers the challenges sent by the plugin, as the agent does.
+	ChallengeHandler func(challenge []byte) ([]byte, error)
+	// Ctx is the context of the stream. Defaults to context.Background().
+	Ctx context.Context
 }
 
 func NewAttestStream(data string) *AttestPluginStream {
@@ -36,6 +41,9 @@ func NewAttestStream(data string) *AttestPluginStream {
 }
 
 func (f *AttestPluginStream) Context() context.Context {
+	if f.Ctx != nil {
+		return f.Ctx
+	}
 	return ctx
 }
 
@@ -49,9 +57,30 @@ func (f *AttestPluginStream) Recv() (*nodeattestorv1.AttestRequest, error) {
 }
 
 func (f *AttestPluginStream) Send(resp *nodeattestorv1.AttestResponse) error {
+	if challenge := resp.GetChallenge(); challenge != nil {
+		if f.ChallengeHandler == nil {
+			return io.EOF
+		}
+		answer, err := f.ChallengeHandler(challenge)
+		if err != nil {
+			return err
+		}
+		f.req = &nodeattestorv1.AttestRequest{
+			Request: &nodeattestorv1.AttestRequest_ChallengeResponse{
+				ChallengeResponse: answer,
+			},
+		}
+		return nil
+	}
+
 	if f.resp != nil {
 		return io.EOF
 	}
 	f.resp = resp
 	return nil
 }
+
+// AgentAttributes returns the attributes sent by the plugin, if any.
+func (f *AttestPluginStream) AgentAttributes() *nodeattestorv1.AgentAttributes {
+	return f.resp.GetAgentAttributes()
+}